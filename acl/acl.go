@@ -0,0 +1,223 @@
+// Package acl decides which operations a client can do on which files.
+//
+// The rules are loaded from a text file, a client is allowed to do an operation when a
+// rule for the client, one of its groups or every client allows the operation on a
+// prefix of the name. Everything that is not allowed is denied.
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+)
+
+// ErrPermissionDenied is returned when the rules do not allow the operation.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Operation is a kind of access to a file or a volume.
+type Operation string
+
+const (
+	// OperationRead reads the content, the information or the tags of a file.
+	OperationRead Operation = "read"
+	// OperationWrite creates a file or changes its content or tags.
+	OperationWrite Operation = "write"
+	// OperationDelete deletes a file.
+	OperationDelete Operation = "delete"
+	// OperationList lists the files, the prefix of the rule is compared with the prefix of the list.
+	OperationList Operation = "list"
+	// OperationVolume creates, reads, writes and deletes volumes, the prefix is compared with the volume name.
+	OperationVolume Operation = "volume"
+)
+
+var operations = []Operation{OperationRead, OperationWrite, OperationDelete, OperationList, OperationVolume}
+
+// everyone is the subject of the rules for every client.
+const everyone = "*"
+
+// Rule allows a subject to do some operations on the names that start with Prefix.
+//
+// The subject is a client id, a group name starting with '@' or "*" for every client.
+// An empty Prefix matches every name.
+type Rule struct {
+	Subject    string
+	Operations []Operation
+	Prefix     string
+}
+
+// ACL is a set of rules and groups, it is safe to use from multiple goroutines after it is created.
+type ACL struct {
+	rules []Rule
+	// groups has the groups of every client id
+	groups map[string][]string
+}
+
+// New returns an ACL with the rules, groups maps the name of a group to its client ids.
+func New(rules []Rule, groups map[string][]string) *ACL {
+	a := &ACL{rules: rules, groups: make(map[string][]string)}
+	for group, members := range groups {
+		for _, member := range members {
+			a.groups[member] = append(a.groups[member], group)
+		}
+	}
+	return a
+}
+
+// Load reads the rules of a file, see Parse for the format.
+func Load(path string) (*ACL, error) {
+	slog.Info("Loading the access rules", "file", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// Parse reads the groups and the rules, one per line, the empty lines and the lines that
+// start with '#' are ignored:
+//
+//	group <name> <clientID> [clientID ...]
+//	allow <clientID|@group|*> <operation[,operation ...]|*> <prefix|*>
+//
+// The operations are read, write, delete, list and volume, "*" allows all of them.
+// A prefix "*" matches every name.
+func Parse(r io.Reader) (*ACL, error) {
+	var rules []Rule
+	groups := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		switch fields[0] {
+		case "group":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: expected a group name and its members", line)
+			}
+			groups[fields[1]] = append(groups[fields[1]], fields[2:]...)
+		case "allow":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("line %d: expected a subject, the operations and a prefix", line)
+			}
+			ops, err := parseOperations(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			prefix := fields[3]
+			if prefix == "*" {
+				prefix = ""
+			}
+			rules = append(rules, Rule{Subject: fields[1], Operations: ops, Prefix: prefix})
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive=%s", line, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if group, ok := strings.CutPrefix(rule.Subject, "@"); ok {
+			if _, exists := groups[group]; !exists {
+				return nil, fmt.Errorf("the group=%s of a rule is not defined", group)
+			}
+		}
+	}
+	return New(rules, groups), nil
+}
+
+// parseOperations parses a list of operations separated by commas.
+func parseOperations(s string) ([]Operation, error) {
+	if s == "*" {
+		return operations, nil
+	}
+
+	var ops []Operation
+	for name := range strings.SplitSeq(s, ",") {
+		op := Operation(name)
+		if !slices.Contains(operations, op) {
+			return nil, fmt.Errorf("unknown operation=%s", name)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// Allowed reports if a rule allows the client to do the operation on name.
+func (a *ACL) Allowed(clientID string, op Operation, name string) bool {
+	for _, rule := range a.rules {
+		if !a.matches(rule.Subject, clientID) {
+			continue
+		}
+		if slices.Contains(rule.Operations, op) && strings.HasPrefix(name, rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports if the subject of a rule is the client.
+func (a *ACL) matches(subject string, clientID string) bool {
+	if subject == everyone || subject == clientID {
+		return true
+	}
+	group, ok := strings.CutPrefix(subject, "@")
+	return ok && slices.Contains(a.groups[clientID], group)
+}
+
+// Authorize returns an error wrapping ErrPermissionDenied when the client can not execute the message.
+//
+// The chunks, the commit and the abort of an upload are allowed, the file of the upload is
+// authorized when the upload begins and only the client that began it can continue it.
+func (a *ACL) Authorize(clientID string, msg protocol.Message) error {
+	op, name, ok := operation(msg)
+	if !ok {
+		return nil
+	}
+	if !a.Allowed(clientID, op, name) {
+		return fmt.Errorf("%w: client=%s operation=%s name=%s", ErrPermissionDenied, clientID, op, name)
+	}
+	return nil
+}
+
+// operation returns the operation of a message and the name it is applied to, ok is false
+// for the messages that do not need authorization.
+func operation(msg protocol.Message) (op Operation, name string, ok bool) {
+	switch msg.MessageType {
+	case protocol.MessageRead, protocol.MessageReadRange, protocol.MessageStat, protocol.MessageGetTags:
+		return OperationRead, msg.Filename, true
+	case protocol.MessageWrite, protocol.MessageUpdate, protocol.MessageWriteAt, protocol.MessageSetTags,
+		protocol.MessageUploadBegin:
+		return OperationWrite, msg.Filename, true
+	case protocol.MessageDelete:
+		return OperationDelete, msg.Filename, true
+	case protocol.MessageList:
+		return OperationList, msg.Prefix, true
+	case protocol.MessageVolumeCreate, protocol.MessageVolumeRead, protocol.MessageVolumeWrite, protocol.MessageVolumeDelete:
+		return OperationVolume, msg.Filename, true
+	case protocol.MessageUploadChunk, protocol.MessageUploadCommit, protocol.MessageUploadAbort:
+		return "", "", false
+	default:
+		// the unknown messages are rejected by the handler
+		return "", "", false
+	}
+}
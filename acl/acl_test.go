@@ -0,0 +1,81 @@
+package acl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+const rules = `
+# readers of the reports
+group analysts client-01 client-02
+allow @analysts read,list reports/
+allow client-03 * ingest/
+allow * read public/
+allow admin-01 * *
+`
+
+func TestAllowed(t *testing.T) {
+	a, err := Parse(strings.NewReader(rules))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		clientID string
+		op       Operation
+		file     string
+		want     bool
+	}{
+		{"a group member reads its prefix", "client-02", OperationRead, "reports/2024.csv", true},
+		{"a group member can not write its prefix", "client-02", OperationWrite, "reports/2024.csv", false},
+		{"a group member can not read other prefix", "client-01", OperationRead, "ingest/raw.bin", false},
+		{"a client with all the operations", "client-03", OperationDelete, "ingest/raw.bin", true},
+		{"every client reads the public files", "client-09", OperationRead, "public/index.html", true},
+		{"an unknown client is denied", "client-09", OperationRead, "reports/2024.csv", false},
+		{"the admin can do everything", "admin-01", OperationVolume, "disk0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, a.Allowed(tt.clientID, tt.op, tt.file))
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a, err := Parse(strings.NewReader(rules))
+	assert.Nil(t, err)
+
+	err = a.Authorize("client-01", protocol.Message{MessageType: protocol.MessageList, Prefix: "reports/"})
+	assert.Nil(t, err)
+	err = a.Authorize("client-01", protocol.Message{MessageType: protocol.MessageList, Prefix: ""})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	err = a.Authorize("client-01", protocol.Message{MessageType: protocol.MessageUploadBegin, Filename: "reports/new.csv"})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+
+	// the chunks are authorized when the upload begins
+	err = a.Authorize("client-01", protocol.Message{MessageType: protocol.MessageUploadChunk, UploadID: 1})
+	assert.Nil(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{"unknown directive", "deny client-01 read *"},
+		{"unknown operation", "allow client-01 read,rename *"},
+		{"missing prefix", "allow client-01 read"},
+		{"undefined group", "allow @ops read *"},
+		{"group without members", "group ops"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.rules))
+			assert.NotNil(t, err)
+		})
+	}
+}
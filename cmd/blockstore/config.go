@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+)
+
+// Config is the configuration of the blockstore server.
+//
+// The values are read from the flags and from a JSON file with the same names as the flags,
+// the flags given in the command line override the values of the file. The environment
+// variables read by the server before the flags existed are the defaults of the matching values.
+type Config struct {
+	Listen                  string     `json:"listen"`
+	NBDListen               string     `json:"nbd-listen"`
+	DataDir                 string     `json:"data-dir"`
+	BlocksDir               string     `json:"blocks-dir"`
+	MetadataFile            string     `json:"metadata-file"`
+	BlockSize               int        `json:"block-size"`
+	HandshakeTimeout        Duration   `json:"handshake-timeout"`
+	ShutdownTimeout         Duration   `json:"shutdown-timeout"`
+	IdleTimeout             Duration   `json:"idle-timeout"`
+	ReadTimeout             Duration   `json:"read-timeout"`
+	WriteTimeout            Duration   `json:"write-timeout"`
+	LogLevel                slog.Level `json:"log-level"`
+	MaxInFlightRequests     int        `json:"max-in-flight-requests"`
+	MaxConnections          int        `json:"max-connections"`
+	MaxConnectionsPerClient int        `json:"max-connections-per-client"`
+	MaxFrameSize            int        `json:"max-frame-size"`
+	KeysFile                string     `json:"keys-file"`
+	ACLFile                 string     `json:"acl-file"`
+	TLSCert                 string     `json:"tls-cert"`
+	TLSKey                  string     `json:"tls-key"`
+	TLSClientCA             string     `json:"tls-client-ca"`
+}
+
+// Duration is a time.Duration written as "10s" in the config file.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses a flag value, it implements flag.Value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("a duration must be a string like \"10s\": %w", err)
+	}
+	return d.Set(s)
+}
+
+// defaultShutdownTimeout is the time the requests in flight have to finish when the server stops.
+const defaultShutdownTimeout = 30 * time.Second
+
+// defaultConfig returns the configuration used when a value is not in the flags or in the file.
+//
+// The keys, the access rules, the certificates and the location of the data are taken from
+// the STG_* environment variables, a deployment configured with them keeps its security
+// and its files.
+func defaultConfig() Config {
+	return Config{
+		Listen:              server.ApplicationPort,
+		DataDir:             "data",
+		BlocksDir:           os.Getenv("STG_BLOCKS_DIR"),
+		MetadataFile:        os.Getenv("STG_METADATA_FILE"),
+		KeysFile:            os.Getenv("STG_KEYS_FILE"),
+		ACLFile:             os.Getenv("STG_ACL_FILE"),
+		TLSCert:             os.Getenv("STG_TLS_CERT"),
+		TLSKey:              os.Getenv("STG_TLS_KEY"),
+		TLSClientCA:         os.Getenv("STG_TLS_CLIENT_CA"),
+		BlockSize:           storage.DefaultBlockSize,
+		HandshakeTimeout:    Duration(server.DefaultHandshakeTimeout),
+		ShutdownTimeout:     Duration(defaultShutdownTimeout),
+		LogLevel:            slog.LevelInfo,
+		MaxInFlightRequests: server.DefaultMaxInFlightRequests,
+		MaxConnections:      server.DefaultMaxConnections,
+		MaxFrameSize:        server.DefaultMaxFrameSize,
+		IdleTimeout:         Duration(server.DefaultIdleTimeout),
+		ReadTimeout:         Duration(server.DefaultReadTimeout),
+		WriteTimeout:        Duration(server.DefaultWriteTimeout),
+	}
+}
+
+// flagSet returns the flags that write the values of c.
+func (c *Config) flagSet(output io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("blockstore", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&c.Listen, "listen", c.Listen, "address of the storage protocol listener")
+	flags.StringVar(&c.NBDListen, "nbd-listen", c.NBDListen, "address of the NBD listener, the NBD clients are not authenticated, it is disabled when it is empty")
+	flags.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory of the blocks and the metadata")
+	flags.StringVar(&c.BlocksDir, "blocks-dir", c.BlocksDir, "directory of the blocks, the default is the blocks directory of data-dir (STG_BLOCKS_DIR)")
+	flags.StringVar(&c.MetadataFile, "metadata-file", c.MetadataFile, "file of the metadata, the default is metadata.json in data-dir (STG_METADATA_FILE)")
+	flags.IntVar(&c.BlockSize, "block-size", c.BlockSize, "size in bytes of the blocks, it can not change after the first file is saved")
+	flags.Var(&c.HandshakeTimeout, "handshake-timeout", "maximum time to complete the handshake of a connection")
+	flags.Var(&c.ShutdownTimeout, "shutdown-timeout", "maximum time to finish the requests in flight when the server stops")
+	flags.TextVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of the logs: debug, info, warn or error")
+	flags.IntVar(&c.MaxInFlightRequests, "max-in-flight-requests", c.MaxInFlightRequests, "requests of a protocol version 2 connection processed at the same time")
+	flags.IntVar(&c.MaxConnections, "max-connections", c.MaxConnections, "maximum connections of the server, 0 does not limit them")
+	flags.IntVar(&c.MaxConnectionsPerClient, "max-connections-per-client", c.MaxConnectionsPerClient, "maximum connections with the same client id, 0 does not limit them")
+	flags.IntVar(&c.MaxFrameSize, "max-frame-size", c.MaxFrameSize, "maximum size in bytes of a request, the bigger files are saved with uploads, 0 does not limit it")
+	flags.Var(&c.IdleTimeout, "idle-timeout", "time a connection without requests waits for the next request before it is closed, 0 keeps it open")
+	flags.Var(&c.ReadTimeout, "read-timeout", "maximum time to receive a request after its first byte, 0 does not limit it")
+	flags.Var(&c.WriteTimeout, "write-timeout", "maximum time of every write of a response, 0 does not limit it")
+	flags.StringVar(&c.KeysFile, "keys-file", c.KeysFile, "file with the secrets of the clients, the clients are not authenticated when it is empty (STG_KEYS_FILE)")
+	flags.StringVar(&c.ACLFile, "acl-file", c.ACLFile, "file with the access rules, every client can do every operation when it is empty (STG_ACL_FILE)")
+	flags.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate of the server, the connections use TLS when it is set (STG_TLS_CERT)")
+	flags.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM key of the server certificate (STG_TLS_KEY)")
+	flags.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "PEM certificates of the CAs of the client certificates, it enables mutual TLS (STG_TLS_CLIENT_CA)")
+	return flags
+}
+
+// loadConfig reads the configuration from the command line arguments.
+//
+// The -config flag is the path of a JSON file, the values of the file replace the defaults
+// and the other flags of the command line replace the values of the file.
+func loadConfig(args []string, output io.Writer) (Config, error) {
+	cfg := defaultConfig()
+	flags := cfg.flagSet(output)
+	configFile := flags.String("config", "", "JSON file with the configuration, the flags override its values")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+
+	if *configFile != "" {
+		fileConfig, err := readConfigFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+
+		// apply the flags of the command line again over the values of the file
+		overrides := fileConfig.flagSet(io.Discard)
+		var setErr error
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && setErr == nil {
+				setErr = overrides.Set(f.Name, f.Value.String())
+			}
+		})
+		if setErr != nil {
+			return Config{}, setErr
+		}
+		cfg = fileConfig
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile reads a JSON config file, the values that are not in the file have the default value.
+func readConfigFile(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("the config file could not be read: %w", err)
+	}
+	defer file.Close()
+
+	cfg := defaultConfig()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("the config file=%s is not valid: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate returns an error with every value of the configuration that is not valid.
+func (c Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen=%q is not a valid address: %w", c.Listen, err))
+	}
+	if _, _, err := net.SplitHostPort(c.NBDListen); c.NBDListen != "" && err != nil {
+		errs = append(errs, fmt.Errorf("nbd-listen=%q is not a valid address: %w", c.NBDListen, err))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data-dir can not be empty"))
+	}
+	if c.BlockSize < storage.MinBlockSize || c.BlockSize > storage.MaxBlockSize {
+		errs = append(errs, fmt.Errorf("block-size=%d must be between %d and %d", c.BlockSize, storage.MinBlockSize, storage.MaxBlockSize))
+	}
+	if c.HandshakeTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("handshake-timeout=%s must be positive", c.HandshakeTimeout))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown-timeout=%s must be positive", c.ShutdownTimeout))
+	}
+	if c.MaxInFlightRequests < 1 {
+		errs = append(errs, fmt.Errorf("max-in-flight-requests=%d must be positive", c.MaxInFlightRequests))
+	}
+	if c.MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("max-connections=%d can not be negative", c.MaxConnections))
+	}
+	if c.MaxConnectionsPerClient < 0 {
+		errs = append(errs, fmt.Errorf("max-connections-per-client=%d can not be negative", c.MaxConnectionsPerClient))
+	}
+	if c.MaxFrameSize < 0 || c.MaxFrameSize > math.MaxUint32 {
+		errs = append(errs, fmt.Errorf("max-frame-size=%d must be between 0 and %d", c.MaxFrameSize, uint32(math.MaxUint32)))
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("idle-timeout=%s can not be negative", c.IdleTimeout))
+	}
+	if c.ReadTimeout < 0 {
+		errs = append(errs, fmt.Errorf("read-timeout=%s can not be negative", c.ReadTimeout))
+	}
+	if c.WriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("write-timeout=%s can not be negative", c.WriteTimeout))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, errors.New("tls-client-ca needs tls-cert and tls-key"))
+	}
+	// without keys or client certificates the client ID of the handshake is not verified
+	if c.ACLFile != "" && c.KeysFile == "" && c.TLSClientCA == "" {
+		errs = append(errs, errors.New("acl-file needs keys-file or tls-client-ca to authenticate the clients"))
+	}
+	return errors.Join(errs...)
+}
+
+// openStore opens the store in the data directory with the block size of the config,
+// blocks-dir and metadata-file replace the locations inside the data directory.
+func (c Config) openStore() (*storage.Store, error) {
+	blocksDir, metadataFile := c.BlocksDir, c.MetadataFile
+	if blocksDir == "" {
+		blocksDir = filepath.Join(c.DataDir, "blocks")
+	}
+	if metadataFile == "" {
+		metadataFile = filepath.Join(c.DataDir, "metadata.json")
+	}
+	for _, dir := range []string{blocksDir, filepath.Dir(metadataFile)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("the directory=%s could not be created: %w", dir, err)
+		}
+	}
+
+	backend := storage.NewDiskBackend(blocksDir, metadataFile)
+	store, err := storage.NewStoreWithOptions(backend, storage.StoreOptions{BlockSize: c.BlockSize})
+	if err != nil {
+		return nil, err
+	}
+	if err := store.LoadMetadata(); err != nil {
+		return nil, fmt.Errorf("the metadata of data-dir=%s can not be loaded: %w", c.DataDir, err)
+	}
+	return store, nil
+}
+
+// serverOptions returns the options of the server with the store, the keys, the access
+// rules and the certificates of the config.
+func (c Config) serverOptions(store *storage.Store) ([]server.Option, error) {
+	opts := []server.Option{
+		server.WithAddress(c.Listen),
+		server.WithStore(store),
+		server.WithHandshakeTimeout(time.Duration(c.HandshakeTimeout)),
+		server.WithMaxInFlightRequests(c.MaxInFlightRequests),
+		server.WithMaxConnections(c.MaxConnections),
+		server.WithMaxConnectionsPerClient(c.MaxConnectionsPerClient),
+		server.WithMaxFrameSize(uint32(c.MaxFrameSize)),
+		server.WithIdleTimeout(time.Duration(c.IdleTimeout)),
+		server.WithReadTimeout(time.Duration(c.ReadTimeout)),
+		server.WithWriteTimeout(time.Duration(c.WriteTimeout)),
+	}
+
+	if c.KeysFile != "" {
+		keys, err := server.LoadKeys(c.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("keys-file: %w", err)
+		}
+		opts = append(opts, server.WithKeys(keys))
+	}
+	if c.ACLFile != "" {
+		rules, err := acl.Load(c.ACLFile)
+		if err != nil {
+			return nil, fmt.Errorf("acl-file: %w", err)
+		}
+		opts = append(opts, server.WithACL(rules))
+	}
+	if c.TLSCert != "" {
+		tlsConfig, err := server.TLSConfig(c.TLSCert, c.TLSKey, c.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls-cert: %w", err)
+		}
+		opts = append(opts, server.WithTLSConfig(tlsConfig))
+	}
+	return opts, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(nil, io.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultConfig(), cfg)
+
+	file := filepath.Join(t.TempDir(), "blockstore.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`{
+		"listen": ":9001",
+		"data-dir": "/var/lib/stgblock",
+		"block-size": 65536,
+		"handshake-timeout": "5s",
+		"log-level": "warn"
+	}`), 0644))
+
+	// the flags override the values of the file
+	cfg, err = loadConfig([]string{"-config", file, "-listen", "127.0.0.1:9002", "-log-level", "debug"}, io.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:9002", cfg.Listen)
+	assert.Equal(t, "/var/lib/stgblock", cfg.DataDir)
+	assert.Equal(t, 65536, cfg.BlockSize)
+	assert.Equal(t, Duration(5*time.Second), cfg.HandshakeTimeout)
+	assert.Equal(t, slog.LevelDebug, cfg.LogLevel)
+	assert.Equal(t, defaultConfig().NBDListen, cfg.NBDListen)
+
+	// the NBD listener is disabled by default
+	assert.Equal(t, "", defaultConfig().NBDListen)
+	cfg, err = loadConfig([]string{"-nbd-listen", server.NBDPort}, io.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, server.NBDPort, cfg.NBDListen)
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	t.Setenv("STG_KEYS_FILE", "/etc/stgblock/keys")
+	t.Setenv("STG_ACL_FILE", "/etc/stgblock/acl")
+	t.Setenv("STG_TLS_CERT", "/etc/stgblock/server.pem")
+	t.Setenv("STG_TLS_KEY", "/etc/stgblock/server-key.pem")
+	t.Setenv("STG_BLOCKS_DIR", "/var/lib/stgblock/blocks")
+	t.Setenv("STG_METADATA_FILE", "/var/lib/stgblock/metadata.json")
+
+	// the environment variables are the defaults, the flags override them
+	cfg, err := loadConfig([]string{"-acl-file", "/tmp/acl"}, io.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, "/etc/stgblock/keys", cfg.KeysFile)
+	assert.Equal(t, "/tmp/acl", cfg.ACLFile)
+	assert.Equal(t, "/etc/stgblock/server.pem", cfg.TLSCert)
+	assert.Equal(t, "/etc/stgblock/server-key.pem", cfg.TLSKey)
+	assert.Equal(t, "/var/lib/stgblock/blocks", cfg.BlocksDir)
+	assert.Equal(t, "/var/lib/stgblock/metadata.json", cfg.MetadataFile)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	assert.Nil(t, os.WriteFile(unknown, []byte(`{"port": 8001}`), 0644))
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"invalid address", []string{"-listen", "8001"}, "listen=\"8001\" is not a valid address"},
+		{"invalid NBD address", []string{"-nbd-listen", "10809"}, "nbd-listen=\"10809\" is not a valid address"},
+		{"small block size", []string{"-block-size", "100"}, "block-size=100 must be between"},
+		{"negative timeout", []string{"-handshake-timeout", "-1s"}, "handshake-timeout=-1s must be positive"},
+		{"zero shutdown timeout", []string{"-shutdown-timeout", "0s"}, "shutdown-timeout=0s must be positive"},
+		{"negative idle timeout", []string{"-idle-timeout", "-1s"}, "idle-timeout=-1s can not be negative"},
+		{"big frame size", []string{"-max-frame-size", "8589934592"}, "max-frame-size=8589934592 must be between 0 and 4294967295"},
+		{"negative connections", []string{"-max-connections-per-client", "-1"}, "max-connections-per-client=-1 can not be negative"},
+		{"certificate without key", []string{"-tls-cert", "server.pem"}, "tls-cert and tls-key must be set together"},
+		{"ACL without authentication", []string{"-acl-file", "acl"}, "acl-file needs keys-file or tls-client-ca"},
+		{"unknown field in the file", []string{"-config", unknown}, "unknown field \"port\""},
+		{"missing file", []string{"-config", filepath.Join(dir, "missing.json")}, "the config file could not be read"},
+		{"unknown flag", []string{"-port", "8001"}, "flag provided but not defined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(tt.args, io.Discard)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+
+	// every invalid value is reported
+	_, err := loadConfig([]string{"-block-size", "100", "-max-in-flight-requests", "0"}, io.Discard)
+	assert.ErrorContains(t, err, "block-size=100")
+	assert.ErrorContains(t, err, "max-in-flight-requests=0")
+}
+
+func TestOpenStore(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.BlockSize = storage.MinBlockSize
+
+	store, err := cfg.openStore()
+	assert.Nil(t, err)
+	assert.Nil(t, store.WriteFile("config.txt", []byte("small blocks")))
+
+	// the block size can not change after a file is saved
+	cfg.BlockSize = storage.DefaultBlockSize
+	_, err = cfg.openStore()
+	assert.ErrorIs(t, err, storage.ErrBlockSizeMismatch)
+
+	// blocks-dir and metadata-file replace the locations inside the data directory
+	cfg.BlocksDir = filepath.Join(t.TempDir(), "blocks")
+	cfg.MetadataFile = filepath.Join(t.TempDir(), "meta", "metadata.json")
+	store, err = cfg.openStore()
+	assert.Nil(t, err)
+	assert.Nil(t, store.WriteFile("config.txt", []byte("other location")))
+	assert.FileExists(t, cfg.MetadataFile)
+}
@@ -1,27 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/nbd"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
 )
 
 func main() {
+	cfg, err := loadConfig(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "blockstore: invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	slog.SetLogLoggerLevel(cfg.LogLevel)
+
 	slog.Info("========== Starting Block Storage Application ==========")
-	listener, err := server.StartApplication()
+	store, err := cfg.openStore()
+	if err != nil {
+		slog.Error("Failed to open the storage", "error", err)
+		os.Exit(1)
+	}
+
+	opts, err := cfg.serverOptions(store)
+	if err != nil {
+		slog.Error("Failed to load the server configuration", "error", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
 		slog.Error("Failed to start the TCP server", "error", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
+	srv := server.New(opts...)
+	go srv.Serve(listener)
+
+	var nbdServer *nbd.Server
+	if cfg.NBDListen != "" {
+		slog.Warn("The NBD clients are not authenticated, every client that reaches the NBD listener can read and write every export", "address", cfg.NBDListen)
+		nbdServer, err = server.ListenNBD(cfg.NBDListen, store)
+		if err != nil {
+			slog.Error("Failed to start the NBD server", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Create a channel to listen for OS interrupt signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	<-quit
+	slog.Info("Shutting down, waiting for the requests in flight", "timeout", cfg.ShutdownTimeout)
+
+	// the connections are closed when the requests finish or the timeout expires,
+	// the metadata is saved before Shutdown of the TCP server returns
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if nbdServer != nil {
+		if err := nbdServer.Shutdown(ctx); err != nil {
+			slog.Error("The NBD server did not stop gracefully", "error", err)
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("The TCP server did not stop gracefully", "error", err)
+	}
 	slog.Info("========== Finish Block Storage Application ==========")
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -10,12 +11,32 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pablohdzvizcarra/storage-software-cookbook/handler"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/client"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/stgclient"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/processor"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 	"github.com/stretchr/testify/assert"
 )
 
-func startTestTCPClient() (net.Conn, error) {
-	conn, err := net.Dial("tcp", "localhost:8001")
+// startTestServer starts a server on a random port with an empty store, the server is
+// stopped when the test finishes.
+func startTestServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return listener.Addr().String()
+}
+
+func startTestTCPClient(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		fmt.Printf("Error connecting to server: %v\n", err)
 		return nil, err
@@ -26,18 +47,11 @@ func startTestTCPClient() (net.Conn, error) {
 
 func TestReceiveErrorHandshakeResponse(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -54,7 +68,7 @@ func TestReceiveErrorHandshakeResponse(t *testing.T) {
 			name: "send wrong protocol version in handshake and get error response",
 			args: []byte{
 				0x53, 0x54, 0x47, // magic protocol number
-				0x02,                                           // protocol version
+				0x03,                                           // protocol version
 				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // reserved bytes
 				0x04,                   // client id length
 				0x44, 0x4F, 0x39, 0x31, // client id
@@ -62,7 +76,7 @@ func TestReceiveErrorHandshakeResponse(t *testing.T) {
 			},
 			want: []byte{
 				0x01,       // status (1 byte)
-				0x00, 0x02, // Code error (2 bytes)
+				0x00, 0x03, // Code error (2 bytes)
 				0x0A, // endChar
 			},
 			wantErr: false,
@@ -93,18 +107,11 @@ func TestReceiveErrorHandshakeResponse(t *testing.T) {
 
 func TestReceiveSuccessHandshakeResponse(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -161,18 +168,11 @@ func TestReceiveSuccessHandshakeResponse(t *testing.T) {
 
 func TestSendWriteMessage(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -287,18 +287,11 @@ func TestSendWriteMessage(t *testing.T) {
 
 func TestSendReadMessage(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -434,18 +427,11 @@ func TestSendReadMessage(t *testing.T) {
 
 func TestSendUpdateMessage(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -626,18 +612,11 @@ func TestSendUpdateMessage(t *testing.T) {
 }
 func TestSendDeleteMessage(t *testing.T) {
 	// =================== Start the main application server for testing ===================
-	listener, err := server.StartApplication()
-	if err != nil {
-		t.Fatalf("failed to start the application: %v", err)
-	}
-	defer listener.Close()
-
-	// Allow the server a moment to start
-	time.Sleep(100 * time.Millisecond)
+	addr := startTestServer(t)
 	// =====================================================================================
 
 	// Create the client to send messages to the application
-	conn, err := startTestTCPClient()
+	conn, err := startTestTCPClient(addr)
 	if err != nil {
 		t.FailNow()
 	}
@@ -1083,3 +1062,500 @@ func TestSendDeleteMessage(t *testing.T) {
 // 		})
 // 	}
 // }
+
+func TestSendVersion2Frames(t *testing.T) {
+	// =================== Start the main application server for testing ===================
+	addr := startTestServer(t)
+	// =====================================================================================
+
+	conn, err := startTestTCPClient(addr)
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	handshakeMessage := []byte{
+		0x53, 0x54, 0x47, // magic protocol number
+		0x02,                                           // protocol version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // reserved bytes
+		0x04,                   // client id length
+		0x44, 0x4F, 0x39, 0x32, // client id
+		0x0A, // endChar
+	}
+	_, err = conn.Write(handshakeMessage)
+	assert.Nil(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp, err := reader.ReadBytes('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x00), resp[0])
+
+	// two requests are sent without waiting for the responses
+	frames := []byte{
+		0x00, 0x00, 0x00, 0x0E, // frame length
+		0x00, 0x00, 0x00, 0x07, // request id
+		0x01,                                           // READ opcode
+		0x08,                                           // filename length
+		0x6D, 0x69, 0x73, 0x73, 0x69, 0x6E, 0x67, 0x31, // filename: "missing1"
+		0x00, 0x00, 0x00, 0x0E, // frame length
+		0x00, 0x00, 0x00, 0x09, // request id
+		0x0C,                                           // STAT opcode
+		0x08,                                           // filename length
+		0x6D, 0x69, 0x73, 0x73, 0x69, 0x6E, 0x67, 0x32, // filename: "missing2"
+	}
+	_, err = conn.Write(frames)
+	assert.Nil(t, err)
+
+	// the responses can arrive in any order, the request id identifies them
+	responses := make(map[uint32][]byte)
+	for range 2 {
+		header := make([]byte, 9)
+		_, err := io.ReadFull(reader, header)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(5+7), binary.BigEndian.Uint32(header[0:4]))
+
+		serverResp := make([]byte, 7)
+		_, err = io.ReadFull(reader, serverResp)
+		assert.Nil(t, err)
+		responses[binary.BigEndian.Uint32(header[4:8])] = append([]byte{header[8]}, serverResp...)
+	}
+
+	notFound := []byte{0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+	assert.Equal(t, append([]byte{0x01}, notFound...), responses[7])
+	assert.Equal(t, append([]byte{0x0C}, notFound...), responses[9])
+}
+
+func TestTwoServers(t *testing.T) {
+	// every server has its own store and its own clients
+	first := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	second := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	for _, srv := range []*server.Server{first, second} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start the application: %v", err)
+		}
+		go srv.Serve(listener)
+	}
+	assert.Eventually(t, func() bool { return first.Addr() != nil && second.Addr() != nil }, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, first.Addr().String(), second.Addr().String())
+
+	firstClient, err := stgclient.Dial(first.Addr().String(), "client-01")
+	assert.Nil(t, err)
+	defer firstClient.Close()
+	secondClient, err := stgclient.Dial(second.Addr().String(), "client-01")
+	assert.Nil(t, err)
+	defer secondClient.Close()
+
+	assert.Nil(t, firstClient.Write("two-servers.txt", []byte("Hello World")))
+	data, err := firstClient.Read("two-servers.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+	_, err = secondClient.Read("two-servers.txt")
+	assert.ErrorIs(t, err, stgclient.ErrNotFound)
+
+	// after Shutdown the server does not accept connections and the first one keeps serving
+	addr := second.Addr().String()
+	assert.Nil(t, second.Shutdown(context.Background()))
+	assert.Nil(t, second.Addr())
+	_, err = stgclient.Dial(addr, "client-02")
+	assert.NotNil(t, err)
+	_, err = firstClient.Read("two-servers.txt")
+	assert.Nil(t, err)
+	assert.Nil(t, first.Shutdown(context.Background()))
+}
+
+func TestServerAddr(t *testing.T) {
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	defer srv.Shutdown(context.Background())
+	assert.Nil(t, srv.Addr())
+
+	// Addr is the address of the first listener until it is closed
+	var listeners []net.Listener
+	for range 2 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start the application: %v", err)
+		}
+		listeners = append(listeners, listener)
+		go srv.Serve(listener)
+		assert.Eventually(t, func() bool { return srv.Addr() != nil }, time.Second, 10*time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, listeners[0].Addr().String(), srv.Addr().String())
+
+	listeners[0].Close()
+	assert.Eventually(t, func() bool { return srv.Addr().String() == listeners[1].Addr().String() }, time.Second, 10*time.Millisecond)
+}
+
+// blockingProcessor waits for release before it processes a message.
+type blockingProcessor struct {
+	*processor.DefaultMessageProcessor
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingProcessor) ProcessReply(message []byte, client *client.Client) processor.Reply {
+	b.started <- struct{}{}
+	<-b.release
+	return b.DefaultMessageProcessor.ProcessReply(message, client)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	blocking := &blockingProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	srv := server.New(server.WithStore(store), server.WithProcessor(func() server.Processor {
+		blocking.DefaultMessageProcessor = &processor.DefaultMessageProcessor{Handler: handler.NewWithStore(store)}
+		return blocking
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+
+	busy, err := stgclient.DialOptions(listener.Addr().String(), stgclient.Options{ClientID: "client-01", Version: protocol.ProtocolVersion2})
+	assert.Nil(t, err)
+	defer busy.Close()
+
+	written := make(chan error)
+	go func() { written <- busy.Write("graceful.txt", []byte("Hello World")) }()
+	<-blocking.started
+
+	stopped := make(chan error)
+	go func() { stopped <- srv.Shutdown(context.Background()) }()
+
+	// the server waits for the request in flight and does not accept new connections
+	assert.Eventually(t, func() bool { return srv.Addr() == nil }, time.Second, 10*time.Millisecond)
+	_, err = stgclient.Dial(listener.Addr().String(), "client-02")
+	assert.NotNil(t, err)
+	select {
+	case err := <-stopped:
+		t.Fatalf("the server stopped with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	assert.Nil(t, <-written)
+	assert.Nil(t, <-stopped)
+
+	// the client received the notice and the file is saved with its metadata
+	_, err = busy.Stat("graceful.txt")
+	assert.ErrorIs(t, err, stgclient.ErrServerGoingAway)
+	data, err := store.ReadFile("graceful.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+}
+
+func TestShutdownNotifiesIdleClients(t *testing.T) {
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+
+	conn, err := startTestTCPClient(listener.Addr().String())
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion, ClientID: "client-01"})
+	assert.Nil(t, err)
+	_, err = conn.Write(handshake)
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	_, err = protocol.ReadHandshakeResponse(reader, 0)
+	assert.Nil(t, err)
+
+	idle, err := stgclient.DialOptions(listener.Addr().String(), stgclient.Options{ClientID: "client-02", Version: protocol.ProtocolVersion2})
+	assert.Nil(t, err)
+	defer idle.Close()
+	assert.Nil(t, idle.Write("idle.txt", []byte("Hello World")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+
+	// the notice is sent in the frame of the version of every connection
+	notice, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.EncodeGoAway(protocol.ProtocolVersion), notice)
+	_, err = idle.Stat("idle.txt")
+	assert.ErrorIs(t, err, stgclient.ErrServerGoingAway)
+}
+
+func TestShutdownDrainsPartialFrames(t *testing.T) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	srv := server.New(server.WithStore(store))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+
+	conn, err := startTestTCPClient(listener.Addr().String())
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion, ClientID: "client-01"})
+	assert.Nil(t, err)
+	_, err = conn.Write(handshake)
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	_, err = protocol.ReadHandshakeResponse(reader, 0)
+	assert.Nil(t, err)
+
+	message, err := protocol.EncodeMessage(protocol.Message{
+		MessageType: protocol.MessageWrite, FilenameLength: 11, Filename: "partial.txt", Size: 11, RawData: []byte("Hello World"),
+	})
+	assert.Nil(t, err)
+	frame := append(binary.BigEndian.AppendUint32(nil, uint32(len(message))), message...)
+
+	// the shutdown starts while the frame is received
+	_, err = conn.Write(frame[:10])
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("the server stopped while a frame was received: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = conn.Write(frame[10:])
+	assert.Nil(t, err)
+
+	// the request is processed before the notice
+	received, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	notice := protocol.EncodeGoAway(protocol.ProtocolVersion)
+	if assert.Greater(t, len(received), 4+len(notice)) {
+		response, err := protocol.DecodeResponseMessage(received[4 : len(received)-len(notice)])
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.StatusOk, response.Status)
+		assert.Equal(t, notice, received[len(received)-len(notice):])
+	}
+	assert.Nil(t, <-stopped)
+
+	data, err := store.ReadFile("partial.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	blocking := &blockingProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(blocking.release)
+	srv := server.New(server.WithStore(store), server.WithProcessor(func() server.Processor {
+		blocking.DefaultMessageProcessor = &processor.DefaultMessageProcessor{Handler: handler.NewWithStore(store)}
+		return blocking
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+
+	busy, err := stgclient.DialOptions(listener.Addr().String(), stgclient.Options{ClientID: "client-01", Version: protocol.ProtocolVersion2})
+	assert.Nil(t, err)
+	defer busy.Close()
+	go busy.Stat("deadline.txt")
+	<-blocking.started
+
+	// the connection is closed when the request does not finish before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = busy.Stat("deadline.txt")
+	assert.NotNil(t, err)
+}
+
+func TestPipeliningDoesNotReadPastMaxInFlight(t *testing.T) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	blocking := &blockingProcessor{started: make(chan struct{}, 4), release: make(chan struct{})}
+	srv := server.New(server.WithStore(store), server.WithMaxInFlightRequests(2), server.WithProcessor(func() server.Processor {
+		blocking.DefaultMessageProcessor = &processor.DefaultMessageProcessor{Handler: handler.NewWithStore(store)}
+		return blocking
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+	defer close(blocking.release)
+
+	conn, err := startTestTCPClient(listener.Addr().String())
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion2, ClientID: "client-01"})
+	assert.Nil(t, err)
+	_, err = conn.Write(handshake)
+	assert.Nil(t, err)
+	_, err = protocol.ReadHandshakeResponse(bufio.NewReader(conn), 0)
+	assert.Nil(t, err)
+
+	// the requests in flight take every slot of the connection
+	for requestID := range uint32(2) {
+		message, err := protocol.EncodeMessage(protocol.Message{
+			MessageType: protocol.MessageWrite, FilenameLength: 12, Filename: "pipeline.txt", Size: 11, RawData: []byte("Hello World"),
+		})
+		assert.Nil(t, err)
+		_, err = conn.Write(protocol.EncodeFrameV2(requestID, message))
+		assert.Nil(t, err)
+		<-blocking.started
+	}
+
+	// the next big frame is not read until a request finishes, the client can not send it
+	big := protocol.EncodeFrameV2(2, append([]byte{byte(protocol.MessageWrite)}, make([]byte, 32<<20)...))
+	assert.Nil(t, conn.SetWriteDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = conn.Write(big)
+	var netErr net.Error
+	if assert.ErrorAs(t, err, &netErr) {
+		assert.True(t, netErr.Timeout())
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	start := func(opts ...server.Option) string {
+		srv := server.New(append([]server.Option{server.WithBackend(storage.NewMemoryBackend())}, opts...)...)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to start the application: %v", err)
+		}
+		go srv.Serve(listener)
+		t.Cleanup(func() { srv.Shutdown(context.Background()) })
+		return listener.Addr().String()
+	}
+
+	// dial connects a client, it waits until the server releases the closed connections
+	dial := func(addr string, clientID string) *stgclient.Client {
+		var client *stgclient.Client
+		assert.Eventually(t, func() bool {
+			var err error
+			client, err = stgclient.Dial(addr, clientID)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		return client
+	}
+
+	// the connections of a client id are rejected in the handshake
+	addr := start(server.WithMaxConnectionsPerClient(1))
+	first := dial(addr, "client-01")
+	_, err := stgclient.Dial(addr, "client-01")
+	assert.ErrorIs(t, err, stgclient.ErrTooManyConnections)
+	first.Close()
+	dial(addr, "client-01").Close()
+
+	// a connection that did not send the handshake counts in the limit of the server
+	addr = start(server.WithMaxConnections(2))
+	first = dial(addr, "client-01")
+	defer first.Close()
+	pending, err := startTestTCPClient(addr)
+	assert.Nil(t, err)
+	_, err = stgclient.Dial(addr, "client-02")
+	assert.ErrorIs(t, err, stgclient.ErrTooManyConnections)
+
+	// the connection over the limit of the server receives the error in the handshake response
+	rejected, err := startTestTCPClient(addr)
+	assert.Nil(t, err)
+	defer rejected.Close()
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion, ClientID: "client-03"})
+	assert.Nil(t, err)
+	_, err = rejected.Write(handshake)
+	assert.Nil(t, err)
+	response, err := io.ReadAll(rejected)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status: protocol.StatusError, Error: protocol.ErrorTooManyConnections,
+	}), response)
+
+	// the place of a closed connection is available for the next client
+	pending.Close()
+	dial(addr, "client-02").Close()
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()), server.WithHandshakeTimeout(50*time.Millisecond),
+		server.WithIdleTimeout(200*time.Millisecond), server.WithReadTimeout(50*time.Millisecond))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+	addr := listener.Addr().String()
+
+	// the deadline of the handshake does not apply to the requests
+	client, err := stgclient.Dial(addr, "client-01")
+	assert.Nil(t, err)
+	defer client.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, client.Write("timeouts.txt", []byte("Hello World")))
+
+	// an idle connection is closed after the idle timeout
+	_, err = client.Read("timeouts.txt")
+	assert.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Read("timeouts.txt")
+	assert.NotNil(t, err)
+
+	// a frame that is not completed in the read timeout closes the connection
+	conn, err := startTestTCPClient(addr)
+	if err != nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion, ClientID: "client-02"})
+	assert.Nil(t, err)
+	_, err = conn.Write(handshake)
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	_, err = protocol.ReadHandshakeResponse(reader, 0)
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte{0x00, 0x00})
+	assert.Nil(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	rest, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()), server.WithMaxFrameSize(1024))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+	addr := listener.Addr().String()
+
+	// the server discards the big frames and keeps the connection
+	for _, version := range []byte{protocol.ProtocolVersion, protocol.ProtocolVersion2} {
+		client, err := stgclient.DialOptions(addr, stgclient.Options{ClientID: "client-01", Version: version})
+		assert.Nil(t, err)
+		assert.ErrorIs(t, client.Write("big-file.txt", make([]byte, 2048)), stgclient.ErrBadRequest)
+		assert.Nil(t, client.Write("small.txt", []byte("Hello World")))
+		client.Close()
+	}
+
+	// the client knows the limit and does not send the big requests
+	client, err := stgclient.DialOptions(addr, stgclient.Options{ClientID: "client-02", Capabilities: protocol.CapabilityMaxFrameSize})
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, uint32(1024), client.MaxFrameSize())
+	assert.ErrorIs(t, client.Write("big-file.txt", make([]byte, 2048)), stgclient.ErrFrameTooLarge)
+	data, err := client.Read("small.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+}
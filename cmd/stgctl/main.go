@@ -0,0 +1,362 @@
+// stgctl is a command-line client for a running blockstore server.
+//
+// Usage:
+//
+//	stgctl [flags] <command> [arguments]
+//
+// The flags are:
+//
+//	-addr host:port       address of the server, localhost:8001 by default
+//	-id clientID          client id sent in the handshake, stgctl by default
+//	-secret-file file     file with the secret of the client in hex
+//	-tls                  connect with TLS
+//	-tls-ca file          PEM certificates of the CAs that sign the server certificate
+//	-tls-cert file, -tls-key file
+//	                      PEM client certificate and key for mutual TLS
+//
+// The commands are:
+//
+//	put [-tag key=value] <name> [file]
+//	                      save a new file, the content is read from file or stdin and
+//	                      sent in chunks, it does not need to fit in memory
+//	get <name> [file]     read a file, the content is written to file or stdout
+//	update <name> [file]  replace the content of a file with file or stdin
+//	rm <name>             delete a file
+//	stat <name>           print the information of a file
+//	ls [prefix]           list the files, optionally only the files whose name starts with prefix
+//	tag <name> [key=value ...]
+//	                      print the tags of a file or set them, an empty value removes the tag
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/stgclient"
+)
+
+const usage = `usage: stgctl [flags] <command> [arguments]
+
+flags:
+  -addr host:port       address of the server, localhost:8001 by default
+  -id clientID          client id sent in the handshake, stgctl by default
+  -secret-file file     file with the secret of the client in hex
+  -tls                  connect with TLS
+  -tls-ca file          PEM certificates of the CAs that sign the server certificate
+  -tls-cert file, -tls-key file
+                        PEM client certificate and key for mutual TLS
+
+commands:
+  put [-tag key=value] <name> [file]
+                        save a new file, the content is read from file or stdin and
+                        sent in chunks, it does not need to fit in memory
+  get <name> [file]     read a file, the content is written to file or stdout
+  update <name> [file]  replace the content of a file with file or stdin
+  rm <name>             delete a file
+  stat <name>           print the information of a file
+  ls [prefix]           list the files, optionally only the files whose name starts with prefix
+  tag <name> [key=value ...]
+                        print the tags of a file or set them, an empty value removes the tag
+`
+
+// errUsage is returned when the command or its arguments are not valid.
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("stgctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	addr := flags.String("addr", "localhost:8001", "address of the blockstore server")
+	clientID := flags.String("id", "stgctl", "client id sent in the handshake")
+	secretFile := flags.String("secret-file", "", "file with the secret of the client in hex, it is required when the server authenticates the clients")
+	useTLS := flags.Bool("tls", false, "connect with TLS, it is enabled by the other tls flags")
+	tlsCA := flags.String("tls-ca", "", "file with the PEM certificates of the CAs that sign the server certificate, the system CAs are used when it is empty")
+	tlsCert := flags.String("tls-cert", "", "file with the PEM client certificate for mutual TLS")
+	tlsKey := flags.String("tls-key", "", "file with the PEM key of the client certificate")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	opts := stgclient.Options{ClientID: *clientID}
+	if *secretFile != "" {
+		secret, err := readSecret(*secretFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "stgctl: %v\n", err)
+			return 1
+		}
+		opts.Secret = secret
+	}
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		config, err := tlsConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintf(stderr, "stgctl: %v\n", err)
+			return 1
+		}
+		opts.TLSConfig = config
+	}
+
+	client, err := stgclient.DialOptions(*addr, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "stgctl: could not connect to %s: %v\n", *addr, err)
+		return 1
+	}
+	defer client.Close()
+
+	err = execute(client, flags.Arg(0), flags.Args()[1:], stdin, stdout)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(stderr, "stgctl: %v\n%s", err, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "stgctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readSecret reads the secret of the client from a file with the secret in hex.
+func readSecret(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("the secret of %s is not valid hex: %w", path, err)
+	}
+	return secret, nil
+}
+
+// tlsConfig returns the TLS configuration of the connection, caFile replaces the system CAs
+// and the client certificate is loaded when certFile and keyFile are set.
+func tlsConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("the file=%s does not contain PEM certificates", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("the client certificate could not be loaded: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// execute runs a single command with the connected client.
+func execute(client *stgclient.Client, command string, args []string, stdin io.Reader, stdout io.Writer) error {
+	switch command {
+	case "put", "update":
+		tags := tagsFlag{}
+		if command == "put" {
+			flags := flag.NewFlagSet("put", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			flags.Var(tags, "tag", "tag saved with the file, it can be repeated")
+			if err := flags.Parse(args); err != nil {
+				return fmt.Errorf("%w: %v", errUsage, err)
+			}
+			args = flags.Args()
+		}
+
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%w: %s needs a name and an optional file", errUsage, command)
+		}
+
+		if command == "put" {
+			input, err := openInput(args[1:], stdin)
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+
+			_, err = client.Upload(args[0], input, tags)
+			return err
+		}
+
+		data, err := readInput(args[1:], stdin)
+		if err != nil {
+			return err
+		}
+		_, err = client.Update(args[0], data)
+		return err
+	case "get":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("%w: get needs a name and an optional file", errUsage)
+		}
+		output, err := createOutput(args[1:], stdout)
+		if err != nil {
+			return err
+		}
+
+		_, err = client.Download(args[0], output)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case "rm":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: rm needs a name", errUsage)
+		}
+		return client.Delete(args[0])
+	case "stat":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: stat needs a name", errUsage)
+		}
+		stat, err := client.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(stdout, "name: %s\nsize: %d\nblocks: %d\ncreated: %s\nmodified: %s\nchecksum: %s\nowner: %s\n",
+			stat.Name, stat.Size, stat.Blocks, formatTime(stat.Created), formatTime(stat.Modified), stat.Checksum, stat.Owner)
+		if err != nil {
+			return err
+		}
+		for _, key := range slices.Sorted(maps.Keys(stat.Tags)) {
+			if _, err := fmt.Fprintf(stdout, "tag: %s=%s\n", key, stat.Tags[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "ls":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: ls accepts an optional prefix", errUsage)
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+
+		// request pages until the server returns an empty cursor
+		cursor := ""
+		for {
+			result, err := client.List(prefix, cursor, 0)
+			if err != nil {
+				return err
+			}
+			for _, stat := range result.Files {
+				if _, err := fmt.Fprintf(stdout, "%d\t%s\t%s\n", stat.Size, formatTime(stat.Modified), stat.Name); err != nil {
+					return err
+				}
+			}
+
+			if result.NextCursor == "" {
+				return nil
+			}
+			cursor = result.NextCursor
+		}
+	case "tag":
+		if len(args) < 1 {
+			return fmt.Errorf("%w: tag needs a name", errUsage)
+		}
+
+		var tags map[string]string
+		var err error
+		if len(args) == 1 {
+			tags, err = client.Tags(args[0])
+		} else {
+			pairs := tagsFlag{}
+			for _, pair := range args[1:] {
+				if err := pairs.Set(pair); err != nil {
+					return fmt.Errorf("%w: %v", errUsage, err)
+				}
+			}
+			tags, err = client.SetTags(args[0], pairs)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, key := range slices.Sorted(maps.Keys(tags)) {
+			if _, err := fmt.Fprintf(stdout, "%s=%s\n", key, tags[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+}
+
+// tagsFlag collects the key=value arguments of the tags.
+type tagsFlag map[string]string
+
+func (t tagsFlag) String() string {
+	return fmt.Sprint(map[string]string(t))
+}
+
+func (t tagsFlag) Set(value string) error {
+	key, tagValue, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid tag %q, the format is key=value", value)
+	}
+	t[key] = tagValue
+	return nil
+}
+
+// formatTime formats t in RFC 3339, "-" is returned for an unknown time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// readInput reads the content of the file in args or stdin when args is empty or "-".
+func readInput(args []string, stdin io.Reader) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(args[0])
+}
+
+// openInput opens the file in args or returns stdin when args is empty or "-".
+func openInput(args []string, stdin io.Reader) (io.ReadCloser, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	return os.Open(args[0])
+}
+
+// createOutput creates the file in args or returns stdout when args is empty or "-".
+func createOutput(args []string, stdout io.Writer) (io.WriteCloser, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return nopWriteCloser{stdout}, nil
+	}
+	return os.Create(args[0])
+}
+
+// nopWriteCloser is a io.WriteCloser whose Close does nothing, stdout is never closed.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
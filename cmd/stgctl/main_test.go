@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommands(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+	srv := server.New(server.WithBackend(storage.NewMemoryBackend()))
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+	addr := listener.Addr().String()
+
+	// runCommand executes stgctl and returns the exit code, stdout and stderr
+	runCommand := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(append([]string{"-addr", addr}, args...), strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, _, _ := runCommand("Hello World", "put", "stgctl-file.txt")
+	assert.Equal(t, 0, code)
+
+	code, stdout, _ := runCommand("", "get", "stgctl-file.txt")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "Hello World", stdout)
+
+	input := filepath.Join(t.TempDir(), "input.txt")
+	assert.Nil(t, os.WriteFile(input, []byte("Hello Earth"), 0644))
+	code, _, _ = runCommand("", "update", "stgctl-file.txt", input)
+	assert.Equal(t, 0, code)
+
+	output := filepath.Join(t.TempDir(), "output.txt")
+	code, _, _ = runCommand("", "get", "stgctl-file.txt", output)
+	assert.Equal(t, 0, code)
+	data, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello Earth"), data)
+
+	code, stdout, _ = runCommand("", "stat", "stgctl-file.txt")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "size: 11")
+	assert.Contains(t, stdout, "blocks: 1")
+	assert.Contains(t, stdout, "owner: stgctl")
+
+	code, _, _ = runCommand("other", "put", "-tag", "team=ingest", "other-file.txt")
+	assert.Equal(t, 0, code)
+	code, stdout, _ = runCommand("", "tag", "other-file.txt", "retention=30d")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "retention=30d\nteam=ingest\n", stdout)
+	code, stdout, _ = runCommand("", "tag", "other-file.txt", "team=")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "retention=30d\n", stdout)
+	code, stdout, _ = runCommand("", "ls", "stgctl-")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "stgctl-file.txt")
+	assert.NotContains(t, stdout, "other-file.txt")
+
+	code, _, _ = runCommand("", "rm", "stgctl-file.txt")
+	assert.Equal(t, 0, code)
+
+	code, _, stderr := runCommand("", "get", "stgctl-file.txt")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "file not found")
+
+	code, _, _ = runCommand("", "unknown")
+	assert.Equal(t, 2, code)
+}
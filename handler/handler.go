@@ -3,43 +3,266 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
 
 	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 )
 
+// ErrUploadNotFound is returned when a message uses an upload that does not exist or belongs to other client.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Handler executes the client messages against a storage.Store.
+//
+// The uploads started with MessageUploadBegin are kept by the Handler until they are
+// committed or aborted, only the client that started an upload can use it.
+type Handler struct {
+	store *storage.Store
+
+	uploadsMutex sync.Mutex
+	uploads      map[uint64]*storage.Upload
+	lastUploadID uint64
+}
+
+// New creates a Handler that saves the files in the given backend.
+func New(backend storage.Backend) *Handler {
+	return &Handler{store: storage.NewStore(backend)}
+}
+
+// NewWithStore creates a Handler that uses an already created Store.
+func NewWithStore(store *storage.Store) *Handler {
+	return &Handler{store: store}
+}
+
+// Store returns the storage.Store used by the handler.
+func (h *Handler) Store() *storage.Store {
+	return h.store
+}
+
+// HandleMessage interprets the Message using the default storage.
+//
+// See Handler.HandleMessage for details.
+func HandleMessage(msg protocol.Message) ([]byte, error) {
+	return NewWithStore(storage.Default()).HandleMessage(msg)
+}
+
 // HandleMessage interprets the Message and calls the appropriate function to handle it.
 //
 // This functions assumes that the Message is well-formed and does not perform any validation.
 // It is the responsibility of the caller to ensure that the Message is valid.
-func HandleMessage(msg protocol.Message) ([]byte, error) {
+func (h *Handler) HandleMessage(msg protocol.Message) ([]byte, error) {
 	switch msg.MessageType {
 	case protocol.MessageWrite:
-		err := storage.WriteFile(msg.Filename, msg.RawData)
+		err := h.store.WriteFileWith(msg.Filename, msg.RawData, storage.WriteOptions{Owner: msg.ClientID, Tags: msg.Tags})
 		if err != nil {
-			return nil, fmt.Errorf("error writing file %s: %v", msg.Filename, err)
+			return nil, fmt.Errorf("error writing file %s: %w", msg.Filename, err)
 		}
 		return nil, nil
 	case protocol.MessageRead:
-		data, err := storage.ReadFile(msg.Filename)
+		data, err := h.store.ReadFile(msg.Filename)
 		if err != nil {
-			return nil, fmt.Errorf("error reading the file=%s from storage: %v", msg.Filename, err)
+			return nil, fmt.Errorf("error reading the file=%s from storage: %w", msg.Filename, err)
 		}
 		return data, nil
+	case protocol.MessageReadRange:
+		data, err := h.store.ReadRange(msg.Filename, int64(msg.Offset), int(msg.Length))
+		if err != nil {
+			return nil, fmt.Errorf("error reading the range offset=%d length=%d of the file=%s: %w", msg.Offset, msg.Length, msg.Filename, err)
+		}
+		return data, nil
+	case protocol.MessageWriteAt:
+		err := h.store.WriteAt(msg.Filename, int64(msg.Offset), msg.RawData)
+		if err != nil {
+			return nil, fmt.Errorf("error writing the file=%s at offset=%d: %w", msg.Filename, msg.Offset, err)
+		}
+		return nil, nil
 	case protocol.MessageDelete:
-		_, err := storage.DeleteFile(msg.Filename)
+		_, err := h.store.DeleteFile(msg.Filename)
 		if err != nil {
-			return nil, fmt.Errorf("error while deleting the file=%s from storage error=%v", msg.Filename, err)
+			return nil, fmt.Errorf("error while deleting the file=%s from storage error=%w", msg.Filename, err)
 		}
 		return nil, nil
 	case protocol.MessageUpdate:
-		data, err := storage.UpdateFile(msg.Filename, msg.RawData)
+		data, err := h.store.UpdateFile(msg.Filename, msg.RawData)
 		if err != nil {
-			return nil, fmt.Errorf("error while updating the file=%s error=%v", msg.Filename, err)
+			return nil, fmt.Errorf("error while updating the file=%s error=%w", msg.Filename, err)
 		}
 		return data, nil
+	case protocol.MessageVolumeCreate:
+		err := h.store.CreateVolume(msg.Filename, int64(msg.VolumeSize), int(msg.SectorSize))
+		if err != nil {
+			return nil, fmt.Errorf("error creating the volume=%s: %w", msg.Filename, err)
+		}
+		return nil, nil
+	case protocol.MessageVolumeRead:
+		data, err := h.store.ReadVolume(msg.Filename, msg.Offset, msg.Length)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the volume=%s lba=%d: %w", msg.Filename, msg.Offset, err)
+		}
+		return data, nil
+	case protocol.MessageVolumeWrite:
+		err := h.store.WriteVolume(msg.Filename, msg.Offset, msg.RawData)
+		if err != nil {
+			return nil, fmt.Errorf("error writing the volume=%s lba=%d: %w", msg.Filename, msg.Offset, err)
+		}
+		return nil, nil
+	case protocol.MessageVolumeDelete:
+		err := h.store.DeleteVolume(msg.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting the volume=%s: %w", msg.Filename, err)
+		}
+		return nil, nil
+	case protocol.MessageStat:
+		info, err := h.store.Stat(msg.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the information of the file=%s: %w", msg.Filename, err)
+		}
+		return protocol.EncodeStatPayload(fileStat(info)), nil
+	case protocol.MessageSetTags:
+		tags, err := h.store.SetTags(msg.Filename, msg.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("error setting the tags of the file=%s: %w", msg.Filename, err)
+		}
+		return protocol.EncodeTagsPayload(tags), nil
+	case protocol.MessageGetTags:
+		tags, err := h.store.Tags(msg.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the tags of the file=%s: %w", msg.Filename, err)
+		}
+		return protocol.EncodeTagsPayload(tags), nil
+	case protocol.MessageUploadBegin:
+		upload, err := h.store.CreateUpload(msg.Filename, storage.WriteOptions{Owner: msg.ClientID, Tags: msg.Tags})
+		if err != nil {
+			return nil, fmt.Errorf("error starting the upload of the file=%s: %w", msg.Filename, err)
+		}
+		return protocol.EncodeUploadPayload(h.addUpload(upload)), nil
+	case protocol.MessageUploadChunk:
+		upload, err := h.upload(msg.UploadID, msg.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := upload.Write(msg.RawData); err != nil {
+			return nil, fmt.Errorf("error writing a chunk of the upload=%d: %w", msg.UploadID, err)
+		}
+		return nil, nil
+	case protocol.MessageUploadCommit:
+		upload, err := h.removeUpload(msg.UploadID, msg.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if err := upload.Commit(); err != nil {
+			return nil, fmt.Errorf("error committing the upload=%d of the file=%s: %w", msg.UploadID, upload.Filename(), err)
+		}
+		return nil, nil
+	case protocol.MessageUploadAbort:
+		upload, err := h.removeUpload(msg.UploadID, msg.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		if err := upload.Abort(); err != nil {
+			return nil, fmt.Errorf("error aborting the upload=%d of the file=%s: %w", msg.UploadID, upload.Filename(), err)
+		}
+		return nil, nil
+	case protocol.MessageList:
+		files, next, err := h.store.List(msg.Prefix, msg.Cursor, int(msg.Length))
+		if err != nil {
+			return nil, fmt.Errorf("error listing the files with prefix=%s: %w", msg.Prefix, err)
+		}
+
+		result := protocol.ListResult{NextCursor: next}
+		for _, info := range files {
+			result.Files = append(result.Files, fileStat(info))
+		}
+		return protocol.EncodeListPayload(result), nil
 	default:
 		return nil, fmt.Errorf("unknown message type: %v", msg.MessageType)
 	}
 }
+
+// OpenFile returns a reader that streams the content of a file one block at a time,
+// it is used to answer the read messages without loading the full file in memory.
+//
+// The caller must close the reader.
+func (h *Handler) OpenFile(msg protocol.Message) (*storage.FileReader, error) {
+	reader, err := h.store.Open(msg.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the file=%s from storage: %w", msg.Filename, err)
+	}
+	return reader, nil
+}
+
+// addUpload saves an upload and returns its ID.
+func (h *Handler) addUpload(upload *storage.Upload) uint64 {
+	h.uploadsMutex.Lock()
+	defer h.uploadsMutex.Unlock()
+
+	if h.uploads == nil {
+		h.uploads = make(map[uint64]*storage.Upload)
+	}
+	h.lastUploadID++
+	h.uploads[h.lastUploadID] = upload
+	return h.lastUploadID
+}
+
+// upload returns the upload with id when it was started by clientID.
+func (h *Handler) upload(id uint64, clientID string) (*storage.Upload, error) {
+	h.uploadsMutex.Lock()
+	defer h.uploadsMutex.Unlock()
+
+	upload, ok := h.uploads[id]
+	if !ok || upload.Owner() != clientID {
+		return nil, fmt.Errorf("%w: upload=%d", ErrUploadNotFound, id)
+	}
+	return upload, nil
+}
+
+// removeUpload removes the upload with id when it was started by clientID and returns it.
+func (h *Handler) removeUpload(id uint64, clientID string) (*storage.Upload, error) {
+	h.uploadsMutex.Lock()
+	defer h.uploadsMutex.Unlock()
+
+	upload, ok := h.uploads[id]
+	if !ok || upload.Owner() != clientID {
+		return nil, fmt.Errorf("%w: upload=%d", ErrUploadNotFound, id)
+	}
+	delete(h.uploads, id)
+	return upload, nil
+}
+
+// AbortUploads discards the uploads started by clientID that were not committed,
+// it is called when the connection of the client is closed.
+func (h *Handler) AbortUploads(clientID string) {
+	h.uploadsMutex.Lock()
+	var aborted []*storage.Upload
+	for id, upload := range h.uploads {
+		if upload.Owner() == clientID {
+			aborted = append(aborted, upload)
+			delete(h.uploads, id)
+		}
+	}
+	h.uploadsMutex.Unlock()
+
+	for _, upload := range aborted {
+		slog.Info("Aborting an upload that was not committed", "client", clientID, "file", upload.Filename())
+		if err := upload.Abort(); err != nil {
+			slog.Error("Error aborting the upload", "client", clientID, "file", upload.Filename(), "error", err)
+		}
+	}
+}
+
+// fileStat converts the information of a file into the protocol format.
+func fileStat(info storage.FileInfo) protocol.FileStat {
+	return protocol.FileStat{
+		Name:     info.Name,
+		Size:     uint64(info.Size),
+		Blocks:   uint32(info.Blocks),
+		Created:  info.Created,
+		Modified: info.Modified,
+		Checksum: info.Checksum,
+		Owner:    info.Owner,
+		Tags:     info.Tags,
+	}
+}
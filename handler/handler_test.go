@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +28,9 @@ func TestHandleMessage(t *testing.T) {
 		},
 	}
 
+	// the package level function uses the default store
+	storage.SetDefault(storage.NewStore(storage.NewMemoryBackend()))
+
 	for name, test := range tests {
 		_, err := HandleMessage(test.input)
 		t.Logf("Running test: %s", name)
@@ -37,3 +42,91 @@ func TestHandleMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleMessageWithInjectedBackend(t *testing.T) {
+	h := New(storage.NewMemoryBackend())
+
+	_, err := h.HandleMessage(protocol.Message{
+		MessageType: protocol.MessageWrite,
+		Filename:    "data.txt",
+		Size:        5,
+		RawData:     []byte("Hello"),
+	})
+	assert.Nil(t, err)
+
+	data, err := h.HandleMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: "data.txt"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello"), data)
+
+	// the default storage does not see the file saved in the injected backend
+	_, err = New(storage.NewMemoryBackend()).HandleMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: "data.txt"})
+	assert.NotNil(t, err)
+}
+
+func TestHandleUploadMessages(t *testing.T) {
+	h := New(storage.NewMemoryBackend())
+
+	payload, err := h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadBegin, Filename: "data.txt", ClientID: "client-01"})
+	assert.Nil(t, err)
+	uploadID, err := protocol.DecodeUploadPayload(payload)
+	assert.Nil(t, err)
+
+	for _, chunk := range []string{"Hello", " ", "World"} {
+		_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadChunk, UploadID: uploadID, RawData: []byte(chunk), ClientID: "client-01"})
+		assert.Nil(t, err)
+	}
+
+	// only the client that started the upload can use it
+	_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadCommit, UploadID: uploadID, ClientID: "client-02"})
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// the file is not visible before the commit
+	_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: "data.txt"})
+	assert.NotNil(t, err)
+
+	_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadCommit, UploadID: uploadID, ClientID: "client-01"})
+	assert.Nil(t, err)
+
+	data, err := h.HandleMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: "data.txt"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+
+	// a committed upload can not be used again
+	_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadChunk, UploadID: uploadID, RawData: []byte("!"), ClientID: "client-01"})
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// the uploads of a client are aborted when it disconnects
+	payload, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadBegin, Filename: "other.txt", ClientID: "client-01"})
+	assert.Nil(t, err)
+	uploadID, _ = protocol.DecodeUploadPayload(payload)
+	h.AbortUploads("client-01")
+
+	_, err = h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadCommit, UploadID: uploadID, ClientID: "client-01"})
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = h.Store().Stat("other.txt")
+	assert.NotNil(t, err)
+}
+
+func TestHandleUploadBeginLimit(t *testing.T) {
+	// every connection has its own Handler, the limit is shared by the handlers of the store
+	store := storage.NewStore(storage.NewMemoryBackend())
+	first, second := NewWithStore(store), NewWithStore(store)
+
+	begin := func(h *Handler, clientID string, i int) error {
+		filename := fmt.Sprintf("file-%s-%d.txt", clientID, i)
+		_, err := h.HandleMessage(protocol.Message{MessageType: protocol.MessageUploadBegin, Filename: filename, ClientID: clientID})
+		return err
+	}
+
+	for i := range storage.MaxUploadsPerOwner {
+		assert.Nil(t, begin(first, "client-01", i))
+	}
+	assert.ErrorIs(t, begin(second, "client-01", storage.MaxUploadsPerOwner), storage.ErrTooManyUploads)
+
+	// the limit is counted for every client
+	assert.Nil(t, begin(second, "client-02", 0))
+
+	// the client can begin uploads again after the open ones are closed
+	first.AbortUploads("client-01")
+	assert.Nil(t, begin(second, "client-01", storage.MaxUploadsPerOwner))
+}
@@ -0,0 +1,236 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Client is a minimal NBD client, it is used to test the server without the kernel nbd driver.
+//
+// Requests are sent one at a time, a Client must not be used by multiple goroutines.
+type Client struct {
+	conn   net.Conn
+	handle uint64
+
+	// Size is the size in bytes of the export.
+	Size int64
+	// Flags are the transmission flags of the export.
+	Flags uint16
+}
+
+// Dial connects to an NBD server and selects the export with NBD_OPT_GO.
+func Dial(address string, export string) (*Client, error) {
+	conn, err := dialNegotiation(address)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4+len(export)+2)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(export)))
+	copy(data[4:], export)
+	if err := writeOption(conn, optGo, data); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := &Client{conn: conn}
+	for {
+		replyType, reply, err := readOptionReply(conn, optGo)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		switch {
+		case replyType == repAck:
+			return client, nil
+		case replyType == repInfo && len(reply) >= 12 && binary.BigEndian.Uint16(reply[0:2]) == infoExport:
+			client.Size = int64(binary.BigEndian.Uint64(reply[2:10]))
+			client.Flags = binary.BigEndian.Uint16(reply[10:12])
+		case replyType&(1<<31) != 0:
+			conn.Close()
+			return nil, fmt.Errorf("the server rejected the export=%s: %s", export, reply)
+		}
+	}
+}
+
+// List returns the names of the exports listed by the server.
+func List(address string) ([]string, error) {
+	conn, err := dialNegotiation(address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := writeOption(conn, optList, nil); err != nil {
+		return nil, err
+	}
+
+	var exports []string
+	for {
+		replyType, reply, err := readOptionReply(conn, optList)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case replyType == repAck:
+			_ = writeOption(conn, optAbort, nil)
+			return exports, nil
+		case replyType == repServer && len(reply) >= 4:
+			length := int(binary.BigEndian.Uint32(reply[0:4]))
+			if 4+length > len(reply) {
+				return nil, fmt.Errorf("invalid export name length=%d", length)
+			}
+			exports = append(exports, string(reply[4:4+length]))
+		case replyType&(1<<31) != 0:
+			return nil, fmt.Errorf("the server rejected the list option: %s", reply)
+		}
+	}
+}
+
+// dialNegotiation connects to the server and completes the fixed newstyle handshake.
+func dialNegotiation(address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	greeting := make([]byte, 18)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(greeting[0:8]) != nbdMagic || binary.BigEndian.Uint64(greeting[8:16]) != optionMagic {
+		conn.Close()
+		return nil, fmt.Errorf("the server at %s is not a newstyle NBD server", address)
+	}
+	if binary.BigEndian.Uint16(greeting[16:18])&flagFixedNewstyle == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("the server at %s does not support the fixed newstyle negotiation", address)
+	}
+
+	flags := make([]byte, 4)
+	binary.BigEndian.PutUint32(flags, clientFlagFixedNewstyle|clientFlagNoZeroes)
+	if _, err := conn.Write(flags); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func writeOption(conn net.Conn, option uint32, data []byte) error {
+	request := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(request[0:8], optionMagic)
+	binary.BigEndian.PutUint32(request[8:12], option)
+	binary.BigEndian.PutUint32(request[12:16], uint32(len(data)))
+	copy(request[16:], data)
+
+	_, err := conn.Write(request)
+	return err
+}
+
+func readOptionReply(conn net.Conn, option uint32) (uint32, []byte, error) {
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint64(header[0:8]) != replyOptionMagic {
+		return 0, nil, fmt.Errorf("invalid option reply magic")
+	}
+	if got := binary.BigEndian.Uint32(header[8:12]); got != option {
+		return 0, nil, fmt.Errorf("reply for option=%d, expected option=%d", got, option)
+	}
+
+	length := binary.BigEndian.Uint32(header[16:20])
+	if length > maxOptionLength {
+		return 0, nil, fmt.Errorf("option reply length=%d is too big", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(header[12:16]), data, nil
+}
+
+// request sends a command and reads its reply, the reply has length bytes of data for a read.
+func (c *Client) request(command uint16, offset int64, length uint32, data []byte) ([]byte, error) {
+	c.handle++
+	request := make([]byte, requestHeaderLength+len(data))
+	binary.BigEndian.PutUint32(request[0:4], requestMagic)
+	binary.BigEndian.PutUint16(request[6:8], command)
+	binary.BigEndian.PutUint64(request[8:16], c.handle)
+	binary.BigEndian.PutUint64(request[16:24], uint64(offset))
+	binary.BigEndian.PutUint32(request[24:28], length)
+	copy(request[requestHeaderLength:], data)
+
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	if command == cmdDisc {
+		return nil, nil
+	}
+
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(c.conn, reply); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(reply[0:4]) != simpleReplyMagic {
+		return nil, fmt.Errorf("invalid reply magic")
+	}
+	if handle := binary.BigEndian.Uint64(reply[8:16]); handle != c.handle {
+		return nil, fmt.Errorf("reply for handle=%d, expected handle=%d", handle, c.handle)
+	}
+	if errCode := binary.BigEndian.Uint32(reply[4:8]); errCode != 0 {
+		return nil, Error(errCode)
+	}
+
+	if command != cmdRead {
+		return nil, nil
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// ReadAt reads len(p) bytes of the export starting at offset.
+func (c *Client) ReadAt(p []byte, offset int64) (int, error) {
+	data, err := c.request(cmdRead, offset, uint32(len(p)), nil)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data), nil
+}
+
+// WriteAt writes p in the export starting at offset.
+func (c *Client) WriteAt(p []byte, offset int64) (int, error) {
+	if _, err := c.request(cmdWrite, offset, uint32(len(p)), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Trim tells the server that length bytes starting at offset are not used anymore.
+func (c *Client) Trim(offset int64, length uint32) error {
+	_, err := c.request(cmdTrim, offset, length, nil)
+	return err
+}
+
+// Flush waits until the completed writes are saved in the server.
+func (c *Client) Flush() error {
+	_, err := c.request(cmdFlush, 0, 0, nil)
+	return err
+}
+
+// Close sends NBD_CMD_DISC and closes the connection.
+func (c *Client) Close() error {
+	_, err := c.request(cmdDisc, 0, 0, nil)
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
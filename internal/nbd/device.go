@@ -0,0 +1,146 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+)
+
+// device is the storage behind an export, the offsets are always inside the export.
+type device interface {
+	Size() int64
+	// Flags returns the transmission flags of the export.
+	Flags() uint16
+	ReadAt(p []byte, offset int64) error
+	WriteAt(p []byte, offset int64) error
+	Trim(offset int64, length int64) error
+}
+
+// trimSectors is the maximum number of sectors written with zeros in a single volume write by Trim.
+const trimSectors = 2048
+
+// volumeDevice exports a volume, the requests that are not aligned to the sector size
+// read the sectors they touch and write them back.
+type volumeDevice struct {
+	store  *storage.Store
+	volume storage.VolumeInfo
+}
+
+func (v *volumeDevice) Size() int64 {
+	return v.volume.Size
+}
+
+func (v *volumeDevice) Flags() uint16 {
+	return transmissionHasFlags | transmissionSendFlush | transmissionSendTrim
+}
+
+// sectors returns the first sector and the number of sectors that cover the range.
+func (v *volumeDevice) sectors(offset int64, length int) (uint64, uint32) {
+	sectorSize := int64(v.volume.SectorSize)
+	first := offset / sectorSize
+	last := (offset + int64(length) - 1) / sectorSize
+	return uint64(first), uint32(last - first + 1)
+}
+
+func (v *volumeDevice) ReadAt(p []byte, offset int64) error {
+	lba, count := v.sectors(offset, len(p))
+	data, err := v.store.ReadVolume(v.volume.Name, lba, count)
+	if err != nil {
+		return err
+	}
+
+	copy(p, data[offset-int64(lba)*int64(v.volume.SectorSize):])
+	return nil
+}
+
+func (v *volumeDevice) WriteAt(p []byte, offset int64) error {
+	sectorSize := int64(v.volume.SectorSize)
+	if offset%sectorSize == 0 && int64(len(p))%sectorSize == 0 {
+		return v.store.WriteVolume(v.volume.Name, uint64(offset/sectorSize), p)
+	}
+
+	// read-modify-write of the sectors partially touched by the request
+	lba, count := v.sectors(offset, len(p))
+	data, err := v.store.ReadVolume(v.volume.Name, lba, count)
+	if err != nil {
+		return err
+	}
+
+	copy(data[offset-int64(lba)*sectorSize:], p)
+	return v.store.WriteVolume(v.volume.Name, lba, data)
+}
+
+// Trim writes zeros over the sectors fully inside the range, the volume deallocates
+// the regions that only contain zeros.
+func (v *volumeDevice) Trim(offset int64, length int64) error {
+	sectorSize := int64(v.volume.SectorSize)
+	first := (offset + sectorSize - 1) / sectorSize
+	end := (offset + length) / sectorSize
+
+	for first < end {
+		count := min(end-first, trimSectors)
+		if err := v.store.WriteVolume(v.volume.Name, uint64(first), make([]byte, count*sectorSize)); err != nil {
+			return err
+		}
+		first += count
+	}
+	return nil
+}
+
+// fileDevice exports a file with the size it had when the client connected.
+//
+// The export can not grow the file, the bytes after the end of the file are read as zeros.
+type fileDevice struct {
+	store *storage.Store
+	name  string
+	size  int64
+}
+
+func (f *fileDevice) Size() int64 {
+	return f.size
+}
+
+func (f *fileDevice) Flags() uint16 {
+	return transmissionHasFlags | transmissionSendFlush
+}
+
+func (f *fileDevice) ReadAt(p []byte, offset int64) error {
+	clear(p)
+	data, err := f.store.ReadRange(f.name, offset, len(p))
+	if errors.Is(err, storage.ErrOutOfRange) {
+		// the file is smaller than when the export started
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	copy(p, data)
+	return nil
+}
+
+func (f *fileDevice) WriteAt(p []byte, offset int64) error {
+	return f.store.WriteAt(f.name, offset, p)
+}
+
+func (f *fileDevice) Trim(offset int64, length int64) error {
+	return fmt.Errorf("trim is not supported by the file=%s", f.name)
+}
+
+// openDevice finds the export with the given name, volumes take precedence over files.
+func openDevice(store *storage.Store, name string) (device, error) {
+	volume, err := store.Volume(name)
+	if err == nil {
+		return &volumeDevice{store: store, volume: volume}, nil
+	}
+	if !errors.Is(err, storage.ErrVolumeNotFound) {
+		return nil, err
+	}
+
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDevice{store: store, name: name, size: info.Size}, nil
+}
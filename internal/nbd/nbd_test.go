@@ -0,0 +1,205 @@
+package nbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestServer(t *testing.T) (*storage.Store, string) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the NBD server: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go NewServer(store).Serve(listener)
+	return store, listener.Addr().String()
+}
+
+func TestVolumeExport(t *testing.T) {
+	store, address := startTestServer(t)
+	assert.Nil(t, store.CreateVolume("disk.img", 1024*1024, 512))
+
+	client, err := Dial(address, "disk.img")
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, int64(1024*1024), client.Size)
+	assert.NotZero(t, client.Flags&transmissionSendTrim)
+
+	// an unaligned write is saved with a read-modify-write of the sectors
+	n, err := client.WriteAt([]byte("Hello World"), 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, n)
+	assert.Nil(t, client.Flush())
+
+	data := make([]byte, 13)
+	_, err = client.ReadAt(data, 999)
+	assert.Nil(t, err)
+	assert.Equal(t, append(append([]byte{0}, "Hello World"...), 0), data)
+
+	sector, err := store.ReadVolume("disk.img", 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), sector[1000-512:1011-512])
+
+	// trim deallocates the regions that only contain zeros
+	assert.Nil(t, client.Trim(0, 1024*1024))
+	info, err := store.Volume("disk.img")
+	assert.Nil(t, err)
+	assert.Zero(t, info.AllocatedBlocks)
+
+	// requests outside the export are rejected without closing the connection
+	_, err = client.ReadAt(data, 1024*1024-1)
+	assert.Equal(t, Error(errInval), err)
+	_, err = client.WriteAt(data, 1024*1024-1)
+	assert.Equal(t, Error(errNoSpace), err)
+
+	_, err = client.ReadAt(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 13), data)
+}
+
+func TestFileExport(t *testing.T) {
+	store, address := startTestServer(t)
+	assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+	client, err := Dial(address, "data.txt")
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, int64(11), client.Size)
+	assert.Zero(t, client.Flags&transmissionSendTrim)
+
+	_, err = client.WriteAt([]byte("Earth"), 6)
+	assert.Nil(t, err)
+
+	data := make([]byte, 11)
+	_, err = client.ReadAt(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello Earth"), data)
+
+	assert.Equal(t, Error(errNotSup), client.Trim(0, 11))
+}
+
+func TestExportNotFound(t *testing.T) {
+	_, address := startTestServer(t)
+
+	_, err := Dial(address, "missing.img")
+	assert.NotNil(t, err)
+}
+
+func TestListExports(t *testing.T) {
+	store, address := startTestServer(t)
+	assert.Nil(t, store.CreateVolume("second.img", 4096, 512))
+	assert.Nil(t, store.CreateVolume("first.img", 4096, 512))
+
+	exports, err := List(address)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first.img", "second.img"}, exports)
+}
+
+func TestConcurrentClients(t *testing.T) {
+	store, address := startTestServer(t)
+	assert.Nil(t, store.CreateVolume("disk.img", 64*4096, 4096))
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func(index int) {
+			client, err := Dial(address, "disk.img")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+
+			content := bytes.Repeat([]byte{byte(index + 1)}, 4096)
+			if _, err := client.WriteAt(content, int64(index)*4096); err != nil {
+				errs <- err
+				return
+			}
+			read := make([]byte, 4096)
+			if _, err := client.ReadAt(read, int64(index)*4096); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(content, read) {
+				errs <- errors.New("the data read does not match the data written")
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	store := storage.NewStore(storage.NewMemoryBackend())
+	assert.Nil(t, store.CreateVolume("disk.img", 64*4096, 4096))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the NBD server: %v", err)
+	}
+	srv := NewServer(store)
+	go srv.Serve(listener)
+
+	idle, err := Dial(listener.Addr().String(), "disk.img")
+	assert.Nil(t, err)
+	defer idle.conn.Close()
+	busy, err := Dial(listener.Addr().String(), "disk.img")
+	assert.Nil(t, err)
+	defer busy.conn.Close()
+
+	request := make([]byte, requestHeaderLength+4096)
+	binary.BigEndian.PutUint32(request[0:4], requestMagic)
+	binary.BigEndian.PutUint16(request[6:8], cmdWrite)
+	binary.BigEndian.PutUint64(request[8:16], 1)
+	binary.BigEndian.PutUint32(request[24:28], 4096)
+	copy(request[requestHeaderLength:], bytes.Repeat([]byte{0x5A}, 4096))
+
+	// the shutdown starts while the write is received
+	_, err = busy.conn.Write(request[:100])
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stopped <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("the server stopped while a request was received: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = busy.conn.Write(request[100:])
+	assert.Nil(t, err)
+
+	// the write is acknowledged before the connection is closed
+	reply, err := io.ReadAll(busy.conn)
+	assert.Nil(t, err)
+	if assert.Len(t, reply, 16) {
+		assert.Zero(t, binary.BigEndian.Uint32(reply[4:8]))
+	}
+	assert.Nil(t, <-stopped)
+
+	// the idle connection was closed and the new connections are rejected
+	_, err = idle.ReadAt(make([]byte, 512), 0)
+	assert.NotNil(t, err)
+	_, err = Dial(listener.Addr().String(), "disk.img")
+	assert.NotNil(t, err)
+
+	data, err := store.ReadVolume("disk.img", 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x5A}, 4096), data)
+}
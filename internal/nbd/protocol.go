@@ -0,0 +1,114 @@
+// Package nbd implements the newstyle Network Block Device protocol on top of the Store,
+// Linux hosts can attach a volume or a file with the standard nbd-client tools.
+//
+// The protocol is described in https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md,
+// only the fixed newstyle negotiation and simple replies are supported.
+package nbd
+
+import (
+	"fmt"
+)
+
+const (
+	// nbdMagic is the first value sent by the server, "NBDMAGIC" in ASCII.
+	nbdMagic uint64 = 0x4e42444d41474943
+	// optionMagic is sent after nbdMagic and before every client option, "IHAVEOPT" in ASCII.
+	optionMagic uint64 = 0x49484156454f5054
+	// replyOptionMagic starts every reply to a client option.
+	replyOptionMagic uint64 = 0x0003e889045565a9
+	// requestMagic starts every request in the transmission phase.
+	requestMagic uint32 = 0x25609513
+	// simpleReplyMagic starts every reply in the transmission phase.
+	simpleReplyMagic uint32 = 0x67446698
+)
+
+// handshake flags sent by the server and client flags sent in response
+const (
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+
+	clientFlagFixedNewstyle uint32 = 1 << 0
+	clientFlagNoZeroes      uint32 = 1 << 1
+)
+
+// options sent by the client during the negotiation
+const (
+	optExportName uint32 = 1
+	optAbort      uint32 = 2
+	optList       uint32 = 3
+	optInfo       uint32 = 6
+	optGo         uint32 = 7
+)
+
+// replies of the server to the client options
+const (
+	repAck        uint32 = 1
+	repServer     uint32 = 2
+	repInfo       uint32 = 3
+	repErrUnsup   uint32 = 1<<31 + 1
+	repErrInvalid uint32 = 1<<31 + 3
+	repErrUnknown uint32 = 1<<31 + 6
+)
+
+// information types sent in an NBD_REP_INFO reply
+const (
+	infoExport    uint16 = 0
+	infoBlockSize uint16 = 3
+)
+
+// transmission flags describe the export to the client
+const (
+	transmissionHasFlags  uint16 = 1 << 0
+	transmissionReadOnly  uint16 = 1 << 1
+	transmissionSendFlush uint16 = 1 << 2
+	transmissionSendTrim  uint16 = 1 << 5
+)
+
+// commands of the transmission phase
+const (
+	cmdRead  uint16 = 0
+	cmdWrite uint16 = 1
+	cmdDisc  uint16 = 2
+	cmdFlush uint16 = 3
+	cmdTrim  uint16 = 4
+)
+
+// error values of a reply, they use the Linux errno numbers
+const (
+	errPerm    uint32 = 1
+	errIO      uint32 = 5
+	errInval   uint32 = 22
+	errNoSpace uint32 = 28
+	errNotSup  uint32 = 95
+)
+
+const (
+	// MaxRequestLength is the biggest read or write accepted in a single request.
+	MaxRequestLength = 32 * 1024 * 1024
+	// maxOptionLength is the biggest option data accepted during the negotiation.
+	maxOptionLength = 64 * 1024
+	// requestHeaderLength is the size of a transmission request without the write data.
+	requestHeaderLength = 28
+	// exportNameZeroes is the padding sent after NBD_OPT_EXPORT_NAME when the client did not set NBD_FLAG_C_NO_ZEROES.
+	exportNameZeroes = 124
+)
+
+// Error is the error value returned by the server for a transmission request.
+type Error uint32
+
+func (e Error) Error() string {
+	switch uint32(e) {
+	case errPerm:
+		return "nbd: operation not permitted"
+	case errIO:
+		return "nbd: input/output error"
+	case errInval:
+		return "nbd: invalid argument"
+	case errNoSpace:
+		return "nbd: no space left on device"
+	case errNotSup:
+		return "nbd: operation not supported"
+	default:
+		return fmt.Sprintf("nbd: error=%d", uint32(e))
+	}
+}
@@ -0,0 +1,476 @@
+package nbd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+)
+
+// errAbort is returned by the negotiation when the client ends the connection.
+var errAbort = errors.New("the client aborted the negotiation")
+
+// Server exports the volumes and files of a Store with the NBD protocol.
+//
+// The export name is the name of a volume or a file, volumes are listed with
+// NBD_OPT_LIST. Requests of a connection are processed in order.
+type Server struct {
+	store *storage.Store
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	// conns has every connection, the value is true while a request is received or processed
+	conns  map[net.Conn]bool
+	closed bool
+	// wg counts the connections being served
+	wg sync.WaitGroup
+}
+
+// NewServer creates an NBD server that exports the volumes and files of store.
+func NewServer(store *storage.Store) *Server {
+	return &Server{
+		store:     store,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// Serve accepts connections on listener until it is closed or Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+
+	slog.Info("NBD server listening", "address", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("NBD listener closed; stopping accept loop")
+				return nil
+			}
+			slog.Error("Error accepting NBD connection", "error", err)
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = false
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(conn)
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Shutdown stops the server gracefully.
+//
+// It closes the listeners and the connections waiting for a request, the connections that
+// are receiving or processing a request are closed after the reply is sent. When ctx is done
+// before the connections finish they are closed immediately and Shutdown returns the error of ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	clear(s.listeners)
+	for conn, busy := range s.conns {
+		if !busy {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		slog.Warn("The NBD shutdown deadline expired, closing the connections", "connections", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// untrackConn removes a connection added by Serve.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// setBusy marks if a connection is receiving or processing a request, it returns false when
+// the server is shutting down and the connection must be closed.
+//
+// A request received after the shutdown started is not processed, the request being received
+// when it started is processed.
+func (s *Server) setBusy(conn net.Conn, busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed && (!busy || !s.conns[conn]) {
+		return false
+	}
+	s.conns[conn] = busy
+	return true
+}
+
+// handleConnection negotiates the export with the client and then serves its requests.
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	slog.Info("NBD client connected", "address", conn.RemoteAddr())
+
+	dev, name, err := s.negotiate(conn)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			slog.Info("NBD client disconnected during the negotiation", "address", conn.RemoteAddr())
+		} else if !errors.Is(err, errAbort) {
+			slog.Error("NBD negotiation failed", "address", conn.RemoteAddr(), "error", err)
+		}
+		return
+	}
+
+	slog.Info("NBD export started", "address", conn.RemoteAddr(), "export", name, "size", dev.Size())
+	if err := s.transmission(conn, dev); err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			slog.Info("NBD connection closed by the shutdown", "address", conn.RemoteAddr(), "export", name)
+			return
+		}
+		slog.Error("NBD transmission failed", "address", conn.RemoteAddr(), "export", name, "error", err)
+		return
+	}
+	slog.Info("NBD client disconnected", "address", conn.RemoteAddr(), "export", name)
+}
+
+// negotiate runs the fixed newstyle handshake and the option haggling, it returns the
+// device selected with NBD_OPT_EXPORT_NAME or NBD_OPT_GO.
+func (s *Server) negotiate(conn net.Conn) (device, string, error) {
+	greeting := make([]byte, 18)
+	binary.BigEndian.PutUint64(greeting[0:8], nbdMagic)
+	binary.BigEndian.PutUint64(greeting[8:16], optionMagic)
+	binary.BigEndian.PutUint16(greeting[16:18], flagFixedNewstyle|flagNoZeroes)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, "", err
+	}
+
+	raw := make([]byte, 4)
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return nil, "", err
+	}
+	clientFlags := binary.BigEndian.Uint32(raw)
+	if clientFlags&clientFlagFixedNewstyle == 0 {
+		return nil, "", fmt.Errorf("the client does not support the fixed newstyle negotiation, flags=%d", clientFlags)
+	}
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, "", err
+		}
+		if magic := binary.BigEndian.Uint64(header[0:8]); magic != optionMagic {
+			return nil, "", fmt.Errorf("invalid option magic=%x", magic)
+		}
+
+		option := binary.BigEndian.Uint32(header[8:12])
+		length := binary.BigEndian.Uint32(header[12:16])
+		if length > maxOptionLength {
+			return nil, "", fmt.Errorf("option=%d data length=%d is too big", option, length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, "", err
+		}
+		slog.Info("Processing NBD option", "address", conn.RemoteAddr(), "option", option)
+
+		switch option {
+		case optExportName:
+			// there is no way to report an error for this option, the connection is closed
+			name := string(data)
+			dev, err := openDevice(s.store, name)
+			if err != nil {
+				return nil, "", err
+			}
+
+			reply := make([]byte, 10, 10+exportNameZeroes)
+			binary.BigEndian.PutUint64(reply[0:8], uint64(dev.Size()))
+			binary.BigEndian.PutUint16(reply[8:10], dev.Flags())
+			if clientFlags&clientFlagNoZeroes == 0 {
+				reply = append(reply, make([]byte, exportNameZeroes)...)
+			}
+			if _, err := conn.Write(reply); err != nil {
+				return nil, "", err
+			}
+			return dev, name, nil
+		case optAbort:
+			_ = writeOptionReply(conn, option, repAck, nil)
+			return nil, "", errAbort
+		case optList:
+			if err := s.list(conn, data); err != nil {
+				return nil, "", err
+			}
+		case optInfo, optGo:
+			dev, name, err := s.info(conn, option, data)
+			if err != nil {
+				return nil, "", err
+			}
+			if option == optGo && dev != nil {
+				return dev, name, nil
+			}
+		default:
+			if err := writeOptionReply(conn, option, repErrUnsup, []byte("unsupported option")); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+}
+
+// list replies NBD_OPT_LIST with the name of every volume.
+func (s *Server) list(conn net.Conn, data []byte) error {
+	if len(data) > 0 {
+		return writeOptionReply(conn, optList, repErrInvalid, []byte("the list option has no data"))
+	}
+
+	volumes, err := s.store.Volumes()
+	if err != nil {
+		return writeOptionReply(conn, optList, repErrInvalid, []byte(err.Error()))
+	}
+
+	for _, volume := range volumes {
+		reply := make([]byte, 4+len(volume.Name))
+		binary.BigEndian.PutUint32(reply[0:4], uint32(len(volume.Name)))
+		copy(reply[4:], volume.Name)
+		if err := writeOptionReply(conn, optList, repServer, reply); err != nil {
+			return err
+		}
+	}
+	return writeOptionReply(conn, optList, repAck, nil)
+}
+
+// info replies NBD_OPT_INFO and NBD_OPT_GO, the returned device is nil when the export was not found.
+//
+// The option data has the format [nameLength(4 bytes)][name][requests(2 bytes)][request(2 bytes) * requests].
+func (s *Server) info(conn net.Conn, option uint32, data []byte) (device, string, error) {
+	if len(data) < 6 {
+		return nil, "", writeOptionReply(conn, option, repErrInvalid, []byte("invalid option length"))
+	}
+	nameLength := int(binary.BigEndian.Uint32(data[0:4]))
+	if 4+nameLength+2 > len(data) {
+		return nil, "", writeOptionReply(conn, option, repErrInvalid, []byte("invalid export name length"))
+	}
+	name := string(data[4 : 4+nameLength])
+	requests := int(binary.BigEndian.Uint16(data[4+nameLength : 6+nameLength]))
+	if 6+nameLength+2*requests != len(data) {
+		return nil, "", writeOptionReply(conn, option, repErrInvalid, []byte("invalid information requests length"))
+	}
+
+	dev, err := openDevice(s.store, name)
+	if err != nil {
+		slog.Info("NBD export not found", "export", name, "error", err)
+		return nil, "", writeOptionReply(conn, option, repErrUnknown, []byte("export not found"))
+	}
+
+	export := make([]byte, 12)
+	binary.BigEndian.PutUint16(export[0:2], infoExport)
+	binary.BigEndian.PutUint64(export[2:10], uint64(dev.Size()))
+	binary.BigEndian.PutUint16(export[10:12], dev.Flags())
+	if err := writeOptionReply(conn, option, repInfo, export); err != nil {
+		return nil, "", err
+	}
+
+	for i := 0; i < requests; i++ {
+		offset := 6 + nameLength + 2*i
+		if binary.BigEndian.Uint16(data[offset:offset+2]) != infoBlockSize {
+			continue
+		}
+
+		preferred := uint32(1)
+		if volume, ok := dev.(*volumeDevice); ok {
+			preferred = uint32(volume.volume.SectorSize)
+		}
+		blockSize := make([]byte, 14)
+		binary.BigEndian.PutUint16(blockSize[0:2], infoBlockSize)
+		binary.BigEndian.PutUint32(blockSize[2:6], 1)
+		binary.BigEndian.PutUint32(blockSize[6:10], preferred)
+		binary.BigEndian.PutUint32(blockSize[10:14], MaxRequestLength)
+		if err := writeOptionReply(conn, option, repInfo, blockSize); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := writeOptionReply(conn, option, repAck, nil); err != nil {
+		return nil, "", err
+	}
+	return dev, name, nil
+}
+
+// writeOptionReply sends a reply to a client option with the format:
+// [replyMagic(8 bytes)][option(4 bytes)][replyType(4 bytes)][length(4 bytes)][data]
+func writeOptionReply(conn net.Conn, option uint32, replyType uint32, data []byte) error {
+	reply := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint64(reply[0:8], replyOptionMagic)
+	binary.BigEndian.PutUint32(reply[8:12], option)
+	binary.BigEndian.PutUint32(reply[12:16], replyType)
+	binary.BigEndian.PutUint32(reply[16:20], uint32(len(data)))
+	copy(reply[20:], data)
+
+	_, err := conn.Write(reply)
+	return err
+}
+
+// transmission serves the requests of the client until it sends NBD_CMD_DISC or the
+// server shuts down.
+//
+// Every request has the format:
+// [magic(4 bytes)][flags(2 bytes)][type(2 bytes)][handle(8 bytes)][offset(8 bytes)][length(4 bytes)][data]
+func (s *Server) transmission(conn net.Conn, dev device) error {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, requestHeaderLength)
+	for {
+		// the connection is busy from the first byte of the request until the reply is sent
+		if !s.setBusy(conn, false) {
+			return nil
+		}
+		if _, err := reader.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if !s.setBusy(conn, true) {
+			return nil
+		}
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		if magic := binary.BigEndian.Uint32(header[0:4]); magic != requestMagic {
+			return fmt.Errorf("invalid request magic=%x", magic)
+		}
+
+		command := binary.BigEndian.Uint16(header[6:8])
+		handle := binary.BigEndian.Uint64(header[8:16])
+		offset := binary.BigEndian.Uint64(header[16:24])
+		length := binary.BigEndian.Uint32(header[24:28])
+
+		if length > MaxRequestLength && (command == cmdRead || command == cmdWrite) {
+			// the data of a write can not be skipped safely, the connection is closed
+			return fmt.Errorf("request length=%d is bigger than the maximum=%d", length, MaxRequestLength)
+		}
+
+		var data []byte
+		if command == cmdWrite {
+			data = make([]byte, length)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return err
+			}
+		}
+
+		inside := offset <= uint64(dev.Size()) && uint64(length) <= uint64(dev.Size())-offset
+		switch command {
+		case cmdDisc:
+			return nil
+		case cmdRead:
+			if !inside {
+				if err := writeSimpleReply(conn, handle, errInval, nil); err != nil {
+					return err
+				}
+				continue
+			}
+
+			data = make([]byte, length)
+			errCode := uint32(0)
+			if length > 0 {
+				if err := dev.ReadAt(data, int64(offset)); err != nil {
+					slog.Error("NBD read failed", "offset", offset, "length", length, "error", err)
+					errCode = errIO
+					data = nil
+				}
+			}
+			if err := writeSimpleReply(conn, handle, errCode, data); err != nil {
+				return err
+			}
+		case cmdWrite:
+			errCode := uint32(0)
+			switch {
+			case !inside:
+				errCode = errNoSpace
+			case length > 0:
+				if err := dev.WriteAt(data, int64(offset)); err != nil {
+					slog.Error("NBD write failed", "offset", offset, "length", length, "error", err)
+					errCode = errIO
+				}
+			}
+			if err := writeSimpleReply(conn, handle, errCode, nil); err != nil {
+				return err
+			}
+		case cmdTrim:
+			errCode := uint32(0)
+			switch {
+			case dev.Flags()&transmissionSendTrim == 0:
+				errCode = errNotSup
+			case !inside:
+				errCode = errInval
+			default:
+				if err := dev.Trim(int64(offset), int64(length)); err != nil {
+					slog.Error("NBD trim failed", "offset", offset, "length", length, "error", err)
+					errCode = errIO
+				}
+			}
+			if err := writeSimpleReply(conn, handle, errCode, nil); err != nil {
+				return err
+			}
+		case cmdFlush:
+			// every write is durable in the metadata journal when it is acknowledged
+			if err := writeSimpleReply(conn, handle, 0, nil); err != nil {
+				return err
+			}
+		default:
+			if err := writeSimpleReply(conn, handle, errInval, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeSimpleReply sends the reply of a request with the format:
+// [magic(4 bytes)][error(4 bytes)][handle(8 bytes)][data]
+func writeSimpleReply(conn net.Conn, handle uint64, errCode uint32, data []byte) error {
+	reply := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint32(reply[0:4], simpleReplyMagic)
+	binary.BigEndian.PutUint32(reply[4:8], errCode)
+	binary.BigEndian.PutUint64(reply[8:16], handle)
+	copy(reply[16:], data)
+
+	_, err := conn.Write(reply)
+	return err
+}
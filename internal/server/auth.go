@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+)
+
+// MinSecretLength is the minimum length in bytes of the secret of a client.
+const MinSecretLength = 16
+
+// Keys are the secrets shared with the known clients, indexed by client id.
+//
+// When the server has keys only the clients in Keys are admitted, every client answers a
+// challenge with the HMAC-SHA256 of the challenge and its client id using its secret.
+type Keys map[string][]byte
+
+// LoadKeys reads the secrets of the clients from a file.
+//
+// Every line of the file has a client id and its secret in hex separated by spaces,
+// the empty lines and the lines that start with '#' are ignored:
+//
+//	# clientID secret
+//	client-01 6f1d0e8a4c7b2d9e3f5a6b7c8d9e0f1a
+func LoadKeys(path string) (Keys, error) {
+	slog.Info("Loading client keys", "file", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(Keys)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a client id and a secret", path, line)
+		}
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: the secret is not valid hex: %w", path, line, err)
+		}
+		if len(secret) < MinSecretLength {
+			return nil, fmt.Errorf("%s:%d: the secret of client=%s needs at least %d bytes", path, line, fields[0], MinSecretLength)
+		}
+		if _, exists := keys[fields[0]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicated client=%s", path, line, fields[0])
+		}
+		keys[fields[0]] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// loadKeysFromEnv loads the keys of the file in STG_KEYS_FILE, it returns nil keys when the
+// variable is not set and the clients are not authenticated.
+func loadKeysFromEnv() (Keys, error) {
+	path := os.Getenv("STG_KEYS_FILE")
+	if path == "" {
+		slog.Warn("STG_KEYS_FILE is not set, the clients are not authenticated")
+		return nil, nil
+	}
+	return LoadKeys(path)
+}
+
+// loadACLFromEnv loads the rules of the file in STG_ACL_FILE, it returns a nil ACL when the
+// variable is not set and every client can execute every message.
+func loadACLFromEnv() (*acl.ACL, error) {
+	path := os.Getenv("STG_ACL_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return acl.Load(path)
+}
+
+// authenticate sends a challenge to the client and verifies the answer.
+//
+// An unknown client id receives a challenge too, the answer is rejected without telling
+// the client if the id or the secret is wrong.
+func (k Keys) authenticate(reader *bufio.Reader, conn io.Writer, clientID string, logger *slog.Logger) bool {
+	challenge := make([]byte, protocol.ChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		logger.Error("The challenge could not be generated", "error", err)
+		return false
+	}
+	if _, err := conn.Write(protocol.EncodeAuthChallenge(challenge)); err != nil {
+		return false
+	}
+
+	mac, err := protocol.ReadAuthResponse(reader)
+	if err != nil {
+		logger.Error("auth response read failed", "clientID", clientID, "error", err)
+		return false
+	}
+
+	secret, ok := k[clientID]
+	if !ok {
+		logger.Error("unknown client", "clientID", clientID)
+		return false
+	}
+	return hmac.Equal(mac, protocol.AuthMAC(secret, challenge, clientID))
+}
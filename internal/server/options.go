@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/client"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/processor"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+)
+
+// Processor executes the messages received on a connection.
+//
+// A Processor is created for every connection, Close is called when the connection is closed.
+// The methods must be safe to call from multiple goroutines, the requests of the protocol
+// version 2 are processed concurrently.
+type Processor interface {
+	// ProcessTo executes a message of the protocol version 1 and writes the response to w.
+	ProcessTo(message []byte, client *client.Client, w io.Writer) error
+	// ProcessReply executes a message and returns its response.
+	ProcessReply(message []byte, client *client.Client) processor.Reply
+	// Close releases the state of the client.
+	Close(client *client.Client)
+}
+
+// Option configures a Server created by New.
+type Option func(*Server)
+
+// WithAddress sets the TCP address used by ListenAndServe, the default is ApplicationPort.
+func WithAddress(address string) Option {
+	return func(s *Server) { s.address = address }
+}
+
+// WithStore sets the store of the files, the default is storage.Default.
+func WithStore(store *storage.Store) Option {
+	return func(s *Server) { s.store = store }
+}
+
+// WithBackend saves the files in a store with the backend and the default block size.
+func WithBackend(backend storage.Backend) Option {
+	return func(s *Server) { s.store = storage.NewStore(backend) }
+}
+
+// WithProcessor sets the function that creates the Processor of every connection, the
+// default creates a processor.DefaultMessageProcessor with the store and the ACL of the Server.
+func WithProcessor(newProcessor func() Processor) Option {
+	return func(s *Server) { s.newProcessor = newProcessor }
+}
+
+// WithLogger sets the logger of the Server, the default is slog.Default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithRegistry sets the registry of the connected clients, the default is a new registry
+// for every Server.
+func WithRegistry(registry *client.ClientRegistry) Option {
+	return func(s *Server) { s.registry = registry }
+}
+
+// WithKeys sets the secrets of the clients, nil admits every client, see LoadKeys.
+func WithKeys(keys Keys) Option {
+	return func(s *Server) { s.keys = keys }
+}
+
+// WithACL sets the rules checked before every message, nil allows every message.
+// It is not used when WithProcessor is set.
+func WithACL(rules *acl.ACL) Option {
+	return func(s *Server) { s.acl = rules }
+}
+
+// WithTLSConfig enables TLS when config is not nil, see TLSConfig.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) { s.tlsConfig = config }
+}
+
+// WithHandshakeTimeout sets the maximum time to complete the TLS handshake and the handshake
+// of the protocol, the default is DefaultHandshakeTimeout.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(s *Server) { s.handshakeTimeout = timeout }
+}
+
+// WithMaxInFlightRequests sets the number of requests of a protocol version 2 connection that
+// are processed at the same time, the default is DefaultMaxInFlightRequests.
+func WithMaxInFlightRequests(n int) Option {
+	return func(s *Server) { s.maxInFlight = n }
+}
+
+// WithMaxConnections sets the maximum number of connections of the Server including the
+// connections in the handshake, the next clients are rejected in the handshake with
+// protocol.ErrorTooManyConnections. The default is DefaultMaxConnections, 0 does not limit
+// the connections.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) { s.maxConns = n }
+}
+
+// WithMaxConnectionsPerClient sets the maximum number of connections with the same client id,
+// the next connections of the client are rejected in the handshake with
+// protocol.ErrorTooManyConnections. The default 0 does not limit the connections.
+func WithMaxConnectionsPerClient(n int) Option {
+	return func(s *Server) { s.maxConnsPerClient = n }
+}
+
+// WithMaxFrameSize sets the maximum length of a request frame, the bigger frames are discarded
+// without reading them into memory and the client receives a response with
+// protocol.ErrorBadRequest. The limit is sent to the clients that request
+// protocol.CapabilityMaxFrameSize in the handshake. The default is DefaultMaxFrameSize, 0
+// does not limit the frames.
+func WithMaxFrameSize(n uint32) Option {
+	return func(s *Server) { s.maxFrameSize = n }
+}
+
+// WithIdleTimeout sets the maximum time to wait for the next frame of a connection without
+// requests in flight, the connection is closed after it. The default is DefaultIdleTimeout,
+// 0 keeps the idle connections open.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) { s.idleTimeout = timeout }
+}
+
+// WithReadTimeout sets the maximum time to receive a frame after its first byte, the default
+// is DefaultReadTimeout, 0 does not limit the time.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) { s.readTimeout = timeout }
+}
+
+// WithWriteTimeout sets the maximum time of every write of a response, a response is written
+// in many writes when its payload is streamed. The default is DefaultWriteTimeout, 0 does not
+// limit the time.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) { s.writeTimeout = timeout }
+}
@@ -2,52 +2,575 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/handler"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/nbd"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/client"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/processor"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 )
 
 const ApplicationPort = ":8001"
 
-var clients = client.NewClientRegistry()
+// DefaultMaxInFlightRequests is the number of requests of a protocol version 2 connection that
+// are processed at the same time when it is not configured.
+const DefaultMaxInFlightRequests = 32
+
+// DefaultHandshakeTimeout is the maximum time to receive the handshake when it is not configured.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxConnections is the maximum number of connections of a Server when it is not configured.
+const DefaultMaxConnections = 1024
+
+// DefaultMaxFrameSize is the maximum length of a request frame when it is not configured, the
+// bigger files are saved with the upload messages.
+const DefaultMaxFrameSize = 64 << 20
+
+// DefaultIdleTimeout is the time a connection without requests in flight waits for the next
+// frame when it is not configured.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// DefaultReadTimeout is the maximum time to receive a frame after its first byte when it is not configured.
+const DefaultReadTimeout = 30 * time.Second
+
+// DefaultWriteTimeout is the maximum time of a write of a response when it is not configured.
+const DefaultWriteTimeout = 30 * time.Second
+
+// goAwayTimeout is the maximum time to send the notice of the shutdown to a client.
+const goAwayTimeout = time.Second
+
+// rejectTimeout is the maximum time to reject a connection that exceeds the maximum
+// connections of the Server, it covers the TLS handshake, the handshake request and the response.
+const rejectTimeout = time.Second
+
+// maxPendingRejects is the number of connections over the limit that are rejected at the same
+// time, the next connections are closed without a handshake response.
+const maxPendingRejects = 64
+
+// NBDPort is the address of the NBD frontend, it is the port registered for the NBD protocol
+// on the loopback interface. The NBD clients are not authenticated and the ACL is not checked,
+// the frontend must not be reachable by untrusted clients.
+const NBDPort = "127.0.0.1:10809"
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// errTooManyConnections is returned by trackConn when the Server has the maximum connections.
+var errTooManyConnections = errors.New("too many connections")
+
+// Server serves the storage protocol, it is created with New.
+//
+// A Server can serve many listeners, Shutdown closes all of them and the connections
+// of the clients.
+type Server struct {
+	address          string
+	store            *storage.Store
+	newProcessor     func() Processor
+	logger           *slog.Logger
+	registry         *client.ClientRegistry
+	keys             Keys
+	acl              *acl.ACL
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration
+	maxInFlight      int
+
+	maxConns          int
+	maxConnsPerClient int
+	maxFrameSize      uint32
+	idleTimeout       time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+
+	mu sync.Mutex
+	// listeners are in the order they started to be served
+	listeners []net.Listener
+	conns     map[net.Conn]*connState
+	closed    bool
+	// perClient is the number of connections of every client id that completed the handshake
+	perClient map[string]int
+	// rejects has a slot for every connection over the limit that is being rejected
+	rejects chan struct{}
+	// wg counts the connections being served
+	wg sync.WaitGroup
+}
+
+// New returns a Server with the options, the options that are not given use their default value.
+func New(opts ...Option) *Server {
+	s := &Server{
+		address:          ApplicationPort,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		maxInFlight:      DefaultMaxInFlightRequests,
+		maxConns:         DefaultMaxConnections,
+		maxFrameSize:     DefaultMaxFrameSize,
+		idleTimeout:      DefaultIdleTimeout,
+		readTimeout:      DefaultReadTimeout,
+		writeTimeout:     DefaultWriteTimeout,
+		conns:            make(map[net.Conn]*connState),
+		perClient:        make(map[string]int),
+		rejects:          make(chan struct{}, maxPendingRejects),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.store == nil {
+		s.store = storage.Default()
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	if s.registry == nil {
+		s.registry = client.NewClientRegistry()
+	}
+	if s.newProcessor == nil {
+		s.newProcessor = func() Processor {
+			return &processor.DefaultMessageProcessor{Handler: handler.NewWithStore(s.store), ACL: s.acl}
+		}
+	}
+	return s
+}
 
 // StartApplication starts the TCP server and begins accepting client connections.
 func StartApplication() (net.Listener, error) {
-	slog.Info("Starting TCP server on", "port", ApplicationPort)
-	listener, err := net.Listen("tcp", ApplicationPort)
+	return Listen(ApplicationPort)
+}
+
+// Listen starts a Server on address and begins accepting client connections, the
+// files are saved in the default storage. Closing the listener stops the Server.
+//
+// An address with port 0 listens on a random port, the port is available in the Addr of the listener.
+//
+// When STG_KEYS_FILE is set only the clients in the keys file are admitted, see LoadKeys.
+// When STG_ACL_FILE is set the messages are checked with the rules of the file, see acl.Parse,
+// it needs STG_KEYS_FILE or STG_TLS_CLIENT_CA so the client IDs are authenticated.
+// When STG_TLS_CERT and STG_TLS_KEY are set the connections use TLS, see TLSConfig.
+func Listen(address string) (net.Listener, error) {
+	keys, err := loadKeysFromEnv()
+	if err != nil {
+		slog.Error("Error while loading the client keys", "error", err)
+		return nil, err
+	}
+	rules, err := loadACLFromEnv()
+	if err != nil {
+		slog.Error("Error while loading the access rules", "error", err)
+		return nil, err
+	}
+	tlsConfig, err := loadTLSConfigFromEnv()
+	if err != nil {
+		slog.Error("Error while loading the TLS configuration", "error", err)
+		return nil, err
+	}
+	if rules != nil && keys == nil && (tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert) {
+		err := errors.New("STG_ACL_FILE needs STG_KEYS_FILE or STG_TLS_CLIENT_CA to authenticate the clients")
+		slog.Error("Error while loading the access rules", "error", err)
+		return nil, err
+	}
+
+	slog.Info("Starting TCP server on", "port", address)
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		slog.Error("Error while starting the TCP server, ", "error", err)
 		return nil, err
 	}
 
-	go func() {
-		slog.Info("TCP server listening", "port", ApplicationPort)
-		for {
-			// Wait for a connection
-			conn, err := listener.Accept()
-			if err != nil {
-				// Server is shutting down or encountered a non-timeout error
-				if ne, ok := err.(net.Error); ok && !ne.Timeout() {
-					slog.Info("Listener closed; stopping accept loop")
-					return
-				}
-				slog.Error("Error accepting client connection", "error", err)
-				return
+	s := New(WithAddress(address), WithKeys(keys), WithACL(rules), WithTLSConfig(tlsConfig))
+	go s.Serve(listener)
+	return listener, nil
+}
+
+// ListenAndServe listens on the address of the Server and serves the connections, it
+// returns ErrServerClosed after Shutdown.
+func (s *Server) ListenAndServe() error {
+	s.logger.Info("Starting TCP server on", "port", s.address)
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		s.logger.Error("Error while starting the TCP server, ", "error", err)
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts the connections of listener and serves every connection in its own
+// goroutine. The listener is wrapped with TLS when the Server has a TLS configuration.
+//
+// Serve always closes the listener, it returns ErrServerClosed after Shutdown or the
+// error of Accept when the listener fails.
+func (s *Server) Serve(listener net.Listener) error {
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+	defer listener.Close()
+
+	s.logger.Info("TCP server listening", "port", listener.Addr())
+	for {
+		// Wait for a connection
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				s.logger.Info("Listener closed; stopping accept loop")
+				return ErrServerClosed
 			}
+			s.logger.Error("Error accepting client connection", "error", err)
+			return err
+		}
+
+		state, err := s.trackConn(conn)
+		if errors.Is(err, errTooManyConnections) {
+			s.logger.Warn("The server has the maximum connections, rejecting the new connection", "address", conn.RemoteAddr(), "maxConnections", s.maxConns)
+			select {
+			case s.rejects <- struct{}{}:
+				go func() {
+					defer func() { <-s.rejects }()
+					s.rejectConn(conn)
+				}()
+			default:
+				s.logger.Warn("Too many connections are being rejected, closing the new connection", "address", conn.RemoteAddr())
+				conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(conn)
+			s.handleClientConnection(state)
+		}()
+	}
+}
 
-			go handleClientConnection(conn)
+// Addr returns the address of the first listener served by the Server, it returns nil
+// when the Server is not serving a listener.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Shutdown stops the Server gracefully.
+//
+// It closes the listeners, the connections in the handshake and the idle connections, the
+// connections with requests in flight or receiving a frame are closed when their requests
+// finish, the frame being received is processed. The clients
+// receive a notice before their connection is closed, see protocol.EncodeGoAway. When ctx is
+// done before the connections finish they are closed immediately and Shutdown returns the
+// error of ctx. The metadata of the store is saved before Shutdown returns.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+	var idle []*connState
+	for _, state := range s.conns {
+		switch {
+		case state.reading:
+			state.draining = true
+		case state.active == 0:
+			state.goingAway = true
+			idle = append(idle, state)
 		}
+	}
+	s.mu.Unlock()
+
+	s.logger.Info("Shutting down the TCP server", "idleConnections", len(idle))
+	for _, state := range idle {
+		s.goAway(state)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
 	}()
 
-	return listener, nil
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.logger.Warn("The shutdown deadline expired, closing the connections", "connections", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		err = ctx.Err()
+	}
+
+	if checkpointErr := s.store.Checkpoint(); checkpointErr != nil {
+		s.logger.Error("The metadata could not be saved", "error", checkpointErr)
+		err = errors.Join(err, checkpointErr)
+	}
+	return err
+}
+
+// connState is the state of a connection used to close it gracefully.
+//
+// The fields are protected by the mutex of the Server.
+type connState struct {
+	conn net.Conn
+	// clientID is the id of the client after the handshake
+	clientID string
+	// version is the protocol version of the connection, it is 0 during the handshake
+	version byte
+	// active is the number of requests being processed
+	active int
+	// reading is true while a frame is received, the idle timeout does not apply
+	reading bool
+	// draining is true when the Server is shutting down while a frame is received, the
+	// frame is processed before the connection is closed
+	draining bool
+	// goingAway is true when the notice was sent or is being sent
+	goingAway bool
+}
+
+// shuttingDown reports if Shutdown was called.
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackListener adds or removes a listener served by the Server, it returns false when
+// the listener is added after Shutdown.
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		s.listeners = slices.DeleteFunc(s.listeners, func(l net.Listener) bool { return l == listener })
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	return true
+}
+
+// trackConn adds a connection of a client and counts it in wg, it returns ErrServerClosed
+// when the connection is added after Shutdown and errTooManyConnections when the Server has
+// the maximum connections. The connections in the TLS handshake and in the handshake of the
+// protocol are counted too.
+func (s *Server) trackConn(conn net.Conn) (*connState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	if s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		return nil, errTooManyConnections
+	}
+	state := &connState{conn: conn}
+	s.conns[conn] = state
+	s.wg.Add(1)
+	return state, nil
+}
+
+// rejectConn answers the handshake of a connection that exceeds the maximum connections of
+// the Server with ErrorTooManyConnections and closes it.
+//
+// The handshake request is read before the response, closing a connection with unread data
+// can discard the response before the client reads it.
+func (s *Server) rejectConn(conn net.Conn) {
+	defer conn.Close()
+	if err := tlsHandshake(conn, rejectTimeout); err != nil {
+		s.logger.Error("TLS handshake failed", "addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if _, err := protocol.ReadHandshakeRequest(bufio.NewReader(conn)); err != nil {
+		s.logger.Error("handshake read failed", "addr", conn.RemoteAddr(), "error", err)
+		return
+	}
+	resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status: protocol.StatusError, Error: protocol.ErrorTooManyConnections,
+	})
+	_, _ = conn.Write(resp)
+}
+
+// untrackConn removes a connection added by trackConn and releases its place in the limits
+// of connections.
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.conns[conn]
+	delete(s.conns, conn)
+	if state == nil || state.version == 0 {
+		return
+	}
+	s.perClient[state.clientID]--
+	if s.perClient[state.clientID] == 0 {
+		delete(s.perClient, state.clientID)
+	}
+}
+
+// admit records a connection that completed the handshake, it returns the error code of
+// the handshake response when the connection is rejected because the Server is shutting
+// down or the client id has the maximum connections.
+func (s *Server) admit(state *connState, clientID string, version byte) protocol.ErrorCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return protocol.ErrorGoingAway
+	}
+	if s.maxConnsPerClient > 0 && s.perClient[clientID] >= s.maxConnsPerClient {
+		s.logger.Warn("The client has the maximum connections", "clientID", clientID, "maxConnectionsPerClient", s.maxConnsPerClient)
+		return protocol.ErrorTooManyConnections
+	}
+
+	s.perClient[clientID]++
+	state.clientID = clientID
+	state.version = version
+	return protocol.NoError
+}
+
+// waitFrame blocks until the first byte of the next frame is received, it returns the
+// error of the reader when the connection is closed or the idle timeout expires.
+//
+// The idle timeout applies only when the connection has no requests in flight, the read
+// timeout applies from the first byte until waitFrame is called again.
+func (s *Server) waitFrame(state *connState, reader *bufio.Reader) error {
+	s.mu.Lock()
+	state.reading = false
+	s.armIdleTimeout(state)
+	s.mu.Unlock()
+
+	if _, err := reader.Peek(1); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	state.reading = true
+	s.mu.Unlock()
+	return state.conn.SetReadDeadline(deadline(s.readTimeout))
+}
+
+// armIdleTimeout sets the read deadline of a connection waiting for a frame, a connection
+// with requests in flight waits without deadline. The caller must hold the mutex.
+func (s *Server) armIdleTimeout(state *connState) {
+	if state.reading {
+		return
+	}
+	if state.active > 0 {
+		_ = state.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	_ = state.conn.SetReadDeadline(deadline(s.idleTimeout))
+}
+
+// deadline returns the deadline after timeout, a zero timeout has no deadline.
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// deadlineWriter sets the write deadline of the connection before every write, a response
+// streamed in many writes is not limited by the time of the full response.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	if err := w.conn.SetWriteDeadline(deadline(w.timeout)); err != nil {
+		return 0, err
+	}
+	return w.conn.Write(p)
+}
+
+// beginRequest counts a request of the connection as in flight, it returns false when the
+// Server is shutting down and the request must not be processed. The frame that was being
+// received when the shutdown started is processed.
+func (s *Server) beginRequest(state *connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed && !state.draining {
+		return false
+	}
+	state.draining = false
+	state.active++
+	return true
+}
+
+// endRequest finishes a request started with beginRequest, the connection is closed when
+// the Server is shutting down and it was the last request in flight.
+//
+// It must be called after the response is written, no other response can be written at the
+// same time than the notice.
+func (s *Server) endRequest(state *connState) {
+	s.mu.Lock()
+	state.active--
+	goAway := s.closed && state.active == 0 && !state.goingAway
+	if goAway {
+		state.goingAway = true
+	}
+	s.armIdleTimeout(state)
+	s.mu.Unlock()
+
+	if goAway {
+		s.goAway(state)
+	}
+}
+
+// goAway sends the notice of the shutdown to a connection and closes it, a connection in
+// the handshake is closed without the notice.
+func (s *Server) goAway(state *connState) {
+	if state.version != 0 {
+		_ = state.conn.SetWriteDeadline(time.Now().Add(goAwayTimeout))
+		if _, err := state.conn.Write(protocol.EncodeGoAway(state.version)); err != nil {
+			s.logger.Warn("The shutdown notice could not be sent", "address", state.conn.RemoteAddr(), "error", err)
+		}
+	}
+	state.conn.Close()
+}
+
+// StartNBD starts the NBD frontend that exports the volumes and files of the default storage.
+func StartNBD() (*nbd.Server, error) {
+	return ListenNBD(NBDPort, storage.Default())
+}
+
+// ListenNBD starts the NBD frontend on address that exports the volumes and files of store,
+// the frontend is stopped with the Shutdown of the returned server.
+//
+// Every client that reaches address can read and write every export, the keys, the ACL and
+// the TLS configuration of a Server are not used by the NBD frontend.
+func ListenNBD(address string, store *storage.Store) (*nbd.Server, error) {
+	slog.Info("Starting NBD server on", "port", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("Error while starting the NBD server, ", "error", err)
+		return nil, err
+	}
+
+	nbdServer := nbd.NewServer(store)
+	go nbdServer.Serve(listener)
+	return nbdServer, nil
 }
 
 // handleClientConnection manages a client connection.
@@ -55,92 +578,227 @@ func StartApplication() (net.Listener, error) {
 // This is the connection loop where server receive and send message to clients.
 // When a client is exited from this function that means the connection was terminated.
 // Clients must send a '\n' character to terminate the message.
-func handleClientConnection(conn net.Conn) {
+func (s *Server) handleClientConnection(state *connState) {
+	conn := state.conn
 	defer conn.Close()
-	slog.Info("Client connected", "address", conn.RemoteAddr())
+	s.logger.Info("Client connected", "address", conn.RemoteAddr())
+	if err := tlsHandshake(conn, s.handshakeTimeout); err != nil {
+		s.logger.Error("TLS handshake failed", "addr", conn.RemoteAddr(), "error", err)
+		return
+	}
 	reader := bufio.NewReader(conn)
 
 	// If the handshake is not successful we exit of the function
 	// with this validation we avoid enter in the connection loop
-	client, ok := performHandshake(reader, conn)
+	client, ok := s.performHandshake(reader, state)
 	if !ok {
 		return // handshake failed; response already sent (if any)
 	}
-	defer clients.Remove(client.ID)
+	defer s.registry.Remove(client.ID)
+
+	mp := s.newProcessor()
+	defer mp.Close(client)
+
+	if client.Version == protocol.ProtocolVersion2 {
+		s.serveFramesV2(state, reader, client, mp)
+		return
+	}
 
-	mp := &processor.DefaultMessageProcessor{}
+	writer := deadlineWriter{conn: conn, timeout: s.writeTimeout}
 	header := make([]byte, 4)
 	for {
+		if err := s.waitFrame(state, reader); err != nil {
+			s.readFailed(client, err)
+			break
+		}
+
 		// ================== Read client request header
-		n, err := io.ReadFull(conn, header)
+		n, err := io.ReadFull(reader, header)
 		if err != nil {
-			if err.Error() == "EOF" {
-				slog.Info("Client disconnected", "client", client.ID, "address", conn.RemoteAddr())
-				break
-			}
-			slog.Info("Header messages could not be received", "client", client.ID)
+			s.readFailed(client, err)
 			break
 		}
 
-		slog.Info("Reading header message", "client", client.ID, "totalHeaderBytes", n)
+		s.logger.Info("Reading header message", "client", client.ID, "totalHeaderBytes", n)
 
-		// message length can be up to 4096 MiB
+		// message length can be up to 4096 MiB, the messages bigger than the limit are discarded
+		// without allocating them and the client receives a BadRequest response
 		msgLength := binary.BigEndian.Uint32(header)
+		if s.maxFrameSize > 0 && msgLength > s.maxFrameSize {
+			s.logger.Warn("The frame is bigger than the maximum frame size", "client", client.ID, "payloadLength", msgLength, "maxFrameSize", s.maxFrameSize)
+			if _, err := io.CopyN(io.Discard, reader, int64(msgLength)); err != nil {
+				s.readFailed(client, err)
+				break
+			}
+			if !s.rejectFrame(state, writer, client, 0) {
+				break
+			}
+			continue
+		}
 
 		// Second read the message payload
 		// reading the exact number of bytes for the message payload
 		payload := make([]byte, msgLength)
 		// ================== Read client request body
-		n, err = io.ReadFull(conn, payload)
+		n, err = io.ReadFull(reader, payload)
 		if err != nil {
-			if err.Error() == "EOF" {
-				slog.Info("Client disconnected", "client", client.ID, "address", conn.RemoteAddr())
-				break
-			}
-			slog.Error("A problem occurred while reading the payload", "client", client.ID, "payloadLength", msgLength, "error", err)
+			s.logger.Error("A problem occurred while reading the payload", "client", client.ID, "payloadLength", msgLength, "error", err)
 			break
 		}
 
-		slog.Info("Receiving data", "client", client.ID, "bytesLength", n, "payloadLength", len(payload))
+		s.logger.Info("Receiving data", "client", client.ID, "bytesLength", n, "payloadLength", len(payload))
 
-		response, header, err := mp.Process(payload, client)
+		if !s.beginRequest(state) {
+			s.logger.Info("The server is shutting down, the request is not processed", "client", client.ID)
+			break
+		}
+		// the response of a READ is streamed to the connection one block at a time
+		err = mp.ProcessTo(payload, client, writer)
+		s.endRequest(state)
 		if err != nil {
-			slog.Error("Error processing message", "client", client.ID, "error", err)
-			// In a future iteration, send an error response back to the client
+			s.logger.Error("Error sending the response, closing the connection", "client", client.ID, "error", err)
+			break
 		}
+	}
+}
 
-		if header < 0 {
-			// TODO: send a client message error indicating the header could not be empty and something wrongs happened
-		}
+// rejectFrame sends a BadRequest response to a frame that was discarded, it returns false
+// when the connection must be closed.
+func (s *Server) rejectFrame(state *connState, writer io.Writer, client *client.Client, requestID uint32) bool {
+	if !s.beginRequest(state) {
+		return false
+	}
+	defer s.endRequest(state)
 
-		slog.Info("Sending a client header message", "client", client.ID, "headerSize", header)
-		headerBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(headerBytes, uint32(header))
+	if _, err := writer.Write(protocol.EncodeErrorFrame(client.Version, requestID, protocol.ErrorBadRequest)); err != nil {
+		s.logger.Error("Error sending the response, closing the connection", "client", client.ID, "requestID", requestID, "error", err)
+		return false
+	}
+	return true
+}
 
-		// ================== Write header server to client
-		if _, err = conn.Write(headerBytes); err != nil {
-			slog.Error("Error sending the client header", "client", client.ID, "error", err)
+// readFailed logs the reason why the next frame of the client could not be read.
+func (s *Server) readFailed(client *client.Client, err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		s.logger.Info("Client disconnected", "client", client.ID, "address", client.Addr)
+	case s.shuttingDown():
+		s.logger.Info("Connection closed by the shutdown", "client", client.ID)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.logger.Warn("The client did not send a frame in time, closing the connection", "client", client.ID, "error", err)
+	default:
+		s.logger.Error("A problem occurred while reading the frame", "client", client.ID, "error", err)
+	}
+}
+
+// serveFramesV2 is the connection loop of the protocol version 2.
+//
+// Every request is processed in its own goroutine and the response is sent as soon as it is
+// ready, the request ID in the frame allows the client to match the responses. At most
+// maxInFlight requests are read and processed at the same time, the next frame is not read
+// until a request finishes. The messages that must keep their order (the upload chunks) wait
+// for the previous ordered message before they are processed.
+func (s *Server) serveFramesV2(state *connState, reader *bufio.Reader, client *client.Client, mp Processor) {
+	conn := state.conn
+	writer := deadlineWriter{conn: conn, timeout: s.writeTimeout}
+	var (
+		wg         sync.WaitGroup
+		writeMutex sync.Mutex
+		inFlight   = make(chan struct{}, s.maxInFlight)
+		// previous is closed when the last ordered message was processed
+		previous chan struct{}
+	)
+	// the uploads are aborted after all the requests finished
+	defer wg.Wait()
+
+	for {
+		// the slot is taken before the frame is read, a connection buffers at most maxInFlight frames
+		inFlight <- struct{}{}
+		if err := s.waitFrame(state, reader); err != nil {
+			s.readFailed(client, err)
+			return
+		}
+		frame, err := protocol.ReadFrameV2(reader, s.maxFrameSize)
+		if errors.Is(err, protocol.ErrFrameTooLarge) {
+			s.logger.Warn("The frame is bigger than the maximum frame size", "client", client.ID, "requestID", frame.RequestID, "error", err)
+			writeMutex.Lock()
+			ok := s.rejectFrame(state, writer, client, frame.RequestID)
+			writeMutex.Unlock()
+			<-inFlight
+			if !ok {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			s.readFailed(client, err)
+			return
+		}
+		s.logger.Info("Receiving frame", "client", client.ID, "requestID", frame.RequestID, "opcode", frame.Opcode, "bytesLength", len(frame.Message))
+		// the connection is closed when the requests in flight finish
+		if !s.beginRequest(state) {
+			s.logger.Info("The server is shutting down, the request is not processed", "client", client.ID, "requestID", frame.RequestID)
+			return
 		}
 
-		slog.Info("Sending a message response", "client", client.ID, "responseBytesLength", len(response))
-		// ================== Write response server to client
-		if _, err = conn.Write(response); err != nil {
-			slog.Error("Error writing response", "client", client.ID, "error", err)
+		var wait, done chan struct{}
+		if frame.Opcode.Ordered() {
+			wait, done = previous, make(chan struct{})
+			previous = done
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.endRequest(state)
+			defer func() { <-inFlight }()
+
+			if wait != nil {
+				<-wait
+			}
+			reply := mp.ProcessReply(frame.Message, client)
+			if done != nil {
+				close(done)
+			}
+			defer reply.Close()
+
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+
+			header := protocol.EncodeResponseFrameHeaderV2(frame.RequestID, frame.Opcode, reply.Length())
+			_, err := writer.Write(header)
+			if err == nil {
+				_, err = reply.WriteTo(writer)
+			}
+			if err != nil {
+				// the frames after a partial response can not be parsed by the client
+				s.logger.Error("Error sending the response, closing the connection", "client", client.ID, "requestID", frame.RequestID, "error", err)
+				conn.Close()
+			}
+		}()
 	}
 }
 
-func performHandshake(reader *bufio.Reader, conn net.Conn) (*client.Client, bool) {
-	slog.Info("Start to process the client handshake")
-	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	raw, err := reader.ReadBytes(protocol.MessageEndChar)
+// performHandshake reads the handshake of the client, when the Server has keys the client
+// needs to request the auth capability and answer the challenge.
+//
+// The connection is admitted after the client is authenticated, it is rejected with
+// ErrorTooManyConnections when the client id has the maximum connections.
+func (s *Server) performHandshake(reader *bufio.Reader, state *connState) (*client.Client, bool) {
+	s.logger.Info("Start to process the client handshake")
+	conn := state.conn
+	// the deadline covers the handshake and the authentication, the frames have their own deadlines
+	_ = conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	raw, err := protocol.ReadHandshakeRequest(reader)
 	if err != nil {
-		slog.Error("handshake read failed", "addr", conn.RemoteAddr(), "error", err)
+		s.logger.Error("handshake read failed", "addr", conn.RemoteAddr(), "error", err)
 		return nil, false
 	}
 	req, err := protocol.DecodeHandshakeRequest(raw)
 	if err != nil {
-		slog.Error("bad handshake", "addr", conn.RemoteAddr(), "error", err)
+		s.logger.Error("bad handshake", "addr", conn.RemoteAddr(), "error", err)
 		resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
 			Status: protocol.StatusError, Error: protocol.ErrorBadRequest,
 		})
@@ -148,8 +806,8 @@ func performHandshake(reader *bufio.Reader, conn net.Conn) (*client.Client, bool
 		return nil, false
 	}
 
-	if req.Version != protocol.ProtocolVersion {
-		slog.Error("unsupported version", "got", req.Version, "want", protocol.ProtocolVersion)
+	if !protocol.SupportedVersion(req.Version) {
+		s.logger.Error("unsupported version", "got", req.Version, "want", protocol.ProtocolVersion2)
 		resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
 			Status: protocol.StatusError, Error: protocol.ErrorBadRequest,
 		})
@@ -157,26 +815,65 @@ func performHandshake(reader *bufio.Reader, conn net.Conn) (*client.Client, bool
 		return nil, false
 	}
 
+	// with mutual TLS the id of the client is the common name of its certificate
 	id := req.ClientID
+	if cn, mutual := certificateID(conn); mutual {
+		if cn == "" {
+			s.logger.Error("the client certificate has no common name", "addr", conn.RemoteAddr())
+			resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+				Status: protocol.StatusError, Error: protocol.ErrorPermissionDenied,
+			})
+			_, _ = conn.Write(resp)
+			return nil, false
+		}
+		id = cn
+	}
+
+	supported := protocol.ServerCapabilities
+	if s.keys != nil {
+		supported |= protocol.CapabilityAuth
+		if !req.Capabilities.Has(protocol.CapabilityAuth) || !s.keys.authenticate(reader, conn, id, s.logger) {
+			s.logger.Error("authentication failed", "clientID", id, "addr", conn.RemoteAddr())
+			resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+				Status: protocol.StatusError, Error: protocol.ErrorPermissionDenied,
+			})
+			_, _ = conn.Write(resp)
+			return nil, false
+		}
+	}
+
 	if id == "" {
 		id = randomID()
 	}
+	if code := s.admit(state, id, req.Version); code != protocol.NoError {
+		s.logger.Error("connection rejected", "clientID", id, "addr", conn.RemoteAddr(), "error", code)
+		resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+			Status: protocol.StatusError, Error: code,
+		})
+		_, _ = conn.Write(resp)
+		return nil, false
+	}
 	client := &client.Client{
-		ID:          id,
-		Version:     req.Version,
-		Addr:        conn.RemoteAddr().String(),
-		Conn:        conn,
-		ConnectedAt: time.Now(),
+		ID:           id,
+		Version:      req.Version,
+		Capabilities: req.Capabilities.Negotiate(supported, req.Version),
+		Addr:         conn.RemoteAddr().String(),
+		Conn:         conn,
+		ConnectedAt:  time.Now(),
 	}
 
-	clients.Add(client)
+	s.registry.Add(client)
 
+	// the clients that do not send capabilities receive the response of the first version
 	resp := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
-		Status:     protocol.StatusOk,
-		AssignedID: id,
+		Status:       protocol.StatusOk,
+		AssignedID:   id,
+		Negotiated:   req.Capabilities != 0,
+		Capabilities: client.Capabilities,
+		MaxFrameSize: s.maxFrameSize,
 	})
 	_, _ = conn.Write(resp)
-	slog.Info("handshake completed", "clientID", client.ID, "addr", client.Addr, "version", client.Version)
+	s.logger.Info("handshake completed", "clientID", client.ID, "addr", client.Addr, "version", client.Version, "capabilities", client.Capabilities)
 	return client, true
 }
 
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// TLSConfig returns the configuration of a TLS listener with the certificate and key files.
+//
+// When clientCAFile is not empty the clients need a certificate signed by one of the CAs of
+// the file (mutual TLS), the common name of the certificate is the id of the client.
+func TLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	slog.Info("Loading the TLS certificate", "cert", certFile, "key", keyFile, "clientCA", clientCAFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("the TLS certificate could not be loaded: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("the client CA could not be loaded: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("the file=%s does not contain PEM certificates", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// loadTLSConfigFromEnv returns the TLS configuration of the files in STG_TLS_CERT, STG_TLS_KEY
+// and STG_TLS_CLIENT_CA, it returns a nil configuration when the certificate is not set and
+// the server listens without TLS.
+func loadTLSConfigFromEnv() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("STG_TLS_CERT"), os.Getenv("STG_TLS_KEY")
+	clientCAFile := os.Getenv("STG_TLS_CLIENT_CA")
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("STG_TLS_CLIENT_CA needs STG_TLS_CERT and STG_TLS_KEY")
+		}
+		slog.Warn("STG_TLS_CERT is not set, the traffic is not encrypted")
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("STG_TLS_CERT and STG_TLS_KEY need to be set together")
+	}
+	return TLSConfig(certFile, keyFile, clientCAFile)
+}
+
+// tlsHandshake completes the TLS handshake of a connection accepted by a TLS listener, it
+// does nothing for a plain connection.
+//
+// The handshake is done before the handshake of the protocol so the certificate of the
+// client is available.
+func tlsHandshake(conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
+
+// certificateID returns the common name of the verified certificate of the client, mutual is
+// false when the connection does not use mutual TLS.
+func certificateID(conn net.Conn) (id string, mutual bool) {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return "", false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
@@ -4,15 +4,19 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
 )
 
 type Client struct {
-	ID          string
-	Version     byte
-	Addr        string
-	Conn        net.Conn
-	ConnectedAt time.Time
-	Metadata    map[string]string
+	ID      string
+	Version byte
+	// Capabilities are the capabilities negotiated in the handshake
+	Capabilities protocol.Capabilities
+	Addr         string
+	Conn         net.Conn
+	ConnectedAt  time.Time
+	Metadata     map[string]string
 }
 
 type ClientRegistry struct {
@@ -0,0 +1,425 @@
+// Package stgclient is a Go client for the STG binary protocol described in docs/binary_protocol.txt.
+//
+// A Client performs the handshake when it is created, the methods are safe to call from
+// multiple goroutines. With the protocol version 1 the client sends one request at a time,
+// with the protocol version 2 the requests of many goroutines are sent without waiting for
+// the previous responses.
+package stgclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+)
+
+// HandshakeTimeout is the maximum time Dial waits for the handshake response.
+const HandshakeTimeout = 10 * time.Second
+
+var (
+	// ErrNotFound is returned when the file does not exist in the server.
+	ErrNotFound = errors.New("stgclient: file not found")
+	// ErrBadRequest is returned when the server rejects the request.
+	ErrBadRequest = errors.New("stgclient: bad request")
+	// ErrPermissionDenied is returned when the server does not admit the client or the client can not do the operation.
+	ErrPermissionDenied = errors.New("stgclient: permission denied")
+	// ErrSecretRequired is returned by Dial when the server requires authentication and the options have no secret.
+	ErrSecretRequired = errors.New("stgclient: the server requires a secret")
+	// ErrCorruptedData is returned when a block of the file is missing or corrupted in the server.
+	ErrCorruptedData = errors.New("stgclient: corrupted data")
+	// ErrServerGoingAway is returned when the server is shutting down, the connection is closed after it.
+	ErrServerGoingAway = errors.New("stgclient: the server is shutting down")
+	// ErrTooManyConnections is returned by Dial when the server or the client id has the maximum connections.
+	ErrTooManyConnections = errors.New("stgclient: too many connections")
+	// ErrFrameTooLarge is returned without sending the request when it is bigger than the
+	// maximum frame size of the server, the big files are saved with Upload.
+	ErrFrameTooLarge = errors.New("stgclient: the request is bigger than the maximum frame size of the server")
+	// ErrNoResponse is returned when the server could not process the request and sent an empty response.
+	ErrNoResponse = errors.New("stgclient: the server could not process the request")
+)
+
+// ResponseError is the error returned when the server responds with an error status.
+//
+// It wraps ErrNotFound, ErrBadRequest, ErrPermissionDenied, ErrCorruptedData,
+// ErrServerGoingAway or ErrTooManyConnections for the known error codes, use errors.Is to
+// check the error.
+type ResponseError struct {
+	Code protocol.ErrorCode
+}
+
+func (e *ResponseError) Error() string {
+	if err := e.Unwrap(); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("stgclient: server error code=%d", e.Code)
+}
+
+func (e *ResponseError) Unwrap() error {
+	switch e.Code {
+	case protocol.ErrorNotFound:
+		return ErrNotFound
+	case protocol.ErrorBadRequest:
+		return ErrBadRequest
+	case protocol.ErrorPermissionDenied:
+		return ErrPermissionDenied
+	case protocol.ErrorCorruptedData:
+		return ErrCorruptedData
+	case protocol.ErrorGoingAway:
+		return ErrServerGoingAway
+	case protocol.ErrorTooManyConnections:
+		return ErrTooManyConnections
+	default:
+		return nil
+	}
+}
+
+// Client is a connection to a STG server.
+type Client struct {
+	// mu is held during a full request with the protocol version 1,
+	// and only while a frame is written with the protocol version 2
+	mu           sync.Mutex
+	conn         net.Conn
+	id           string
+	version      byte
+	capabilities protocol.Capabilities
+	// maxFrameSize is the maximum frame size of the server, 0 when it is unknown
+	maxFrameSize uint32
+
+	// the requests of the protocol version 2 waiting for a response
+	pendingMutex  sync.Mutex
+	pending       map[uint32]*call
+	lastRequestID uint32
+	// readErr is the error that stopped the response reader, the next requests fail with it
+	readErr error
+}
+
+// Options configures a connection created by DialOptions.
+type Options struct {
+	// ClientID is sent in the handshake, the protocol requires a client id between 4 and 255 bytes.
+	ClientID string
+	// Version is the protocol version used by the connection, 0 uses protocol.ProtocolVersion.
+	Version byte
+	// Capabilities are the capabilities requested in the handshake, 0 does not request
+	// capabilities and it works with the servers that do not support them. With
+	// protocol.CapabilityMaxFrameSize the requests bigger than the limit of the server are
+	// not sent.
+	Capabilities protocol.Capabilities
+	// Secret is the key shared with the server to answer the authentication challenge,
+	// protocol.CapabilityAuth is requested when it is set.
+	Secret []byte
+	// TLSConfig enables TLS when it is not nil, a client certificate in the configuration is
+	// used when the server requires mutual TLS, its common name is the id of the client.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to the server at addr and performs the handshake with clientID,
+// the protocol requires a client id between 4 and 255 bytes.
+func Dial(addr string, clientID string) (*Client, error) {
+	return DialOptions(addr, Options{ClientID: clientID})
+}
+
+// DialOptions connects to the server at addr and performs the handshake with the options.
+func DialOptions(addr string, opts Options) (*Client, error) {
+	var conn net.Conn
+	var err error
+	if opts.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", addr, opts.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(conn, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// newClient performs the handshake over an open connection.
+func newClient(conn net.Conn, opts Options) (*Client, error) {
+	version := opts.Version
+	if version == 0 {
+		version = protocol.ProtocolVersion
+	}
+	if opts.Secret != nil {
+		opts.Capabilities |= protocol.CapabilityAuth
+	}
+
+	handshake, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{
+		Version:      version,
+		Capabilities: opts.Capabilities,
+		ClientID:     opts.ClientID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(handshake); err != nil {
+		return nil, err
+	}
+
+	resp, err := protocol.ReadHandshakeResponse(conn, opts.Capabilities)
+	if err != nil {
+		return nil, fmt.Errorf("stgclient: handshake failed: %w", err)
+	}
+	if resp.Status == protocol.StatusChallenge {
+		resp, err = authenticate(conn, opts, resp.Challenge)
+		if err != nil {
+			return nil, fmt.Errorf("stgclient: authentication failed: %w", err)
+		}
+	}
+	if resp.Status != protocol.StatusOk {
+		return nil, fmt.Errorf("stgclient: handshake rejected: %w", &ResponseError{Code: resp.Error})
+	}
+
+	client := &Client{conn: conn, id: resp.AssignedID, version: version, capabilities: resp.Capabilities, maxFrameSize: resp.MaxFrameSize}
+	if version == protocol.ProtocolVersion2 {
+		client.pending = make(map[uint32]*call)
+		go client.readResponses()
+	}
+	return client, nil
+}
+
+// authenticate answers the challenge of the server and reads the handshake response.
+func authenticate(conn net.Conn, opts Options, challenge []byte) (protocol.HandshakeResponse, error) {
+	if opts.Secret == nil {
+		return protocol.HandshakeResponse{}, ErrSecretRequired
+	}
+	mac := protocol.AuthMAC(opts.Secret, challenge, opts.ClientID)
+	if _, err := conn.Write(protocol.EncodeAuthResponse(mac)); err != nil {
+		return protocol.HandshakeResponse{}, err
+	}
+	return protocol.ReadHandshakeResponse(conn, opts.Capabilities)
+}
+
+// ID returns the client id assigned by the server in the handshake.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// Capabilities returns the capabilities negotiated in the handshake, they are the requested
+// capabilities that the server supports.
+func (c *Client) Capabilities() protocol.Capabilities {
+	return c.capabilities
+}
+
+// MaxFrameSize returns the maximum length of a request frame of the server, it is 0 when
+// the server has no limit or protocol.CapabilityMaxFrameSize was not requested.
+func (c *Client) MaxFrameSize() uint32 {
+	return c.maxFrameSize
+}
+
+// Close closes the connection with the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Read returns the content of a file.
+func (c *Client) Read(filename string) ([]byte, error) {
+	return c.do(protocol.Message{MessageType: protocol.MessageRead, Filename: filename})
+}
+
+// ReadRange returns length bytes of a file starting at offset.
+func (c *Client) ReadRange(filename string, offset uint64, length uint32) ([]byte, error) {
+	return c.do(protocol.Message{MessageType: protocol.MessageReadRange, Filename: filename, Offset: offset, Length: length})
+}
+
+// Write saves a new file, the server keeps the current content when the file already exists.
+func (c *Client) Write(filename string, data []byte) error {
+	_, err := c.do(protocol.Message{MessageType: protocol.MessageWrite, Filename: filename, RawData: data})
+	return err
+}
+
+// WriteWithTags saves a new file with tags, the server keeps the current content and tags
+// when the file already exists.
+func (c *Client) WriteWithTags(filename string, data []byte, tags map[string]string) error {
+	_, err := c.do(protocol.Message{MessageType: protocol.MessageWrite, Filename: filename, RawData: data, Tags: tags})
+	return err
+}
+
+// Upload saves a new file with the content of r, the content is sent in chunks of
+// protocol.DefaultChunkSize bytes so the file does not need to fit in memory.
+//
+// The file is visible in the server only when all the content was sent, if the upload
+// fails it is aborted. It returns the number of bytes saved, an error wrapping ErrBadRequest
+// is returned when the file already exists.
+func (c *Client) Upload(filename string, r io.Reader, tags map[string]string) (int64, error) {
+	payload, err := c.do(protocol.Message{MessageType: protocol.MessageUploadBegin, Filename: filename, Tags: tags})
+	if err != nil {
+		return 0, err
+	}
+	uploadID, err := protocol.DecodeUploadPayload(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := c.sendChunks(uploadID, r)
+	if err != nil {
+		// the server aborts the upload when the connection is closed, the error is not relevant
+		_, _ = c.do(protocol.Message{MessageType: protocol.MessageUploadAbort, UploadID: uploadID})
+		return size, err
+	}
+
+	if _, err := c.do(protocol.Message{MessageType: protocol.MessageUploadCommit, UploadID: uploadID}); err != nil {
+		return size, err
+	}
+	return size, nil
+}
+
+// uploadWindow is the number of chunks sent without waiting for their responses with the protocol version 2.
+const uploadWindow = 4
+
+// sendChunks sends the content of r to the upload and returns the number of bytes sent.
+//
+// With the protocol version 2 up to uploadWindow chunks are sent before waiting for the
+// first response, the server appends the chunks in the order they are received.
+func (c *Client) sendChunks(uploadID uint64, r io.Reader) (int64, error) {
+	var (
+		size     int64
+		inFlight []*call
+	)
+
+	// wait for the oldest chunk, or all the chunks when all is true
+	wait := func(all bool) error {
+		for len(inFlight) > 0 && (all || len(inFlight) >= uploadWindow) {
+			res := inFlight[0].wait()
+			inFlight = inFlight[1:]
+			if res.err != nil {
+				for _, pending := range inFlight {
+					pending.wait()
+				}
+				inFlight = nil
+				return res.err
+			}
+		}
+		return nil
+	}
+
+	chunk := make([]byte, protocol.DefaultChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			request, encodeErr := protocol.EncodeMessage(protocol.Message{MessageType: protocol.MessageUploadChunk, UploadID: uploadID, RawData: chunk[:n]})
+			if encodeErr != nil {
+				return size, encodeErr
+			}
+
+			if c.version != protocol.ProtocolVersion2 {
+				if res := c.roundTrip(request, nil); res.err != nil {
+					return size, res.err
+				}
+			} else {
+				sent, sendErr := c.start(request, nil)
+				if sendErr != nil {
+					wait(true)
+					return size, sendErr
+				}
+				inFlight = append(inFlight, sent)
+				if waitErr := wait(false); waitErr != nil {
+					return size, waitErr
+				}
+			}
+			size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, wait(true)
+		}
+		if err != nil {
+			wait(true)
+			return size, err
+		}
+	}
+}
+
+// WriteAt writes data in an existing file starting at offset.
+func (c *Client) WriteAt(filename string, offset uint64, data []byte) error {
+	_, err := c.do(protocol.Message{MessageType: protocol.MessageWriteAt, Filename: filename, Offset: offset, RawData: data})
+	return err
+}
+
+// Update replaces the content of an existing file, it returns the content saved by the server.
+func (c *Client) Update(filename string, data []byte) ([]byte, error) {
+	return c.do(protocol.Message{MessageType: protocol.MessageUpdate, Filename: filename, RawData: data})
+}
+
+// Delete removes a file.
+func (c *Client) Delete(filename string) error {
+	_, err := c.do(protocol.Message{MessageType: protocol.MessageDelete, Filename: filename})
+	return err
+}
+
+// Tags returns the tags of a file.
+func (c *Client) Tags(filename string) (map[string]string, error) {
+	payload, err := c.do(protocol.Message{MessageType: protocol.MessageGetTags, Filename: filename})
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeTagsPayload(payload)
+}
+
+// SetTags adds tags to a file without rewriting its content and returns all the tags of the file,
+// a tag with an empty value is removed.
+func (c *Client) SetTags(filename string, tags map[string]string) (map[string]string, error) {
+	payload, err := c.do(protocol.Message{MessageType: protocol.MessageSetTags, Filename: filename, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeTagsPayload(payload)
+}
+
+// Stat returns the information of a file without reading its content.
+func (c *Client) Stat(filename string) (protocol.FileStat, error) {
+	payload, err := c.do(protocol.Message{MessageType: protocol.MessageStat, Filename: filename})
+	if err != nil {
+		return protocol.FileStat{}, err
+	}
+	return protocol.DecodeStatPayload(payload)
+}
+
+// List returns a page of at most limit files whose name starts with prefix and comes after cursor,
+// a limit of 0 uses the server default. The NextCursor of the result is empty in the last page.
+func (c *Client) List(prefix string, cursor string, limit uint32) (protocol.ListResult, error) {
+	payload, err := c.do(protocol.Message{MessageType: protocol.MessageList, Prefix: prefix, Cursor: cursor, Length: limit})
+	if err != nil {
+		return protocol.ListResult{}, err
+	}
+	return protocol.DecodeListPayload(payload)
+}
+
+// Download writes the content of a file to w and returns the number of bytes written.
+//
+// The content is copied to w while it is received, the file does not need to fit in memory.
+// When w fails the rest of the content is discarded, the client can still be used.
+func (c *Client) Download(filename string, w io.Writer) (int64, error) {
+	request, err := protocol.EncodeMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: filename})
+	if err != nil {
+		return 0, err
+	}
+
+	res := c.roundTrip(request, w)
+	return res.written, res.err
+}
+
+// do sends a request and returns the payload of the response.
+func (c *Client) do(msg protocol.Message) ([]byte, error) {
+	request, err := protocol.EncodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	res := c.roundTrip(request, nil)
+	return res.payload, res.err
+}
@@ -0,0 +1,388 @@
+package stgclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/internal/server"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer starts a server on a random port with an empty store and the options,
+// the server is stopped when the test finishes.
+func startTestServer(t *testing.T, opts ...server.Option) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the application: %v", err)
+	}
+
+	srv := server.New(append([]server.Option{server.WithBackend(storage.NewMemoryBackend())}, opts...)...)
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return listener.Addr().String()
+}
+
+func TestClientOperations(t *testing.T) {
+	client, err := Dial(startTestServer(t), "client-01")
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, "client-01", client.ID())
+
+	assert.Nil(t, client.Write("sdk-file.txt", []byte("Hello World")))
+
+	data, err := client.Read("sdk-file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+
+	data, err = client.ReadRange("sdk-file.txt", 6, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("World"), data)
+
+	assert.Nil(t, client.WriteAt("sdk-file.txt", 6, []byte("Earth")))
+	data, err = client.Update("sdk-file.txt", []byte("Hello Earth!"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello Earth!"), data)
+
+	stat, err := client.Stat("sdk-file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "sdk-file.txt", stat.Name)
+	assert.Equal(t, uint64(12), stat.Size)
+	assert.Equal(t, "client-01", stat.Owner)
+	assert.False(t, stat.Modified.Before(stat.Created))
+
+	assert.Nil(t, client.Write("sdk-other.txt", []byte("other")))
+	page, err := client.List("sdk-", "", 1)
+	assert.Nil(t, err)
+	assert.Len(t, page.Files, 1)
+	assert.Equal(t, "sdk-file.txt", page.Files[0].Name)
+	page, err = client.List("sdk-", page.NextCursor, 1)
+	assert.Nil(t, err)
+	assert.Len(t, page.Files, 1)
+	assert.Equal(t, "sdk-other.txt", page.Files[0].Name)
+
+	assert.Nil(t, client.Delete("sdk-file.txt"))
+	_, err = client.Read("sdk-file.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDialValidatesClientID(t *testing.T) {
+	address := startTestServer(t)
+
+	// the protocol requires a client id of at least 4 bytes
+	client, err := Dial(address, "abc")
+	assert.NotNil(t, err)
+	assert.Nil(t, client)
+
+	client, err = Dial(address, "abcd")
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, "abcd", client.ID())
+}
+
+func TestClientErrors(t *testing.T) {
+	client, err := Dial(startTestServer(t), "client-02")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Read("missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the filename is validated before sending the request
+	assert.NotNil(t, client.Write("a.txt", []byte("data")))
+
+	assert.Nil(t, client.Write("range-file.txt", []byte("data")))
+	_, err = client.ReadRange("range-file.txt", 100, 1)
+	assert.ErrorIs(t, err, ErrBadRequest)
+	var responseErr *ResponseError
+	assert.ErrorAs(t, err, &responseErr)
+}
+
+func TestClientTags(t *testing.T) {
+	client, err := Dial(startTestServer(t), "client-03")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	assert.Nil(t, client.WriteWithTags("tagged-file.txt", []byte("data"), map[string]string{"team": "ingest"}))
+
+	tags, err := client.SetTags("tagged-file.txt", map[string]string{"retention": "30d"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"team": "ingest", "retention": "30d"}, tags)
+
+	// an empty value removes the tag
+	_, err = client.SetTags("tagged-file.txt", map[string]string{"team": ""})
+	assert.Nil(t, err)
+	tags, err = client.Tags("tagged-file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"retention": "30d"}, tags)
+
+	_, err = client.SetTags("missing-file.txt", map[string]string{"team": "ingest"})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClientUpload(t *testing.T) {
+	client, err := Dial(startTestServer(t), "client-04")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// the content is bigger than a chunk and a block
+	data := bytes.Repeat([]byte("0123456789abcdef"), protocol.DefaultChunkSize/16*2+100)
+	size, err := client.Upload("upload-file.bin", bytes.NewReader(data), map[string]string{"team": "ingest"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	read, err := client.Read("upload-file.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	stat, err := client.Stat("upload-file.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, "client-04", stat.Owner)
+	assert.Equal(t, map[string]string{"team": "ingest"}, stat.Tags)
+
+	// an upload never replaces an existing file
+	_, err = client.Upload("upload-file.bin", bytes.NewReader([]byte("other")), nil)
+	assert.ErrorIs(t, err, ErrBadRequest)
+
+	// a failed upload is aborted and the file is not visible
+	_, err = client.Upload("failed-file.bin", iotest.TimeoutReader(bytes.NewReader(data)), nil)
+	assert.NotNil(t, err)
+	_, err = client.Stat("failed-file.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// failingWriter fails after receiving limit bytes.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("disk full")
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
+
+func TestClientDownload(t *testing.T) {
+	client, err := Dial(startTestServer(t), "client-05")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 40000)
+	assert.Nil(t, client.Write("download-file.bin", data))
+
+	var out bytes.Buffer
+	n, err := client.Download("download-file.bin", &out)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, out.Bytes())
+
+	_, err = client.Download("missing-file.bin", &out)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the content that could not be written is discarded and the client can still be used
+	n, err = client.Download("download-file.bin", &failingWriter{limit: 1000})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1000), n)
+
+	read, err := client.Read("download-file.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+}
+
+func TestClientCapabilities(t *testing.T) {
+	addr := startTestServer(t)
+
+	// a client that does not request capabilities gets none
+	client, err := Dial(addr, "client-07")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.Capabilities(0), client.Capabilities())
+	client.Close()
+
+	requested := protocol.CapabilityCompression | protocol.CapabilityStreaming | protocol.CapabilityPipelining
+	client, err = DialOptions(addr, Options{ClientID: "client-07", Capabilities: requested})
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.CapabilityStreaming, client.Capabilities())
+	assert.Nil(t, client.Write("capabilities.txt", []byte("negotiated")))
+	client.Close()
+
+	client, err = DialOptions(addr, Options{ClientID: "client-07", Version: protocol.ProtocolVersion2, Capabilities: requested})
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, protocol.CapabilityStreaming|protocol.CapabilityPipelining, client.Capabilities())
+	data, err := client.Read("capabilities.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("negotiated"), data)
+}
+
+func TestClientAuthentication(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5A}, 16)
+	keys := filepath.Join(t.TempDir(), "keys")
+	assert.Nil(t, os.WriteFile(keys, []byte("# clientID secret\nclient-08 "+hex.EncodeToString(secret)+"\n"), 0600))
+	serverKeys, err := server.LoadKeys(keys)
+	assert.Nil(t, err)
+	addr := startTestServer(t, server.WithKeys(serverKeys))
+
+	client, err := DialOptions(addr, Options{ClientID: "client-08", Secret: secret})
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.CapabilityAuth, client.Capabilities())
+	assert.Nil(t, client.Write("authenticated.txt", []byte("secret data")))
+	client.Close()
+
+	// a client without the auth capability is rejected
+	_, err = Dial(addr, "client-08")
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+
+	// a wrong secret and an unknown client are rejected
+	_, err = DialOptions(addr, Options{ClientID: "client-08", Secret: bytes.Repeat([]byte{0x01}, 16)})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	_, err = DialOptions(addr, Options{ClientID: "client-09", Secret: secret})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+
+	// the server requires a secret when the client requests the auth capability
+	_, err = DialOptions(addr, Options{ClientID: "client-08", Capabilities: protocol.CapabilityAuth})
+	assert.ErrorIs(t, err, ErrSecretRequired)
+
+	// a keys file with a short secret is not valid
+	assert.Nil(t, os.WriteFile(keys, []byte("client-08 0102\n"), 0600))
+	_, err = server.LoadKeys(keys)
+	assert.NotNil(t, err)
+}
+
+// testCertificate creates a certificate signed by parent, a nil parent creates a CA.
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM saves a certificate or a key in a PEM file.
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	assert.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+func TestClientTLS(t *testing.T) {
+	ca, caKey, _ := testCertificate(t, "test-ca", nil, nil)
+	serverCert, serverKey, _ := testCertificate(t, "127.0.0.1", ca, caKey)
+	_, _, clientCert := testCertificate(t, "cert-client", ca, caKey)
+
+	dir := t.TempDir()
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", serverCert.Raw)
+	keyDER, err := x509.MarshalECPrivateKey(serverKey)
+	assert.Nil(t, err)
+	writePEM(t, filepath.Join(dir, "server-key.pem"), "EC PRIVATE KEY", keyDER)
+
+	tlsConfig, err := server.TLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	assert.Nil(t, err)
+	addr := startTestServer(t, server.WithTLSConfig(tlsConfig))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// the common name of the certificate is the id of the client
+	client, err := DialOptions(addr, Options{
+		ClientID:  "client-10",
+		TLSConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}},
+	})
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, "cert-client", client.ID())
+
+	assert.Nil(t, client.Write("tls-file.txt", []byte("encrypted")))
+	info, err := client.Stat("tls-file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "cert-client", info.Owner)
+
+	// a client without certificate and a plain client are rejected
+	_, err = DialOptions(addr, Options{ClientID: "client-10", TLSConfig: &tls.Config{RootCAs: roots}})
+	assert.NotNil(t, err)
+	_, err = DialOptions(addr, Options{ClientID: "client-10"})
+	assert.NotNil(t, err)
+}
+
+func TestClientVersion2(t *testing.T) {
+	client, err := DialOptions(startTestServer(t), Options{ClientID: "client-06", Version: protocol.ProtocolVersion2})
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// the requests of many goroutines are in flight at the same time
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("pipelined-%02d.txt", i)
+			content := []byte(strings.Repeat(name, i+1))
+
+			assert.Nil(t, client.Write(name, content))
+			data, err := client.Read(name)
+			assert.Nil(t, err)
+			assert.Equal(t, content, data)
+
+			_, err = client.Stat(name + ".missing")
+			assert.ErrorIs(t, err, ErrNotFound)
+		}()
+	}
+	wg.Wait()
+
+	// the chunks of an upload are sent without waiting for every response
+	data := bytes.Repeat([]byte("0123456789abcdef"), protocol.DefaultChunkSize/16*5+100)
+	size, err := client.Upload("pipelined-upload.bin", bytes.NewReader(data), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	var out bytes.Buffer
+	n, err := client.Download("pipelined-upload.bin", &out)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, out.Bytes())
+
+	// the requests fail after the connection is closed
+	assert.Nil(t, client.Close())
+	_, err = client.Read("pipelined-00.txt")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,244 @@
+package stgclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+)
+
+// result is the outcome of a request.
+//
+// payload has the response when the request has no body writer, written is the number
+// of bytes copied to the body writer.
+type result struct {
+	payload []byte
+	written int64
+	err     error
+}
+
+// call is a request of the protocol version 2 waiting for its response.
+type call struct {
+	body   io.Writer
+	result result
+	done   chan struct{}
+}
+
+// wait blocks until the response of the call is received.
+func (c *call) wait() result {
+	<-c.done
+	return c.result
+}
+
+// roundTrip sends a request built by protocol.EncodeMessage and waits for its response,
+// when body is not nil the payload of the response is copied to body.
+func (c *Client) roundTrip(request []byte, body io.Writer) result {
+	if c.version == protocol.ProtocolVersion2 {
+		sent, err := c.start(request, body)
+		if err != nil {
+			return result{err: err}
+		}
+		return sent.wait()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	length, err := c.send(request)
+	if err != nil {
+		return result{err: err}
+	}
+	res, err := readResponse(c.conn, length, body)
+	if err != nil {
+		return result{written: res.written, err: err}
+	}
+	return res
+}
+
+// send writes a request frame of the protocol version 1 and reads the length of the response
+// frame, it returns ErrNoResponse when the length is 0.
+//
+// Every frame is [length(4 bytes)][message], the server uses the same framing for the response.
+// The caller must hold the mutex until the response is read.
+func (c *Client) send(request []byte) (uint32, error) {
+	if c.tooLarge(len(request)) {
+		return 0, ErrFrameTooLarge
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(request)), uint32(len(request)))
+	frame = append(frame, request...)
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 {
+		return 0, ErrNoResponse
+	}
+	return length, nil
+}
+
+// tooLarge reports if a frame of length bytes is bigger than the maximum frame size of the server.
+func (c *Client) tooLarge(length int) bool {
+	return c.maxFrameSize > 0 && uint64(length) > uint64(c.maxFrameSize)
+}
+
+// start sends a request frame of the protocol version 2 without waiting for the response.
+func (c *Client) start(request []byte, body io.Writer) (*call, error) {
+	if c.tooLarge(4 + len(request)) {
+		return nil, ErrFrameTooLarge
+	}
+	sent := &call{body: body, done: make(chan struct{})}
+
+	c.pendingMutex.Lock()
+	if c.readErr != nil {
+		c.pendingMutex.Unlock()
+		return nil, c.readErr
+	}
+	c.lastRequestID++
+	if c.lastRequestID == protocol.NoticeRequestID {
+		c.lastRequestID++
+	}
+	requestID := c.lastRequestID
+	c.pending[requestID] = sent
+	c.pendingMutex.Unlock()
+
+	c.mu.Lock()
+	_, err := c.conn.Write(protocol.EncodeFrameV2(requestID, request))
+	c.mu.Unlock()
+
+	if err != nil {
+		c.pendingMutex.Lock()
+		delete(c.pending, requestID)
+		c.pendingMutex.Unlock()
+		return nil, err
+	}
+	return sent, nil
+}
+
+// readResponses reads the response frames of the protocol version 2 and completes the calls
+// with the same request ID, it runs until the connection is closed.
+func (c *Client) readResponses() {
+	for {
+		requestID, _, length, err := protocol.ReadResponseFrameHeaderV2(c.conn)
+		if err != nil {
+			c.failPending(err)
+			return
+		}
+
+		// the server sends a notice before it closes the connection
+		if requestID == protocol.NoticeRequestID {
+			res, err := readResponse(c.conn, length, nil)
+			if err == nil {
+				err = res.err
+			}
+			if err == nil {
+				err = ErrServerGoingAway
+			}
+			c.failPending(err)
+			return
+		}
+
+		c.pendingMutex.Lock()
+		pending, ok := c.pending[requestID]
+		delete(c.pending, requestID)
+		c.pendingMutex.Unlock()
+
+		if !ok {
+			c.failPending(fmt.Errorf("stgclient: response for an unknown request id=%d", requestID))
+			return
+		}
+
+		if length == 0 {
+			pending.result = result{err: ErrNoResponse}
+			close(pending.done)
+			continue
+		}
+
+		res, err := readResponse(c.conn, length, pending.body)
+		if err != nil {
+			pending.result = result{written: res.written, err: err}
+			close(pending.done)
+			c.failPending(err)
+			return
+		}
+		pending.result = res
+		close(pending.done)
+	}
+}
+
+// failPending completes all the calls waiting for a response with err, the connection can not be used anymore.
+func (c *Client) failPending(err error) {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	c.readErr = err
+	for requestID, pending := range c.pending {
+		pending.result = result{err: err}
+		close(pending.done)
+		delete(c.pending, requestID)
+	}
+	c.conn.Close()
+}
+
+// readResponse reads a response of length bytes with the format
+// [status(1 byte)][error(2 bytes)][payloadLength(4 bytes)][payload].
+//
+// When body is not nil the payload is copied to body while it is received, if body fails the
+// rest of the payload is discarded. The returned error means that the connection can not be
+// used anymore, the error of the request is in the result.
+func readResponse(r io.Reader, length uint32, body io.Writer) (result, error) {
+	if body == nil {
+		raw := make([]byte, length)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return result{}, err
+		}
+
+		resp, err := protocol.DecodeResponseMessage(raw)
+		if err != nil {
+			return result{err: err}, nil
+		}
+		if resp.Status != protocol.StatusOk {
+			return result{err: &ResponseError{Code: resp.Error}}, nil
+		}
+		return result{payload: resp.Payload}, nil
+	}
+
+	if length < protocol.ResponseHeaderLength {
+		return result{}, fmt.Errorf("response too short length=%d", length)
+	}
+
+	raw := make([]byte, protocol.ResponseHeaderLength)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return result{}, err
+	}
+	status := protocol.ResponseStatus(raw[0])
+	payloadLength := binary.BigEndian.Uint32(raw[3:7])
+	if payloadLength != length-protocol.ResponseHeaderLength {
+		return result{}, fmt.Errorf("the response payload length=%d does not match the payloadLength=%d", length-protocol.ResponseHeaderLength, payloadLength)
+	}
+
+	payload := &io.LimitedReader{R: r, N: int64(payloadLength)}
+	if status != protocol.StatusOk {
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return result{}, err
+		}
+		return result{err: &ResponseError{Code: protocol.ErrorCode(binary.BigEndian.Uint16(raw[1:3]))}}, nil
+	}
+
+	written, copyErr := io.Copy(body, payload)
+	if copyErr != nil {
+		// keep the connection in sync when the error comes from body
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return result{written: written}, err
+		}
+	}
+	if payload.N > 0 {
+		return result{written: written}, io.ErrUnexpectedEOF
+	}
+	return result{written: written, err: copyErr}, nil
+}
@@ -2,12 +2,17 @@ package processor
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
-	"strings"
+	"sync"
 
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/handler"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/client"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 )
 
 // MessageProcessor defines the operations of a client message
@@ -16,7 +21,39 @@ type MessageProcessor interface {
 }
 
 // DefaultMessageProcessor is the default implementation of MessageProcessor
-type DefaultMessageProcessor struct{}
+//
+// Handler is the handler used to execute the messages, when it is nil the
+// messages are executed against the default storage.
+//
+// ACL are the rules checked before a message is executed, when it is nil every
+// client can execute every message.
+//
+// The methods are safe to call from multiple goroutines, the messages of a client that
+// sends many requests without waiting for the responses are processed concurrently.
+type DefaultMessageProcessor struct {
+	Handler *handler.Handler
+	ACL     *acl.ACL
+
+	handlerOnce sync.Once
+}
+
+// handler returns the Handler used to execute the messages.
+//
+// The Handler is created once, it keeps the uploads started by the client between messages.
+func (d *DefaultMessageProcessor) handler() *handler.Handler {
+	d.handlerOnce.Do(func() {
+		if d.Handler == nil {
+			d.Handler = handler.NewWithStore(storage.Default())
+		}
+	})
+	return d.Handler
+}
+
+// Close releases the state of a client when its connection is closed,
+// the uploads that were not committed are aborted.
+func (d *DefaultMessageProcessor) Close(client *client.Client) {
+	d.handler().AbortUploads(client.ID)
+}
 
 // Process decodes the message, handles it, and send back the response.
 func (d *DefaultMessageProcessor) Process(message []byte, client *client.Client) ([]byte, int, error) {
@@ -27,15 +64,26 @@ func (d *DefaultMessageProcessor) Process(message []byte, client *client.Client)
 		return nil, 0, err
 	}
 
+	msg.ClientID = client.ID
+
+	if err := d.authorize(msg, client); err != nil {
+		return processErrorResponse(err, msg)
+	}
+
 	// Processing the client message, operations like WRITE & READ
 	slog.Info("Handling the message", "client", client.ID, "messageType", msg.MessageType, "filename", msg.Filename)
-	respBytes, err := handler.HandleMessage(msg)
+	respBytes, err := d.handler().HandleMessage(msg)
 
 	if err != nil {
 		slog.Error("Error while handling the message", "client", client.ID, "error", err)
 		return processErrorResponse(err, msg)
 	}
 
+	if int64(len(respBytes)) > protocol.MaxResponsePayload(client.Version) {
+		err = fmt.Errorf("%w: payload length=%d", errResponseTooLarge, len(respBytes))
+		slog.Error("The response does not fit in a frame", "client", client.ID, "error", err)
+		return processErrorResponse(err, msg)
+	}
 	if respBytes != nil {
 		msg.RawData = respBytes
 		msg.Size = uint32(len(respBytes))
@@ -58,18 +106,155 @@ func (d *DefaultMessageProcessor) Process(message []byte, client *client.Client)
 	return rawResponse, header, nil
 }
 
+var (
+	// errFileTooLarge is returned when a file does not fit in the payload of a READ response.
+	errFileTooLarge = errors.New("the file is too large for a read response, use read range")
+	// errResponseTooLarge is returned when the result of a message does not fit in the payload of a response.
+	errResponseTooLarge = errors.New("the response is too large for a frame")
+)
+
+// Reply is the response of a message.
+//
+// Body is only used by the READ messages, the content of the file is streamed after the
+// Response without loading it in memory. A Reply must always be closed.
+type Reply struct {
+	Response   []byte
+	Body       io.ReadCloser
+	BodyLength uint32
+}
+
+// Length returns the number of bytes of the response including the body.
+func (r Reply) Length() uint32 {
+	return uint32(len(r.Response)) + r.BodyLength
+}
+
+// WriteTo writes the response and the body to w.
+//
+// An error after the response was written means that the reply was interrupted,
+// the connection can not be used anymore.
+func (r Reply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.Response)
+	if err != nil || r.Body == nil {
+		return int64(n), err
+	}
+
+	written, err := io.Copy(w, r.Body)
+	if err != nil {
+		return int64(n) + written, fmt.Errorf("the response was interrupted after %d bytes: %w", written, err)
+	}
+	return int64(n) + written, nil
+}
+
+// Close releases the body of the reply.
+func (r Reply) Close() error {
+	if r.Body == nil {
+		return nil
+	}
+	return r.Body.Close()
+}
+
+// ProcessReply decodes the message, handles it, and returns the reply, the Response is empty
+// when the message could not be processed. The content of a READ message is not loaded in
+// memory, the blocks are read one at a time while the Body is written.
+func (d *DefaultMessageProcessor) ProcessReply(message []byte, client *client.Client) Reply {
+	if len(message) > 0 && protocol.MessageType(message[0]) == protocol.MessageRead {
+		msg, err := protocol.DecodeMessage(message)
+		if err == nil {
+			msg.ClientID = client.ID
+			return d.streamRead(msg, client)
+		}
+	}
+
+	response, _, err := d.Process(message, client)
+	if err != nil {
+		slog.Error("Error processing message", "client", client.ID, "error", err)
+	}
+	return Reply{Response: response}
+}
+
+// ProcessTo decodes the message, handles it, and writes the response frame to w.
+//
+// The frame is [length(4 bytes)][response], a length of 0 without response is sent when the
+// message could not be processed.
+//
+// The returned error means that w could not be written, or that the response was interrupted
+// after the header was sent, in both cases the connection can not be used anymore.
+func (d *DefaultMessageProcessor) ProcessTo(message []byte, client *client.Client, w io.Writer) error {
+	reply := d.ProcessReply(message, client)
+	defer reply.Close()
+
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, reply.Length())); err != nil {
+		return err
+	}
+	_, err := reply.WriteTo(w)
+	return err
+}
+
+// streamRead opens the file of a READ message, the first block is read before the reply is
+// returned so a missing file or a corrupted first block is replied as an error response.
+func (d *DefaultMessageProcessor) streamRead(msg protocol.Message, client *client.Client) Reply {
+	if err := d.authorize(msg, client); err != nil {
+		response, _, _ := processErrorResponse(err, msg)
+		return Reply{Response: response}
+	}
+
+	slog.Info("Handling the message", "client", client.ID, "messageType", msg.MessageType, "filename", msg.Filename)
+	reader, err := d.handler().OpenFile(msg)
+	if err == nil && reader.Size() > protocol.MaxResponsePayload(client.Version) {
+		reader.Close()
+		err = fmt.Errorf("%w: file=%s size=%d", errFileTooLarge, msg.Filename, reader.Size())
+	}
+	if err != nil {
+		slog.Error("Error while handling the message", "client", client.ID, "error", err)
+		response, _, _ := processErrorResponse(err, msg)
+		return Reply{Response: response}
+	}
+
+	size := uint32(reader.Size())
+	slog.Info("Streaming the file content", "client", client.ID, "filename", msg.Filename, "payloadLength", size)
+	return Reply{
+		Response:   protocol.EncodeResponseHeader(protocol.StatusOk, protocol.NoError, size),
+		Body:       reader,
+		BodyLength: size,
+	}
+}
+
+// authorize checks the ACL before the message is handled, a denied message is replied with
+// the PermissionDenied error code.
+func (d *DefaultMessageProcessor) authorize(msg protocol.Message, client *client.Client) error {
+	if d.ACL == nil {
+		return nil
+	}
+	if err := d.ACL.Authorize(client.ID, msg); err != nil {
+		slog.Error("The client is not allowed to execute the message", "client", client.ID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// processErrorResponse creates the error response sent to the client for the known errors.
 func processErrorResponse(err error, msg protocol.Message) ([]byte, int, error) {
-	// validate if the error contains some string pattern
-	if strings.Contains(err.Error(), "file not found") {
-		errCodeBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(errCodeBytes, uint16(protocol.ErrorNotFound))
-		return []byte{
-			byte(protocol.StatusError),
-			errCodeBytes[0], errCodeBytes[1],
-			0x00, 0x00, 0x00, 0x00,
-			protocol.MessageEndChar,
-		}, 0, nil
-	}
-
-	return nil, 0, nil
+	var code protocol.ErrorCode
+
+	switch {
+	case errors.Is(err, acl.ErrPermissionDenied):
+		code = protocol.ErrorPermissionDenied
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrVolumeNotFound),
+		errors.Is(err, handler.ErrUploadNotFound):
+		code = protocol.ErrorNotFound
+	case errors.Is(err, storage.ErrBlockMissing), errors.Is(err, storage.ErrChecksumMismatch):
+		code = protocol.ErrorCorruptedData
+	case errors.Is(err, storage.ErrOutOfRange), errors.Is(err, storage.ErrVolumeExists), errors.Is(err, storage.ErrInvalidVolume),
+		errors.Is(err, storage.ErrInvalidTags), errors.Is(err, storage.ErrFileExists), errors.Is(err, errFileTooLarge),
+		errors.Is(err, errResponseTooLarge), errors.Is(err, storage.ErrTooManyUploads):
+		code = protocol.ErrorBadRequest
+	default:
+		return nil, 0, nil
+	}
+
+	slog.Info("Creating an error response message", "type", msg.MessageType, "errorCode", code)
+	return protocol.EncodeResponseMessage(protocol.Response{
+		Status: protocol.StatusError,
+		Error:  code,
+	})
 }
@@ -1,9 +1,15 @@
 package processor
 
 import (
+	"bytes"
+	"encoding/binary"
+	"strings"
 	"testing"
 
+	"github.com/pablohdzvizcarra/storage-software-cookbook/acl"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/handler"
 	"github.com/pablohdzvizcarra/storage-software-cookbook/pkg/client"
+	"github.com/pablohdzvizcarra/storage-software-cookbook/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -102,6 +108,9 @@ func TestProcessWriteMessage(t *testing.T) {
 		// },
 	}
 
+	// a processor without Handler uses the default store
+	storage.SetDefault(storage.NewStore(storage.NewMemoryBackend()))
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mp := DefaultMessageProcessor{}
@@ -119,3 +128,157 @@ func TestProcessWriteMessage(t *testing.T) {
 	}
 
 }
+
+func TestProcessErrorResponses(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	mp := DefaultMessageProcessor{Handler: handler.New(backend)}
+	dummyClient := &client.Client{ID: "89DF045K"}
+
+	readMessage := []byte{
+		0x01,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+	}
+
+	// READ a file that does not exist
+	response, header, err := mp.Process(readMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, response)
+
+	// READ a file with a corrupted block
+	writeMessage := []byte{
+		0x02,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+		0x00, 0x00, 0x00, 0x05, // size
+		0x48, 0x65, 0x6C, 0x6C, 0x6F, // content
+	}
+	_, _, err = mp.Process(writeMessage, dummyClient)
+	assert.Nil(t, err)
+
+	keys, _ := backend.List()
+	assert.Nil(t, backend.Put(keys[0], []byte("Jello")))
+
+	response, header, err = mp.Process(readMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00}, response)
+
+	// UPDATE a file that does not exist
+	updateMessage := []byte{
+		0x03,                                                             // message type
+		0x0B,                                                             // filename length
+		0x6D, 0x69, 0x73, 0x73, 0x69, 0x6E, 0x67, 0x2E, 0x74, 0x78, 0x74, // filename
+		0x00, 0x00, 0x00, 0x05, // size
+		0x48, 0x65, 0x6C, 0x6C, 0x6F, // content
+	}
+	response, header, err = mp.Process(updateMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, response)
+
+	// COMMIT an upload that does not exist
+	commitMessage := []byte{
+		0x11,                                           // message type
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, // upload id
+	}
+	response, header, err = mp.Process(commitMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, response)
+
+	// BEGIN an upload of a file that already exists
+	beginMessage := []byte{
+		0x0F,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+	}
+	response, header, err = mp.Process(beginMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00}, response)
+
+	// the error code does not depend on the name of the file in the error message
+	filename := "file not found"
+	_, _, err = mp.Process(append(append([]byte{0x02, byte(len(filename))}, filename...), 0x00, 0x00, 0x00, 0x01, 0x41), dummyClient)
+	assert.Nil(t, err)
+	response, header, err = mp.Process(append([]byte{0x0F, byte(len(filename))}, filename...), dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00}, response)
+}
+
+func TestProcessToStreamsRead(t *testing.T) {
+	h := handler.New(storage.NewMemoryBackend())
+	mp := DefaultMessageProcessor{Handler: h}
+	dummyClient := &client.Client{ID: "89DF045K"}
+
+	data := bytes.Repeat([]byte("stream"), storage.DefaultBlockSize/3)
+	assert.Nil(t, h.Store().WriteFile("data.txt", data))
+
+	readMessage := []byte{
+		0x01,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+	}
+
+	// the streamed response has the same bytes as the response built in memory
+	var streamed bytes.Buffer
+	assert.Nil(t, mp.ProcessTo(readMessage, dummyClient, &streamed))
+
+	response, header, err := mp.Process(readMessage, dummyClient)
+	assert.Nil(t, err)
+	expected := binary.BigEndian.AppendUint32(nil, uint32(header))
+	assert.Equal(t, append(expected, response...), streamed.Bytes())
+
+	// a missing file is sent as an error response
+	streamed.Reset()
+	assert.Nil(t, h.Store().WriteFile("gone.txt", []byte("gone")))
+	_, err = h.Store().DeleteFile("gone.txt")
+	assert.Nil(t, err)
+	missingMessage := append([]byte{0x01, 0x08}, []byte("gone.txt")...)
+	assert.Nil(t, mp.ProcessTo(missingMessage, dummyClient, &streamed))
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x07, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, streamed.Bytes())
+
+	// a message that can not be processed is sent with a length of 0
+	streamed.Reset()
+	assert.Nil(t, mp.ProcessTo([]byte{0x63, 0, 0, 0, 0, 0}, dummyClient, &streamed))
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x00}, streamed.Bytes())
+}
+
+func TestProcessDeniedByACL(t *testing.T) {
+	h := handler.New(storage.NewMemoryBackend())
+	rules, err := acl.Parse(strings.NewReader("allow 89DF045K read data.txt\n"))
+	assert.Nil(t, err)
+	mp := DefaultMessageProcessor{Handler: h, ACL: rules}
+	dummyClient := &client.Client{ID: "89DF045K"}
+	assert.Nil(t, h.Store().WriteFile("data.txt", []byte("Hello")))
+
+	// DELETE is not allowed, the file is not removed
+	deleteMessage := []byte{
+		0x04,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+	}
+	response, header, err := mp.Process(deleteMessage, dummyClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, header)
+	assert.Equal(t, []byte{0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}, response)
+	_, err = h.Store().Stat("data.txt")
+	assert.Nil(t, err)
+
+	// READ is allowed for the client and denied for other clients
+	readMessage := []byte{
+		0x01,                                           // message type
+		0x08,                                           // filename length
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+	}
+	var streamed bytes.Buffer
+	assert.Nil(t, mp.ProcessTo(readMessage, dummyClient, &streamed))
+	assert.Equal(t, []byte("Hello"), streamed.Bytes()[4+7:])
+
+	streamed.Reset()
+	assert.Nil(t, mp.ProcessTo(readMessage, &client.Client{ID: "OTHER001"}, &streamed))
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x07, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00}, streamed.Bytes())
+}
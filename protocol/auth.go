@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// ChallengeLength is the length of the random challenge sent by the server to authenticate a client.
+const ChallengeLength = 32
+
+// AuthMACLength is the length of the HMAC-SHA256 sent by the client as the answer of the challenge.
+const AuthMACLength = sha256.Size
+
+// AuthMAC returns the answer of the challenge, it is the HMAC-SHA256 of the challenge and
+// the client id with the secret shared by the client and the server.
+func AuthMAC(secret []byte, challenge []byte, clientID string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	mac.Write([]byte(clientID))
+	return mac.Sum(nil)
+}
+
+// EncodeAuthChallenge builds the response sent instead of the handshake response when the
+// server requires authentication:
+// [status(1 byte) = StatusChallenge][challenge(32 bytes)][endChar]
+func EncodeAuthChallenge(challenge []byte) []byte {
+	out := make([]byte, 0, 1+ChallengeLength+1)
+	out = append(out, byte(StatusChallenge))
+	out = append(out, challenge...)
+	return append(out, MessageEndChar)
+}
+
+// EncodeAuthResponse builds the answer of the client to the challenge:
+// [mac(32 bytes)][endChar]
+func EncodeAuthResponse(mac []byte) []byte {
+	out := make([]byte, 0, AuthMACLength+1)
+	out = append(out, mac...)
+	return append(out, MessageEndChar)
+}
+
+// ReadAuthResponse reads the answer built by EncodeAuthResponse and returns the mac.
+func ReadAuthResponse(r io.Reader) ([]byte, error) {
+	raw := make([]byte, AuthMACLength+1)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	if raw[AuthMACLength] != MessageEndChar {
+		return nil, fmt.Errorf("auth response does not contains valid end char, endChar=%d", raw[AuthMACLength])
+	}
+	return raw[:AuthMACLength], nil
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Capabilities is a bitmap of the optional features of the protocol, it is sent in the
+// reserved bytes of the handshake as a big-endian uint64.
+//
+// The client sends the capabilities it wants to use and the server replies with the
+// intersection of them and the capabilities it supports. A client that sends zero gets
+// the handshake response of the first version, so old clients keep working.
+type Capabilities uint64
+
+const (
+	// CapabilityCompression allows compressed payloads.
+	CapabilityCompression Capabilities = 1 << iota
+	// CapabilityChecksums allows checksums of the payloads in the messages.
+	CapabilityChecksums
+	// CapabilityStreaming allows the chunked upload messages and the streamed READ responses.
+	CapabilityStreaming
+	// CapabilityPipelining allows many requests without waiting for the responses, it needs the protocol version 2.
+	CapabilityPipelining
+	// CapabilityAuth allows the authentication of the client after the handshake.
+	CapabilityAuth
+	// CapabilityMaxFrameSize adds the maximum frame size of the server to the handshake response.
+	CapabilityMaxFrameSize
+)
+
+// CapabilitiesLength is the number of bytes of the capabilities in the handshake.
+const CapabilitiesLength = 8
+
+// ServerCapabilities are the capabilities implemented by the server, CapabilityAuth is added
+// when the server is configured with the keys of the clients.
+const ServerCapabilities = CapabilityStreaming | CapabilityPipelining | CapabilityMaxFrameSize
+
+var capabilityNames = []struct {
+	capability Capabilities
+	name       string
+}{
+	{CapabilityCompression, "compression"},
+	{CapabilityChecksums, "checksums"},
+	{CapabilityStreaming, "streaming"},
+	{CapabilityPipelining, "pipelining"},
+	{CapabilityAuth, "auth"},
+	{CapabilityMaxFrameSize, "max-frame-size"},
+}
+
+// Has reports if all the capabilities of other are in c.
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// Negotiate returns the capabilities that are in c and in supported, pipelining is removed
+// when the connection does not use the protocol version 2.
+func (c Capabilities) Negotiate(supported Capabilities, version byte) Capabilities {
+	negotiated := c & supported
+	if version < ProtocolVersion2 {
+		negotiated &^= CapabilityPipelining
+	}
+	return negotiated
+}
+
+// String returns the names of the capabilities separated by "|", the unknown bits are omitted.
+func (c Capabilities) String() string {
+	names := make([]string, 0, len(capabilityNames))
+	for _, n := range capabilityNames {
+		if c.Has(n.capability) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// encodeCapabilities returns the 8 bytes of the capabilities sent in the handshake.
+func encodeCapabilities(c Capabilities) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, CapabilitiesLength), uint64(c))
+}
+
+// decodeCapabilities returns the capabilities of the 8 bytes sent in the handshake.
+func decodeCapabilities(b []byte) Capabilities {
+	return Capabilities(binary.BigEndian.Uint64(b))
+}
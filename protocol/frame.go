@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameHeaderLengthV2 is the length of the request ID and the opcode sent at the start of
+// every response frame of the protocol version 2.
+const FrameHeaderLengthV2 = 4 + 1
+
+// ErrFrameTooLarge is returned when the length of a frame is bigger than the maximum frame size.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// NoticeRequestID is the request ID of the response frames sent by the server without a
+// request, the clients must not use it in their requests.
+const NoticeRequestID uint32 = 0
+
+// Frame is a request frame of the protocol version 2.
+//
+// The frame has the format [length(4 bytes)][requestID(4 bytes)][message], the first byte of
+// the message is the opcode, it is the same messageType of the protocol version 1.
+type Frame struct {
+	RequestID uint32
+	Opcode    MessageType
+	Message   []byte
+}
+
+// ReadFrameV2 reads a request frame of the protocol version 2.
+//
+// When the length of the frame is bigger than maxLength the message is discarded without
+// allocating it and the error wraps ErrFrameTooLarge, the frame has the request ID so the
+// server can reply and the next frame can be read. A maxLength of 0 does not limit the frames.
+func ReadFrameV2(r io.Reader, maxLength uint32) (Frame, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 4+1 {
+		return Frame{}, fmt.Errorf("the frame length=%d does not contain the request id and the opcode", length)
+	}
+	if maxLength > 0 && length > maxLength {
+		if _, err := io.CopyN(io.Discard, r, int64(length-4)); err != nil {
+			return Frame{}, err
+		}
+		frame := Frame{RequestID: binary.BigEndian.Uint32(header[4:8])}
+		return frame, fmt.Errorf("%w: the frame length=%d is bigger than %d", ErrFrameTooLarge, length, maxLength)
+	}
+
+	message := make([]byte, length-4)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{
+		RequestID: binary.BigEndian.Uint32(header[4:8]),
+		Opcode:    MessageType(message[0]),
+		Message:   message,
+	}, nil
+}
+
+// EncodeFrameV2 builds a request frame of the protocol version 2, message is a request built by EncodeMessage.
+func EncodeFrameV2(requestID uint32, message []byte) []byte {
+	frame := make([]byte, 0, 8+len(message))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(message)))
+	frame = binary.BigEndian.AppendUint32(frame, requestID)
+	return append(frame, message...)
+}
+
+// MaxPayloadLengthV2 is the biggest payload of a response in the protocol version 2, the
+// frame length includes the request ID and the opcode too.
+const MaxPayloadLengthV2 = MaxPayloadLength - FrameHeaderLengthV2
+
+// MaxResponsePayload returns the biggest payload of a response sent with the protocol version.
+func MaxResponsePayload(version byte) int64 {
+	if version == ProtocolVersion2 {
+		return MaxPayloadLengthV2
+	}
+	return MaxPayloadLength
+}
+
+// EncodeResponseFrameHeaderV2 builds the bytes sent before a response of responseLength bytes
+// in the protocol version 2:
+// [length(4 bytes)][requestID(4 bytes)][opcode(1 byte)]
+//
+// The opcode is the opcode of the request, a response of length 0 means that the server
+// could not process the request. The payload of the response can not be bigger than
+// MaxPayloadLengthV2.
+func EncodeResponseFrameHeaderV2(requestID uint32, opcode MessageType, responseLength uint32) []byte {
+	header := make([]byte, 0, 4+FrameHeaderLengthV2)
+	header = binary.BigEndian.AppendUint32(header, FrameHeaderLengthV2+responseLength)
+	header = binary.BigEndian.AppendUint32(header, requestID)
+	return append(header, byte(opcode))
+}
+
+// ReadResponseFrameHeaderV2 reads the header written by EncodeResponseFrameHeaderV2 and
+// returns the length of the response that follows it.
+func ReadResponseFrameHeaderV2(r io.Reader) (requestID uint32, opcode MessageType, responseLength uint32, err error) {
+	header := make([]byte, 4+FrameHeaderLengthV2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < FrameHeaderLengthV2 {
+		return 0, 0, 0, fmt.Errorf("the response frame length=%d does not contain the request id and the opcode", length)
+	}
+	return binary.BigEndian.Uint32(header[4:8]), MessageType(header[8]), length - FrameHeaderLengthV2, nil
+}
+
+// EncodeGoAway builds the notice sent by the server before it closes a connection because it
+// is shutting down, it is an error response with ErrorGoingAway in the frame of the version.
+//
+// In the version 2 the frame has the NoticeRequestID and the opcode 0. In the version 1 it is
+// read as the response of the next request of the client.
+func EncodeGoAway(version byte) []byte {
+	return EncodeErrorFrame(version, NoticeRequestID, ErrorGoingAway)
+}
+
+// EncodeErrorFrame builds a response frame of the version with an error response without
+// payload, requestID is used only in the version 2 and the opcode of the frame is 0.
+func EncodeErrorFrame(version byte, requestID uint32, code ErrorCode) []byte {
+	response := EncodeResponseHeader(StatusError, code, 0)
+	if version == ProtocolVersion2 {
+		header := EncodeResponseFrameHeaderV2(requestID, 0, uint32(len(response)))
+		return append(header, response...)
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(response)), uint32(len(response)))
+	return append(frame, response...)
+}
@@ -9,17 +9,63 @@ const (
 	MessageWrite  MessageType = 2
 	MessageUpdate MessageType = 3
 	MessageDelete MessageType = 4
+	// MessageReadRange reads length bytes of a file starting at offset.
+	MessageReadRange MessageType = 5
+	// MessageWriteAt writes the content of the message in a file starting at offset.
+	MessageWriteAt MessageType = 6
+	// MessageVolumeCreate creates a volume of VolumeSize bytes with sectors of SectorSize bytes.
+	MessageVolumeCreate MessageType = 7
+	// MessageVolumeRead reads Length sectors of a volume starting at the logical block address Offset.
+	MessageVolumeRead MessageType = 8
+	// MessageVolumeWrite writes the content of the message in a volume starting at the logical block address Offset.
+	MessageVolumeWrite MessageType = 9
+	// MessageVolumeDelete deletes a volume.
+	MessageVolumeDelete MessageType = 10
+	// MessageList lists at most Length files whose name starts with Prefix and comes after Cursor.
+	MessageList MessageType = 11
+	// MessageStat returns the information of a file without reading its content.
+	MessageStat MessageType = 12
+	// MessageSetTags adds the Tags to a file, a tag with an empty value is removed.
+	MessageSetTags MessageType = 13
+	// MessageGetTags returns the tags of a file.
+	MessageGetTags MessageType = 14
+	// MessageUploadBegin starts the upload of a new file in chunks, the response has the UploadID.
+	MessageUploadBegin MessageType = 15
+	// MessageUploadChunk appends the content of the message to the upload UploadID.
+	MessageUploadChunk MessageType = 16
+	// MessageUploadCommit saves the file of the upload UploadID, the file is visible after the commit.
+	MessageUploadCommit MessageType = 17
+	// MessageUploadAbort discards the upload UploadID and the chunks already received.
+	MessageUploadAbort MessageType = 18
 )
 
 // Message the server receives an array of bytes from the client, which is serialize into a Message struct.
 // The array of bytes have the following format:
 // [messageType(1 byte)][filenameLength(1 byte)][filename][size(4 bytes)][content]
+//
+// Offset and Length are only used by the messages that access a byte range of the file,
+// for the volume messages Filename is the volume name, Offset the logical block address
+// and Length the number of sectors. Prefix and Cursor are only used by the list message.
+// Tags are used by the write, the set tags and the upload begin messages. UploadID is
+// only used by the upload chunk, commit and abort messages.
+//
+// ClientID is not part of the binary message, it is the ID of the client that sent the
+// message and it is filled by the server after the message is decoded.
 type Message struct {
 	MessageType    MessageType
 	FilenameLength int
 	Filename       string
 	Size           uint32
 	RawData        []byte
+	Offset         uint64
+	Length         uint32
+	VolumeSize     uint64
+	SectorSize     uint32
+	Prefix         string
+	Cursor         string
+	Tags           map[string]string
+	UploadID       uint64
+	ClientID       string
 }
 
 type ResponseStatus byte
@@ -27,14 +73,27 @@ type ResponseStatus byte
 const (
 	StatusOk    ResponseStatus = 0x00
 	StatusError ResponseStatus = 0x01
+	// StatusChallenge is sent only in the handshake, the server requires the client to answer
+	// a challenge before the handshake response.
+	StatusChallenge ResponseStatus = 0x02
 )
 
 type ErrorCode uint16
 
 const (
-	NoError         ErrorCode = 0x0000
-	ErrorNotFound   ErrorCode = 0x0001
-	ErrorBadRequest ErrorCode = 0x0002
+	NoError       ErrorCode = 0x0000
+	ErrorNotFound ErrorCode = 0x0001
+	// ErrorPermissionDenied is returned when the client is not authenticated or it can not do the operation.
+	ErrorPermissionDenied ErrorCode = 0x0002
+	ErrorBadRequest       ErrorCode = 0x0003
+	// ErrorCorruptedData is returned when a block of the file is missing or its checksum does not match.
+	ErrorCorruptedData ErrorCode = 0x0004
+	// ErrorGoingAway is sent by the server when it is shutting down, the connection is closed after it.
+	ErrorGoingAway ErrorCode = 0x0005
+	// ErrorTooManyConnections is sent in the handshake response when the server or the client id
+	// has the maximum number of connections, the connection is closed after it and the client can
+	// connect again later.
+	ErrorTooManyConnections ErrorCode = 0x0006
 )
 
 type Response struct {
@@ -46,14 +105,32 @@ type Response struct {
 
 const (
 	ProtocolVersion byte = 1
+	// ProtocolVersion2 adds a request ID to every frame, the client can send many requests
+	// without waiting for the responses and the server replies in any order.
+	ProtocolVersion2 byte = 2
 )
 
+// SupportedVersion reports if the server accepts the protocol version in the handshake.
+func SupportedVersion(version byte) bool {
+	return version == ProtocolVersion || version == ProtocolVersion2
+}
+
+// Ordered reports if the messages of the type are executed in the order they are received
+// when a client sends many requests without waiting for the responses.
+//
+// The chunks of an upload need to be appended in order, the other messages can be executed concurrently.
+func (t MessageType) Ordered() bool {
+	return t == MessageUploadChunk || t == MessageUploadCommit || t == MessageUploadAbort
+}
+
 var HandshakeMagic = []byte{'S', 'T', 'G'}
 
 type HandshakeRequest struct {
-	Magic          string
-	Version        uint8
+	Magic   string
+	Version uint8
+	// Reserved are the raw 8 bytes after the version, they carry the Capabilities
 	Reserved       []byte
+	Capabilities   Capabilities
 	ClientIDLength uint8
 	ClientID       string
 }
@@ -62,4 +139,13 @@ type HandshakeResponse struct {
 	Status     ResponseStatus
 	Error      ErrorCode
 	AssignedID string
+	// Challenge is the random challenge of a response with StatusChallenge
+	Challenge []byte
+	// Negotiated reports if the response carries the capabilities, the server sets it when
+	// the client requested capabilities, Capabilities can be zero when none is supported
+	Negotiated   bool
+	Capabilities Capabilities
+	// MaxFrameSize is the maximum length of a request frame accepted by the server, 0 is no
+	// limit. It is sent when CapabilityMaxFrameSize is negotiated.
+	MaxFrameSize uint32
 }
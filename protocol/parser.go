@@ -3,7 +3,9 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 )
 
 const MIN_FILENAME_LENGTH = 8
@@ -27,6 +29,34 @@ func DecodeMessage(rawData []byte) (Message, error) {
 		return decodeUpdateMessage(rawData)
 	case 4:
 		return decodeDeleteMessage(rawData)
+	case 5:
+		return decodeReadRangeMessage(rawData)
+	case 6:
+		return decodeWriteAtMessage(rawData)
+	case 7:
+		return decodeVolumeCreateMessage(rawData)
+	case 8:
+		return decodeVolumeReadMessage(rawData)
+	case 9:
+		return decodeVolumeWriteMessage(rawData)
+	case 10:
+		return decodeVolumeDeleteMessage(rawData)
+	case 11:
+		return decodeListMessage(rawData)
+	case 12:
+		return decodeStatMessage(rawData)
+	case 13:
+		return decodeSetTagsMessage(rawData)
+	case 14:
+		return decodeGetTagsMessage(rawData)
+	case 15:
+		return decodeUploadBeginMessage(rawData)
+	case 16:
+		return decodeUploadChunkMessage(rawData)
+	case 17:
+		return decodeUploadIDMessage(rawData, MessageUploadCommit)
+	case 18:
+		return decodeUploadIDMessage(rawData, MessageUploadAbort)
 	default:
 		return Message{}, fmt.Errorf("the message type is not supported")
 	}
@@ -217,6 +247,398 @@ func decodeReadMessage(rawData []byte) (Message, error) {
 	}, nil
 }
 
+// decodeReadRangeMessage decodes a "Read Range" message from the provided raw byte slice.
+//
+// The message has the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename][offset(8 bytes)][length(4 bytes)]
+//
+// Errors:
+//   - Returns an error if the filename length is less than 8 bytes.
+//   - Returns an error if the rawData does not contain the filename, offset and length.
+//   - Returns an error if the length is zero.
+func decodeReadRangeMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Read Range message from the client request", "bytesLength", len(rawData))
+	var offset = 1
+
+	// Read the filename length from the rawData, byte=1
+	filenameLength := int(rawData[offset])
+	offset += 1
+
+	if filenameLength < MIN_FILENAME_LENGTH {
+		return Message{
+			MessageType: MessageReadRange,
+		}, fmt.Errorf("invalid filenameLength=%d, filename length needs to be > 8 bytes", filenameLength)
+	}
+
+	// Ensure there enough bytes for the filename, offset and length
+	if offset+filenameLength+8+4 != len(rawData) {
+		return Message{
+			MessageType:    MessageReadRange,
+			FilenameLength: filenameLength,
+		}, fmt.Errorf("the rawData length=%d does not match the filename, offset and length fields", len(rawData))
+	}
+
+	filename := string(rawData[offset : offset+filenameLength])
+	offset += filenameLength
+
+	rangeOffset := binary.BigEndian.Uint64(rawData[offset : offset+8])
+	offset += 8
+
+	rangeLength := binary.BigEndian.Uint32(rawData[offset : offset+4])
+
+	if rangeLength < 1 {
+		return Message{
+			MessageType:    MessageReadRange,
+			FilenameLength: filenameLength,
+			Filename:       filename,
+			Offset:         rangeOffset,
+		}, fmt.Errorf("range length must be > 0")
+	}
+
+	return Message{
+		MessageType:    MessageReadRange,
+		FilenameLength: filenameLength,
+		Filename:       filename,
+		Offset:         rangeOffset,
+		Length:         rangeLength,
+	}, nil
+}
+
+// decodeWriteAtMessage decodes a "Write At" message from the provided raw byte slice.
+//
+// The message has the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename][offset(8 bytes)][size(4 bytes)][content]
+//
+// Errors:
+//   - Returns an error if the filename length is less than 8 bytes.
+//   - Returns an error if the rawData does not contain the filename, offset and size.
+//   - Returns an error if the size is zero or does not match the content length.
+func decodeWriteAtMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Write At message from the client request", "bytesLength", len(rawData))
+	var offset = 1
+
+	// Read the filename length from the rawData, byte=1
+	filenameLength := int(rawData[offset])
+	offset += 1
+
+	if filenameLength < MIN_FILENAME_LENGTH {
+		return Message{
+			MessageType: MessageWriteAt,
+		}, fmt.Errorf("invalid filenameLength=%d, filename length needs to be > 8 bytes", filenameLength)
+	}
+
+	// Ensure there enough bytes for the filename, offset and size
+	if offset+filenameLength+8+4 > len(rawData) {
+		return Message{
+			MessageType:    MessageWriteAt,
+			FilenameLength: filenameLength,
+		}, fmt.Errorf("the rawData length=%d does not contain the filename, offset and size fields", len(rawData))
+	}
+
+	filename := string(rawData[offset : offset+filenameLength])
+	offset += filenameLength
+
+	writeOffset := binary.BigEndian.Uint64(rawData[offset : offset+8])
+	offset += 8
+
+	fileSize := binary.BigEndian.Uint32(rawData[offset : offset+4])
+	offset += 4
+
+	if fileSize < 1 {
+		return Message{
+			MessageType:    MessageWriteAt,
+			FilenameLength: filenameLength,
+			Filename:       filename,
+			Offset:         writeOffset,
+		}, fmt.Errorf("file size must be > 0")
+	}
+
+	// With this validation we are avoiding byte overflow vulnerability
+	messageContent := rawData[offset:]
+	if uint32(len(messageContent)) != fileSize {
+		return Message{
+			MessageType:    MessageWriteAt,
+			FilenameLength: filenameLength,
+			Filename:       filename,
+			Offset:         writeOffset,
+			Size:           fileSize,
+		}, fmt.Errorf("the message content not match with the length")
+	}
+
+	return Message{
+		MessageType:    MessageWriteAt,
+		FilenameLength: filenameLength,
+		Filename:       filename,
+		Offset:         writeOffset,
+		Size:           fileSize,
+		RawData:        messageContent,
+	}, nil
+}
+
+// decodeNameFields reads the [nameLength(1 byte)][name] fields of a message and
+// validates that rawData has fieldsLength bytes after the name.
+//
+// It returns the name and the offset of the first byte after the name.
+func decodeNameFields(rawData []byte, messageType MessageType, fieldsLength int) (Message, int, error) {
+	var offset = 1
+
+	nameLength := int(rawData[offset])
+	offset += 1
+
+	if nameLength < MIN_FILENAME_LENGTH {
+		return Message{
+			MessageType: messageType,
+		}, 0, fmt.Errorf("invalid nameLength=%d, name length needs to be > 8 bytes", nameLength)
+	}
+
+	if offset+nameLength+fieldsLength > len(rawData) {
+		return Message{
+			MessageType:    messageType,
+			FilenameLength: nameLength,
+		}, 0, fmt.Errorf("the rawData length=%d does not contain the message fields", len(rawData))
+	}
+
+	name := string(rawData[offset : offset+nameLength])
+	offset += nameLength
+
+	return Message{
+		MessageType:    messageType,
+		FilenameLength: nameLength,
+		Filename:       name,
+	}, offset, nil
+}
+
+// decodeVolumeCreateMessage decodes a "Volume Create" message with the format:
+// [messageType(1 byte)][nameLength(1 byte)][name][volumeSize(8 bytes)][sectorSize(4 bytes)]
+func decodeVolumeCreateMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Volume Create message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageVolumeCreate, 8+4)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.VolumeSize = binary.BigEndian.Uint64(rawData[offset : offset+8])
+	msg.SectorSize = binary.BigEndian.Uint32(rawData[offset+8 : offset+12])
+
+	if msg.VolumeSize < 1 || msg.SectorSize < 1 {
+		return msg, fmt.Errorf("volume size and sector size must be > 0")
+	}
+	return msg, nil
+}
+
+// decodeVolumeReadMessage decodes a "Volume Read" message with the format:
+// [messageType(1 byte)][nameLength(1 byte)][name][lba(8 bytes)][sectors(4 bytes)]
+func decodeVolumeReadMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Volume Read message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageVolumeRead, 8+4)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Offset = binary.BigEndian.Uint64(rawData[offset : offset+8])
+	msg.Length = binary.BigEndian.Uint32(rawData[offset+8 : offset+12])
+
+	if msg.Length < 1 {
+		return msg, fmt.Errorf("the number of sectors must be > 0")
+	}
+	return msg, nil
+}
+
+// decodeVolumeWriteMessage decodes a "Volume Write" message with the format:
+// [messageType(1 byte)][nameLength(1 byte)][name][lba(8 bytes)][size(4 bytes)][content]
+func decodeVolumeWriteMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Volume Write message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageVolumeWrite, 8+4)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Offset = binary.BigEndian.Uint64(rawData[offset : offset+8])
+	msg.Size = binary.BigEndian.Uint32(rawData[offset+8 : offset+12])
+	offset += 12
+
+	if msg.Size < 1 {
+		return msg, fmt.Errorf("file size must be > 0")
+	}
+
+	// With this validation we are avoiding byte overflow vulnerability
+	messageContent := rawData[offset:]
+	if uint32(len(messageContent)) != msg.Size {
+		return msg, fmt.Errorf("the message content not match with the length")
+	}
+
+	msg.RawData = messageContent
+	return msg, nil
+}
+
+// decodeVolumeDeleteMessage decodes a "Volume Delete" message with the format:
+// [messageType(1 byte)][nameLength(1 byte)][name]
+func decodeVolumeDeleteMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Volume Delete message from the client request", "bytesLength", len(rawData))
+	msg, _, err := decodeNameFields(rawData, MessageVolumeDelete, 0)
+	return msg, err
+}
+
+// decodeListMessage decodes a "List" message with the format:
+// [messageType(1 byte)][limit(4 bytes)][prefixLength(1 byte)][prefix][cursorLength(1 byte)][cursor]
+//
+// The prefix and the cursor can be empty, a limit of 0 uses the server default.
+func decodeListMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a List message from the client request", "bytesLength", len(rawData))
+	var offset = 1
+
+	limit := binary.BigEndian.Uint32(rawData[offset : offset+4])
+	offset += 4
+
+	prefixLength := int(rawData[offset])
+	offset += 1
+	if offset+prefixLength+1 > len(rawData) {
+		return Message{
+			MessageType: MessageList,
+		}, fmt.Errorf("the rawData length=%d does not contain the prefix of length=%d", len(rawData), prefixLength)
+	}
+	prefix := string(rawData[offset : offset+prefixLength])
+	offset += prefixLength
+
+	cursorLength := int(rawData[offset])
+	offset += 1
+	if offset+cursorLength != len(rawData) {
+		return Message{
+			MessageType: MessageList,
+			Prefix:      prefix,
+		}, fmt.Errorf("the rawData length=%d does not match the cursor of length=%d", len(rawData), cursorLength)
+	}
+
+	return Message{
+		MessageType: MessageList,
+		Length:      limit,
+		Prefix:      prefix,
+		Cursor:      string(rawData[offset:]),
+	}, nil
+}
+
+// decodeStatMessage decodes a "Stat" message with the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename]
+func decodeStatMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Stat message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageStat, 0)
+	if err != nil {
+		return msg, err
+	}
+	if offset != len(rawData) {
+		return msg, fmt.Errorf("the rawData length=%d does not match the filename length=%d", len(rawData), msg.FilenameLength)
+	}
+	return msg, nil
+}
+
+// decodeSetTagsMessage decodes a "Set Tags" message with the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename][tagsCount(2 bytes)][tag * tagsCount]
+func decodeSetTagsMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Set Tags message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageSetTags, 2)
+	if err != nil {
+		return msg, err
+	}
+
+	tags, offset, err := readTags(rawData, offset)
+	if err != nil {
+		return msg, err
+	}
+	if offset != len(rawData) {
+		return msg, fmt.Errorf("the rawData length=%d has unexpected bytes after the tags", len(rawData))
+	}
+	if len(tags) == 0 {
+		return msg, fmt.Errorf("the set tags message needs at least one tag")
+	}
+
+	msg.Tags = tags
+	return msg, nil
+}
+
+// decodeGetTagsMessage decodes a "Get Tags" message with the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename]
+func decodeGetTagsMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding a Get Tags message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageGetTags, 0)
+	if err != nil {
+		return msg, err
+	}
+	if offset != len(rawData) {
+		return msg, fmt.Errorf("the rawData length=%d does not match the filename length=%d", len(rawData), msg.FilenameLength)
+	}
+	return msg, nil
+}
+
+// decodeUploadBeginMessage decodes an "Upload Begin" message with the format:
+// [messageType(1 byte)][filenameLength(1 byte)][filename][tagsCount(2 bytes)][tag * tagsCount]
+//
+// The tags are optional, a message that ends after the filename has no tags.
+func decodeUploadBeginMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding an Upload Begin message from the client request", "bytesLength", len(rawData))
+	msg, offset, err := decodeNameFields(rawData, MessageUploadBegin, 0)
+	if err != nil {
+		return msg, err
+	}
+
+	if offset < len(rawData) {
+		tags, offset, err := readTags(rawData, offset)
+		if err != nil {
+			return msg, err
+		}
+		if offset != len(rawData) {
+			return msg, fmt.Errorf("the rawData length=%d has unexpected bytes after the tags", len(rawData))
+		}
+		msg.Tags = tags
+	}
+	return msg, nil
+}
+
+// decodeUploadChunkMessage decodes an "Upload Chunk" message with the format:
+// [messageType(1 byte)][uploadID(8 bytes)][size(4 bytes)][content]
+func decodeUploadChunkMessage(rawData []byte) (Message, error) {
+	slog.Info("Decoding an Upload Chunk message from the client request", "bytesLength", len(rawData))
+	if len(rawData) < 1+8+4 {
+		return Message{
+			MessageType: MessageUploadChunk,
+		}, fmt.Errorf("the rawData length=%d does not contain the upload id and size fields", len(rawData))
+	}
+
+	msg := Message{
+		MessageType: MessageUploadChunk,
+		UploadID:    binary.BigEndian.Uint64(rawData[1:9]),
+		Size:        binary.BigEndian.Uint32(rawData[9:13]),
+	}
+
+	if msg.Size < 1 {
+		return msg, fmt.Errorf("chunk size must be > 0")
+	}
+
+	// With this validation we are avoiding byte overflow vulnerability
+	messageContent := rawData[13:]
+	if uint32(len(messageContent)) != msg.Size {
+		return msg, fmt.Errorf("the message content not match with the length")
+	}
+
+	msg.RawData = messageContent
+	return msg, nil
+}
+
+// decodeUploadIDMessage decodes the "Upload Commit" and "Upload Abort" messages with the format:
+// [messageType(1 byte)][uploadID(8 bytes)]
+func decodeUploadIDMessage(rawData []byte, messageType MessageType) (Message, error) {
+	slog.Info("Decoding an Upload message from the client request", "type", messageType, "bytesLength", len(rawData))
+	if len(rawData) != 1+8 {
+		return Message{
+			MessageType: messageType,
+		}, fmt.Errorf("the rawData length=%d does not match the upload id field", len(rawData))
+	}
+
+	return Message{
+		MessageType: messageType,
+		UploadID:    binary.BigEndian.Uint64(rawData[1:9]),
+	}, nil
+}
+
 func decodeWriteMessage(rawData []byte) (Message, error) {
 	// here the offset start in 1 because we read 1 byte in DecodeMessage function
 	var offset = 1
@@ -255,11 +677,8 @@ func decodeWriteMessage(rawData []byte) (Message, error) {
 		}, fmt.Errorf("file size must be > 0")
 	}
 
-	// Read the message content from the raw data
-	messageContent := rawData[offset:]
-
 	// With this validation we are avoiding byte overflow vulnerability
-	if uint32(len(messageContent)) != fileSize {
+	if uint64(offset)+uint64(fileSize) > uint64(len(rawData)) {
 		return Message{
 			MessageType:    MessageWrite,
 			FilenameLength: filenameLength,
@@ -268,12 +687,32 @@ func decodeWriteMessage(rawData []byte) (Message, error) {
 		}, fmt.Errorf("the message content not match with the length")
 	}
 
+	// Read the message content from the raw data
+	messageContent := rawData[offset : offset+int(fileSize)]
+	offset += int(fileSize)
+
+	// the tags are optional, they are only present when there are bytes after the content
+	var tags map[string]string
+	if offset < len(rawData) {
+		var err error
+		tags, offset, err = readTags(rawData, offset)
+		if err != nil || offset != len(rawData) {
+			return Message{
+				MessageType:    MessageWrite,
+				FilenameLength: filenameLength,
+				Filename:       filename,
+				Size:           fileSize,
+			}, fmt.Errorf("the message content not match with the length")
+		}
+	}
+
 	return Message{
 		MessageType:    MessageWrite,
 		FilenameLength: int(filenameLength),
 		Filename:       filename,
 		Size:           fileSize,
 		RawData:        messageContent,
+		Tags:           tags,
 	}, nil
 }
 
@@ -284,7 +723,9 @@ func decodeWriteMessage(rawData []byte) (Message, error) {
 //   - msg: the message received from the storage component.
 //   - error: error value indicating if there was any issue during response creation.
 func CreateClientResponse(msg Message) (Response, error) {
-	if msg.MessageType == MessageRead {
+	if msg.MessageType == MessageRead || msg.MessageType == MessageReadRange || msg.MessageType == MessageVolumeRead ||
+		msg.MessageType == MessageList || msg.MessageType == MessageStat ||
+		msg.MessageType == MessageSetTags || msg.MessageType == MessageGetTags || msg.MessageType == MessageUploadBegin {
 		return Response{
 			Status:        StatusOk,
 			Error:         NoError,
@@ -293,7 +734,8 @@ func CreateClientResponse(msg Message) (Response, error) {
 		}, nil
 	}
 
-	if msg.MessageType == MessageWrite {
+	if msg.MessageType == MessageWrite || msg.MessageType == MessageWriteAt || msg.MessageType == MessageUploadChunk ||
+		msg.MessageType == MessageUploadCommit || msg.MessageType == MessageUploadAbort {
 		return Response{
 			Status:        StatusOk,
 			Error:         NoError,
@@ -321,29 +763,38 @@ func CreateClientResponse(msg Message) (Response, error) {
 //   - error: if an error happens when creating the binary message response.
 func EncodeResponseMessage(msg Response) ([]byte, int, error) {
 	slog.Info("Encoding a response message into bytes", "status", msg.Status, "payloadLength", msg.PayloadLength)
-	// Read the status (byte 0)
-	status := byte(msg.Status)
-
-	// Read the error code (bytes 1-2)
-	errorCode := uint16(msg.Error)
-
-	// Read the payload length (bytes 3-6)
-	payloadLength := uint32(msg.PayloadLength)
 
 	// build the response message
-	response := make([]byte, 7+payloadLength)
-	response[0] = status
-	binary.BigEndian.PutUint16(response[1:3], errorCode)
-	binary.BigEndian.PutUint32(response[3:7], payloadLength)
+	response := make([]byte, ResponseHeaderLength+msg.PayloadLength)
+	copy(response, EncodeResponseHeader(msg.Status, msg.Error, msg.PayloadLength))
 
 	// Read payload bytes (7-n) if exists
-	if payloadLength > 0 {
-		copy(response[7:], msg.Payload)
+	if msg.PayloadLength > 0 {
+		copy(response[ResponseHeaderLength:], msg.Payload)
 	}
 
 	return response, len(response), nil
 }
 
+// ResponseHeaderLength is the length of the status, error and payload length fields of a response.
+const ResponseHeaderLength = 7
+
+// MaxPayloadLength is the biggest payload of a response, the frame length of 4 bytes
+// includes the response header.
+const MaxPayloadLength = math.MaxUint32 - ResponseHeaderLength
+
+// EncodeResponseHeader builds the fields of a response that are sent before the payload:
+// [status(1 byte)][error(2 bytes)][payloadLength(4 bytes)]
+//
+// It allows to stream a payload after the header without copying it into the response.
+func EncodeResponseHeader(status ResponseStatus, code ErrorCode, payloadLength uint32) []byte {
+	header := make([]byte, ResponseHeaderLength)
+	header[0] = byte(status)
+	binary.BigEndian.PutUint16(header[1:3], uint16(code))
+	binary.BigEndian.PutUint32(header[3:7], payloadLength)
+	return header
+}
+
 func DecodeHandshakeRequest(b []byte) (HandshakeRequest, error) {
 	slog.Info("Decoding handshake request from client", "length", len(b))
 	minLen := MAGIC_LEN + PROTOCOL_VERSION_LEN + 8 + 1
@@ -394,6 +845,7 @@ func DecodeHandshakeRequest(b []byte) (HandshakeRequest, error) {
 		Magic:          "STG",
 		Version:        protocolVer,
 		Reserved:       reservedData,
+		Capabilities:   decodeCapabilities(reservedData),
 		ClientIDLength: uint8(clientIdLen),
 		ClientID:       clientID,
 	}, nil
@@ -410,12 +862,243 @@ func EncodeHandshakeResponse(h HandshakeResponse) []byte {
 	}
 
 	// format of success handshake
-	// status(1) + idLen(1) + id + endChar
+	// status(1) + idLen(1) + id + [capabilities(8)] + [maxFrameSize(4)] + endChar
 	id := []byte(h.AssignedID)
-	out := make([]byte, 0, 1+1+len(id)+1)
+	out := make([]byte, 0, 1+1+len(id)+CapabilitiesLength+4+1)
 	out = append(out, byte(StatusOk))
 	out = append(out, byte(len(id)))
 	out = append(out, id...)
+	if h.Negotiated {
+		out = append(out, encodeCapabilities(h.Capabilities)...)
+		if h.Capabilities.Has(CapabilityMaxFrameSize) {
+			out = binary.BigEndian.AppendUint32(out, h.MaxFrameSize)
+		}
+	}
 	out = append(out, MessageEndChar)
 	return out
 }
+
+// EncodeMessage builds the binary request of a Message, it is the inverse of DecodeMessage.
+//
+// The fields used for every message type are the same fields filled by DecodeMessage,
+// FilenameLength and Size are computed from Filename and RawData.
+func EncodeMessage(msg Message) ([]byte, error) {
+	if msg.MessageType == MessageList {
+		if len(msg.Prefix) > 255 || len(msg.Cursor) > 255 {
+			return nil, fmt.Errorf("the prefix and the cursor can not be longer than 255 bytes")
+		}
+		out := make([]byte, 0, 1+4+1+len(msg.Prefix)+1+len(msg.Cursor))
+		out = append(out, byte(MessageList))
+		out = binary.BigEndian.AppendUint32(out, msg.Length)
+		out = append(out, byte(len(msg.Prefix)))
+		out = append(out, msg.Prefix...)
+		out = append(out, byte(len(msg.Cursor)))
+		out = append(out, msg.Cursor...)
+		return out, nil
+	}
+
+	switch msg.MessageType {
+	case MessageUploadChunk:
+		out := make([]byte, 0, 1+8+4+len(msg.RawData))
+		out = append(out, byte(MessageUploadChunk))
+		out = binary.BigEndian.AppendUint64(out, msg.UploadID)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(msg.RawData)))
+		return append(out, msg.RawData...), nil
+	case MessageUploadCommit, MessageUploadAbort:
+		out := make([]byte, 0, 1+8)
+		out = append(out, byte(msg.MessageType))
+		return binary.BigEndian.AppendUint64(out, msg.UploadID), nil
+	}
+
+	if len(msg.Filename) < MIN_FILENAME_LENGTH || len(msg.Filename) > 255 {
+		return nil, fmt.Errorf("invalid filename length=%d, it needs to be between %d and 255 bytes", len(msg.Filename), MIN_FILENAME_LENGTH)
+	}
+
+	out := make([]byte, 0, 2+len(msg.Filename)+16+len(msg.RawData))
+	out = append(out, byte(msg.MessageType), byte(len(msg.Filename)))
+	out = append(out, msg.Filename...)
+
+	switch msg.MessageType {
+	case MessageRead, MessageDelete, MessageVolumeDelete, MessageStat, MessageGetTags:
+	case MessageWrite, MessageUpdate:
+		out = binary.BigEndian.AppendUint32(out, uint32(len(msg.RawData)))
+		out = append(out, msg.RawData...)
+		if msg.MessageType == MessageWrite && len(msg.Tags) > 0 {
+			if err := validateTagLengths(msg.Tags); err != nil {
+				return nil, err
+			}
+			out = appendTags(out, msg.Tags)
+		}
+	case MessageSetTags:
+		if err := validateTagLengths(msg.Tags); err != nil {
+			return nil, err
+		}
+		out = appendTags(out, msg.Tags)
+	case MessageUploadBegin:
+		if len(msg.Tags) > 0 {
+			if err := validateTagLengths(msg.Tags); err != nil {
+				return nil, err
+			}
+			out = appendTags(out, msg.Tags)
+		}
+	case MessageReadRange, MessageVolumeRead:
+		out = binary.BigEndian.AppendUint64(out, msg.Offset)
+		out = binary.BigEndian.AppendUint32(out, msg.Length)
+	case MessageWriteAt, MessageVolumeWrite:
+		out = binary.BigEndian.AppendUint64(out, msg.Offset)
+		out = binary.BigEndian.AppendUint32(out, uint32(len(msg.RawData)))
+		out = append(out, msg.RawData...)
+	case MessageVolumeCreate:
+		out = binary.BigEndian.AppendUint64(out, msg.VolumeSize)
+		out = binary.BigEndian.AppendUint32(out, msg.SectorSize)
+	default:
+		return nil, fmt.Errorf("unknown message type=%d", msg.MessageType)
+	}
+
+	return out, nil
+}
+
+// DecodeResponseMessage reads a binary response built by EncodeResponseMessage.
+//
+// The response has the format [status(1 byte)][error(2 bytes)][payloadLength(4 bytes)][payload].
+func DecodeResponseMessage(raw []byte) (Response, error) {
+	if len(raw) < 7 {
+		return Response{}, fmt.Errorf("response too short length=%d", len(raw))
+	}
+
+	payloadLength := binary.BigEndian.Uint32(raw[3:7])
+	if uint32(len(raw)-7) != payloadLength {
+		return Response{}, fmt.Errorf("the response payload length=%d does not match the payloadLength=%d", len(raw)-7, payloadLength)
+	}
+
+	return Response{
+		Status:        ResponseStatus(raw[0]),
+		Error:         ErrorCode(binary.BigEndian.Uint16(raw[1:3])),
+		PayloadLength: payloadLength,
+		Payload:       raw[7:],
+	}, nil
+}
+
+// EncodeHandshakeRequest builds the handshake sent by a client, it is the inverse of DecodeHandshakeRequest.
+//
+// The format is "STG" + version(1) + reserved(8) + idLen(1) + id + endChar, the reserved
+// bytes are the Capabilities when they are not zero.
+func EncodeHandshakeRequest(h HandshakeRequest) ([]byte, error) {
+	if len(h.ClientID) < 4 || len(h.ClientID) > 255 {
+		return nil, fmt.Errorf("client id length=%d needs to be between 4 and 255 bytes", len(h.ClientID))
+	}
+	if len(h.Reserved) > 8 {
+		return nil, fmt.Errorf("reserved bytes length=%d is bigger than 8", len(h.Reserved))
+	}
+
+	reserved := make([]byte, 8)
+	copy(reserved, h.Reserved)
+	if h.Capabilities != 0 {
+		reserved = encodeCapabilities(h.Capabilities)
+	}
+
+	out := make([]byte, 0, MAGIC_LEN+PROTOCOL_VERSION_LEN+8+1+len(h.ClientID)+1)
+	out = append(out, HandshakeMagic...)
+	out = append(out, h.Version)
+	out = append(out, reserved...)
+	out = append(out, byte(len(h.ClientID)))
+	out = append(out, h.ClientID...)
+	out = append(out, MessageEndChar)
+	return out, nil
+}
+
+// ReadHandshakeRequest reads the bytes of a handshake request from r, the bytes are decoded
+// by DecodeHandshakeRequest.
+//
+// The request is read field by field, the reserved bytes and the client id can contain the end char.
+func ReadHandshakeRequest(r io.Reader) ([]byte, error) {
+	// format: magic(3) + version(1) + reserved(8) + idLen(1)
+	header := make([]byte, MAGIC_LEN+PROTOCOL_VERSION_LEN+8+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// the client id and the end char
+	rest := make([]byte, int(header[len(header)-1])+1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return append(header, rest...), nil
+}
+
+// ReadHandshakeResponse reads the handshake response built by EncodeHandshakeResponse from r.
+//
+// The response is read field by field, the assigned id can contain the end char. When
+// requested is not zero the response has the capabilities negotiated by the server.
+//
+// A response with StatusChallenge is returned when the server requires authentication,
+// the client answers with EncodeAuthResponse and reads the handshake response again.
+func ReadHandshakeResponse(r io.Reader, requested Capabilities) (HandshakeResponse, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return HandshakeResponse{}, err
+	}
+
+	if ResponseStatus(status[0]) == StatusError {
+		// format: status(1) + error(2) + end(1)
+		rest := make([]byte, 3)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return HandshakeResponse{}, err
+		}
+		return HandshakeResponse{
+			Status: StatusError,
+			Error:  ErrorCode(binary.BigEndian.Uint16(rest[0:2])),
+		}, nil
+	}
+
+	if ResponseStatus(status[0]) == StatusChallenge {
+		// format: status(1) + challenge(32) + end(1)
+		rest := make([]byte, ChallengeLength+1)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return HandshakeResponse{}, err
+		}
+		if rest[ChallengeLength] != MessageEndChar {
+			return HandshakeResponse{}, fmt.Errorf("auth challenge does not contains valid end char, endChar=%d", rest[ChallengeLength])
+		}
+		return HandshakeResponse{Status: StatusChallenge, Challenge: rest[:ChallengeLength]}, nil
+	}
+
+	// format: status(1) + idLen(1) + id + [capabilities(8)] + [maxFrameSize(4)] + endChar
+	idLength := make([]byte, 1)
+	if _, err := io.ReadFull(r, idLength); err != nil {
+		return HandshakeResponse{}, err
+	}
+	id := int(idLength[0])
+	fields := make([]byte, id)
+	if requested != 0 {
+		fields = make([]byte, id+CapabilitiesLength)
+	}
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return HandshakeResponse{}, err
+	}
+
+	resp := HandshakeResponse{
+		Status:     StatusOk,
+		AssignedID: string(fields[:id]),
+	}
+	if requested != 0 {
+		resp.Negotiated = true
+		resp.Capabilities = decodeCapabilities(fields[id:])
+	}
+
+	// the maximum frame size is sent only when its capability was negotiated
+	rest := make([]byte, 1)
+	if resp.Capabilities.Has(CapabilityMaxFrameSize) {
+		rest = make([]byte, 4+1)
+	}
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return HandshakeResponse{}, err
+	}
+	if rest[len(rest)-1] != MessageEndChar {
+		return HandshakeResponse{}, fmt.Errorf("handshake response does not contains valid end char, endChar=%d", rest[len(rest)-1])
+	}
+	if len(rest) > 1 {
+		resp.MaxFrameSize = binary.BigEndian.Uint32(rest[:4])
+	}
+	return resp, nil
+}
@@ -1,7 +1,9 @@
 package protocol_test
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
 	"github.com/pablohdzvizcarra/storage-software-cookbook/protocol"
 	"github.com/stretchr/testify/assert"
@@ -567,3 +569,572 @@ func TestDecodeDeleteMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeReadRangeMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		output protocol.Message
+		fails  bool
+	}{
+		{
+			name: "error when filename length is less than 8",
+			input: []byte{
+				0x05,                         // messageType
+				0x04,                         // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x00, // filename
+			},
+			output: protocol.Message{
+				MessageType: protocol.MessageReadRange,
+			},
+			fails: true,
+		},
+		{
+			name: "error when message does not contain offset and length",
+			input: []byte{
+				0x05,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, // incomplete offset
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageReadRange,
+				FilenameLength: 8,
+			},
+			fails: true,
+		},
+		{
+			name: "error when length is zero",
+			input: []byte{
+				0x05,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // offset
+				0x00, 0x00, 0x00, 0x00, // length
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageReadRange,
+				FilenameLength: 8,
+				Filename:       "data.txt",
+				Offset:         6,
+			},
+			fails: true,
+		},
+		{
+			name: "decode valid read range message into Message object",
+			input: []byte{
+				0x05,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // offset
+				0x00, 0x00, 0x00, 0x05, // length
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageReadRange,
+				FilenameLength: 8,
+				Filename:       "data.txt",
+				Offset:         6,
+				Length:         5,
+			},
+			fails: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := protocol.DecodeMessage(test.input)
+			if test.fails {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, test.output, message)
+		})
+	}
+}
+
+func TestDecodeWriteAtMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		output protocol.Message
+		fails  bool
+	}{
+		{
+			name: "error when message does not contain offset and size",
+			input: []byte{
+				0x06,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, // incomplete offset
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageWriteAt,
+				FilenameLength: 8,
+			},
+			fails: true,
+		},
+		{
+			name: "error when content does not match the size",
+			input: []byte{
+				0x06,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // offset
+				0x00, 0x00, 0x00, 0x05, // size
+				0x57, 0x6F, 0x72, // content
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageWriteAt,
+				FilenameLength: 8,
+				Filename:       "data.txt",
+				Offset:         6,
+				Size:           5,
+			},
+			fails: true,
+		},
+		{
+			name: "decode valid write at message into Message object",
+			input: []byte{
+				0x06,                                           // messageType
+				0x08,                                           // filenameLength
+				0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, // offset
+				0x00, 0x00, 0x00, 0x05, // size
+				0x57, 0x6F, 0x72, 0x6C, 0x64, // content
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageWriteAt,
+				FilenameLength: 8,
+				Filename:       "data.txt",
+				Offset:         6,
+				Size:           5,
+				RawData:        []byte{0x57, 0x6F, 0x72, 0x6C, 0x64},
+			},
+			fails: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := protocol.DecodeMessage(test.input)
+			if test.fails {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, test.output, message)
+		})
+	}
+}
+
+func TestDecodeVolumeMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		output protocol.Message
+		fails  bool
+	}{
+		{
+			name: "decode valid volume create message",
+			input: []byte{
+				0x07,                                           // messageType
+				0x08,                                           // nameLength
+				0x64, 0x69, 0x73, 0x6B, 0x2E, 0x69, 0x6D, 0x67, // name
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, // volumeSize
+				0x00, 0x00, 0x02, 0x00, // sectorSize
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageVolumeCreate,
+				FilenameLength: 8,
+				Filename:       "disk.img",
+				VolumeSize:     1048576,
+				SectorSize:     512,
+			},
+		},
+		{
+			name: "decode volume create message without sector size",
+			input: []byte{
+				0x07,                                           // messageType
+				0x08,                                           // nameLength
+				0x64, 0x69, 0x73, 0x6B, 0x2E, 0x69, 0x6D, 0x67, // name
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, // volumeSize
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageVolumeCreate,
+				FilenameLength: 8,
+			},
+			fails: true,
+		},
+		{
+			name: "decode valid volume read message",
+			input: []byte{
+				0x08,                                           // messageType
+				0x08,                                           // nameLength
+				0x64, 0x69, 0x73, 0x6B, 0x2E, 0x69, 0x6D, 0x67, // name
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // lba
+				0x00, 0x00, 0x00, 0x04, // sectors
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageVolumeRead,
+				FilenameLength: 8,
+				Filename:       "disk.img",
+				Offset:         2,
+				Length:         4,
+			},
+		},
+		{
+			name: "decode valid volume write message",
+			input: []byte{
+				0x09,                                           // messageType
+				0x08,                                           // nameLength
+				0x64, 0x69, 0x73, 0x6B, 0x2E, 0x69, 0x6D, 0x67, // name
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, // lba
+				0x00, 0x00, 0x00, 0x02, // size
+				0xAA, 0xBB, // content
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageVolumeWrite,
+				FilenameLength: 8,
+				Filename:       "disk.img",
+				Offset:         2,
+				Size:           2,
+				RawData:        []byte{0xAA, 0xBB},
+			},
+		},
+		{
+			name: "decode valid volume delete message",
+			input: []byte{
+				0x0A,                                           // messageType
+				0x08,                                           // nameLength
+				0x64, 0x69, 0x73, 0x6B, 0x2E, 0x69, 0x6D, 0x67, // name
+			},
+			output: protocol.Message{
+				MessageType:    protocol.MessageVolumeDelete,
+				FilenameLength: 8,
+				Filename:       "disk.img",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := protocol.DecodeMessage(test.input)
+			if test.fails {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			assert.Equal(t, test.output, message)
+		})
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	messages := []protocol.Message{
+		{MessageType: protocol.MessageRead, FilenameLength: 8, Filename: "data.txt"},
+		{MessageType: protocol.MessageWrite, FilenameLength: 8, Filename: "data.txt", Size: 5, RawData: []byte("Hello")},
+		{MessageType: protocol.MessageUpdate, FilenameLength: 8, Filename: "data.txt", Size: 5, RawData: []byte("Hello")},
+		{MessageType: protocol.MessageDelete, FilenameLength: 8, Filename: "data.txt"},
+		{MessageType: protocol.MessageReadRange, FilenameLength: 8, Filename: "data.txt", Offset: 6, Length: 5},
+		{MessageType: protocol.MessageWriteAt, FilenameLength: 8, Filename: "data.txt", Offset: 6, Size: 5, RawData: []byte("World")},
+		{MessageType: protocol.MessageVolumeCreate, FilenameLength: 8, Filename: "disk.img", VolumeSize: 4096, SectorSize: 512},
+		{MessageType: protocol.MessageVolumeRead, FilenameLength: 8, Filename: "disk.img", Offset: 1, Length: 2},
+		{MessageType: protocol.MessageVolumeWrite, FilenameLength: 8, Filename: "disk.img", Offset: 1, Size: 2, RawData: []byte{0xAA, 0xBB}},
+		{MessageType: protocol.MessageVolumeDelete, FilenameLength: 8, Filename: "disk.img"},
+		{MessageType: protocol.MessageStat, FilenameLength: 8, Filename: "data.txt"},
+		{MessageType: protocol.MessageList, Length: 10, Prefix: "logs/", Cursor: "logs/a.txt"},
+		{MessageType: protocol.MessageList},
+		{MessageType: protocol.MessageWrite, FilenameLength: 8, Filename: "data.txt", Size: 5, RawData: []byte("Hello"), Tags: map[string]string{"team": "ingest"}},
+		{MessageType: protocol.MessageSetTags, FilenameLength: 8, Filename: "data.txt", Tags: map[string]string{"team": "", "retention": "30d"}},
+		{MessageType: protocol.MessageGetTags, FilenameLength: 8, Filename: "data.txt"},
+		{MessageType: protocol.MessageUploadBegin, FilenameLength: 8, Filename: "data.txt"},
+		{MessageType: protocol.MessageUploadBegin, FilenameLength: 8, Filename: "data.txt", Tags: map[string]string{"team": "ingest"}},
+		{MessageType: protocol.MessageUploadChunk, UploadID: 7, Size: 5, RawData: []byte("Hello")},
+		{MessageType: protocol.MessageUploadCommit, UploadID: 7},
+		{MessageType: protocol.MessageUploadAbort, UploadID: 1 << 40},
+	}
+
+	// every encoded message is decoded back into the same Message
+	for _, msg := range messages {
+		raw, err := protocol.EncodeMessage(msg)
+		assert.Nil(t, err)
+
+		decoded, err := protocol.DecodeMessage(raw)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, decoded)
+	}
+
+	_, err := protocol.EncodeMessage(protocol.Message{MessageType: protocol.MessageRead, Filename: "a.txt"})
+	assert.NotNil(t, err)
+}
+
+func TestDecodeResponseMessage(t *testing.T) {
+	raw, _, err := protocol.EncodeResponseMessage(protocol.Response{
+		Status:        protocol.StatusOk,
+		PayloadLength: 5,
+		Payload:       []byte("Hello"),
+	})
+	assert.Nil(t, err)
+
+	resp, err := protocol.DecodeResponseMessage(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.Response{Status: protocol.StatusOk, PayloadLength: 5, Payload: []byte("Hello")}, resp)
+
+	_, err = protocol.DecodeResponseMessage(raw[:9])
+	assert.NotNil(t, err)
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	raw, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{Version: protocol.ProtocolVersion, ClientID: "DO91"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x53, 0x54, 0x47, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x04, 0x44, 0x4F, 0x39, 0x31, 0x0A}, raw)
+
+	req, err := protocol.DecodeHandshakeRequest(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "DO91", req.ClientID)
+
+	// the assigned id can contain the end char
+	resp, err := protocol.ReadHandshakeResponse(bytes.NewReader(protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status:     protocol.StatusOk,
+		AssignedID: "id\n01",
+	})), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "id\n01", resp.AssignedID)
+
+	resp, err = protocol.ReadHandshakeResponse(bytes.NewReader(protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status: protocol.StatusError,
+		Error:  protocol.ErrorBadRequest,
+	})), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.HandshakeResponse{Status: protocol.StatusError, Error: protocol.ErrorBadRequest}, resp)
+}
+
+func TestDecodeListMessage(t *testing.T) {
+	message, err := protocol.DecodeMessage([]byte{
+		0x0B,                   // messageType
+		0x00, 0x00, 0x00, 0x02, // limit
+		0x03, 0x6C, 0x6F, 0x67, // prefix
+		0x01, 0x61, // cursor
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.Message{MessageType: protocol.MessageList, Length: 2, Prefix: "log", Cursor: "a"}, message)
+
+	// the cursor length does not match the message
+	_, err = protocol.DecodeMessage([]byte{0x0B, 0x00, 0x00, 0x00, 0x02, 0x00, 0x04, 0x61})
+	assert.NotNil(t, err)
+}
+
+func TestStatAndListPayloads(t *testing.T) {
+	stat := protocol.FileStat{
+		Name:     "data.txt",
+		Size:     11,
+		Blocks:   1,
+		Created:  time.Unix(1700000000, 0),
+		Modified: time.Unix(1700000100, 5),
+		Checksum: "abcd",
+		Owner:    "DO91",
+		Tags:     map[string]string{"env": "prod", "content-type": "text/plain"},
+	}
+
+	decoded, err := protocol.DecodeStatPayload(protocol.EncodeStatPayload(stat))
+	assert.Nil(t, err)
+	assert.Equal(t, stat, decoded)
+
+	// unknown times are sent as 0
+	legacy := protocol.FileStat{Name: "legacy.txt", Size: 5, Blocks: 1}
+	result := protocol.ListResult{Files: []protocol.FileStat{stat, legacy}, NextCursor: "legacy.txt"}
+	decodedList, err := protocol.DecodeListPayload(protocol.EncodeListPayload(result))
+	assert.Nil(t, err)
+	assert.Equal(t, result, decodedList)
+
+	_, err = protocol.DecodeStatPayload(protocol.EncodeStatPayload(stat)[:20])
+	assert.NotNil(t, err)
+}
+
+func TestDecodeWriteMessageWithTags(t *testing.T) {
+	message, err := protocol.DecodeMessage([]byte{
+		0x02,                                           // messageType
+		0x08,                                           // filenameLength
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+		0x00, 0x00, 0x00, 0x02, // size
+		0x48, 0x69, // content
+		0x00, 0x01, // tagsCount
+		0x04, 0x74, 0x65, 0x61, 0x6D, // key
+		0x00, 0x02, 0x69, 0x6F, // value
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"team": "io"}, message.Tags)
+	assert.Equal(t, []byte("Hi"), message.RawData)
+
+	// the tags are truncated
+	_, err = protocol.DecodeMessage([]byte{
+		0x02,                                           // messageType
+		0x08,                                           // filenameLength
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+		0x00, 0x00, 0x00, 0x02, // size
+		0x48, 0x69, // content
+		0x00, 0x01, // tagsCount
+		0x04, 0x74, 0x65, // key
+	})
+	assert.NotNil(t, err)
+
+	// a set tags message without tags does nothing
+	_, err = protocol.DecodeMessage([]byte{
+		0x0D,                                           // messageType
+		0x08,                                           // filenameLength
+		0x64, 0x61, 0x74, 0x61, 0x2E, 0x74, 0x78, 0x74, // filename
+		0x00, 0x00, // tagsCount
+	})
+	assert.NotNil(t, err)
+}
+
+func TestDecodeUploadMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "chunk without size", raw: []byte{16, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{name: "empty chunk", raw: []byte{16, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{name: "chunk content longer than size", raw: []byte{16, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0x41, 0x42}},
+		{name: "commit with extra bytes", raw: []byte{17, 0, 0, 0, 0, 0, 0, 0, 1, 0}},
+		{name: "abort without upload id", raw: []byte{18, 0, 0, 0, 0, 1}},
+		{name: "begin with truncated tags", raw: append([]byte{15, 8}, append([]byte("data.txt"), 0, 1)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := protocol.DecodeMessage(tt.raw)
+			assert.NotNil(t, err)
+		})
+	}
+
+	id, err := protocol.DecodeUploadPayload(protocol.EncodeUploadPayload(42))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), id)
+
+	_, err = protocol.DecodeUploadPayload([]byte{0, 1})
+	assert.NotNil(t, err)
+}
+
+func TestFrameV2(t *testing.T) {
+	raw := protocol.EncodeFrameV2(7, []byte{0x0C, 0x08, 'd', 'a', 't', 'a', '.', 't', 'x', 't'})
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x0E, 0x00, 0x00, 0x00, 0x07}, raw[:8])
+
+	frame, err := protocol.ReadFrameV2(bytes.NewReader(raw), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), frame.RequestID)
+	assert.Equal(t, protocol.MessageStat, frame.Opcode)
+	assert.Equal(t, raw[8:], frame.Message)
+
+	// a frame without the opcode is rejected
+	_, err = protocol.ReadFrameV2(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x07}), 0)
+	assert.NotNil(t, err)
+
+	header := protocol.EncodeResponseFrameHeaderV2(7, protocol.MessageStat, 12)
+	requestID, opcode, length, err := protocol.ReadResponseFrameHeaderV2(bytes.NewReader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), requestID)
+	assert.Equal(t, protocol.MessageStat, opcode)
+	assert.Equal(t, uint32(12), length)
+
+	// the biggest payload of the version 2 leaves room for the frame header
+	header = protocol.EncodeResponseFrameHeaderV2(7, protocol.MessageRead, protocol.ResponseHeaderLength+protocol.MaxPayloadLengthV2)
+	_, _, length, err = protocol.ReadResponseFrameHeaderV2(bytes.NewReader(header))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(protocol.ResponseHeaderLength+protocol.MaxPayloadLengthV2), length)
+	assert.Equal(t, int64(protocol.MaxPayloadLength), protocol.MaxResponsePayload(protocol.ProtocolVersion))
+	assert.Equal(t, int64(protocol.MaxPayloadLengthV2), protocol.MaxResponsePayload(protocol.ProtocolVersion2))
+
+	assert.True(t, protocol.MessageUploadChunk.Ordered())
+	assert.False(t, protocol.MessageRead.Ordered())
+}
+
+func TestEncodeGoAway(t *testing.T) {
+	response := []byte{0x01, 0x00, 0x05, 0x00, 0x00, 0x00, 0x00}
+	assert.Equal(t, append([]byte{0x00, 0x00, 0x00, 0x07}, response...), protocol.EncodeGoAway(protocol.ProtocolVersion))
+
+	raw := protocol.EncodeGoAway(protocol.ProtocolVersion2)
+	requestID, opcode, length, err := protocol.ReadResponseFrameHeaderV2(bytes.NewReader(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.NoticeRequestID, requestID)
+	assert.Equal(t, protocol.MessageType(0), opcode)
+	assert.Equal(t, response, raw[len(raw)-int(length):])
+}
+
+func TestHandshakeCapabilities(t *testing.T) {
+	requested := protocol.CapabilityCompression | protocol.CapabilityStreaming | protocol.CapabilityPipelining
+	raw, err := protocol.EncodeHandshakeRequest(protocol.HandshakeRequest{
+		Version:      protocol.ProtocolVersion2,
+		Capabilities: requested,
+		ClientID:     "DO91",
+	})
+	assert.Nil(t, err)
+	// the bitmap 0x0D is sent in the last reserved byte
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0x0D}, raw[4:12])
+
+	// the reserved bytes can contain the end char
+	raw[11] = byte(protocol.CapabilityChecksums | protocol.CapabilityPipelining)
+	read, err := protocol.ReadHandshakeRequest(bytes.NewReader(raw))
+	assert.Nil(t, err)
+	assert.Equal(t, raw, read)
+
+	req, err := protocol.DecodeHandshakeRequest(read)
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.CapabilityChecksums|protocol.CapabilityPipelining, req.Capabilities)
+
+	// the server replies with the intersection, pipelining needs the version 2
+	assert.Equal(t, protocol.CapabilityStreaming|protocol.CapabilityPipelining, requested.Negotiate(protocol.ServerCapabilities, protocol.ProtocolVersion2))
+	assert.Equal(t, protocol.CapabilityStreaming, requested.Negotiate(protocol.ServerCapabilities, protocol.ProtocolVersion))
+	assert.Equal(t, "streaming|pipelining", requested.Negotiate(protocol.ServerCapabilities, protocol.ProtocolVersion2).String())
+
+	resp, err := protocol.ReadHandshakeResponse(bytes.NewReader(protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status:       protocol.StatusOk,
+		AssignedID:   "DO91",
+		Negotiated:   true,
+		Capabilities: protocol.CapabilityStreaming,
+	})), requested)
+	assert.Nil(t, err)
+	assert.Equal(t, "DO91", resp.AssignedID)
+	assert.Equal(t, protocol.CapabilityStreaming, resp.Capabilities)
+
+	// an empty intersection is sent to the clients that requested capabilities
+	raw = protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{Status: protocol.StatusOk, AssignedID: "DO91", Negotiated: true})
+	assert.Len(t, raw, 1+1+4+8+1)
+	resp, err = protocol.ReadHandshakeResponse(bytes.NewReader(raw), protocol.CapabilityCompression)
+	assert.Nil(t, err)
+	assert.True(t, resp.Negotiated)
+	assert.Equal(t, protocol.Capabilities(0), resp.Capabilities)
+}
+
+func TestHandshakeMaxFrameSize(t *testing.T) {
+	// the maximum frame size is sent after the capabilities when its capability is negotiated
+	raw := protocol.EncodeHandshakeResponse(protocol.HandshakeResponse{
+		Status:       protocol.StatusOk,
+		AssignedID:   "DO91",
+		Negotiated:   true,
+		Capabilities: protocol.CapabilityMaxFrameSize,
+		MaxFrameSize: 1 << 20,
+	})
+	assert.Equal(t, []byte{0x00, 0x10, 0x00, 0x00, 0x0A}, raw[len(raw)-5:])
+	resp, err := protocol.ReadHandshakeResponse(bytes.NewReader(raw), protocol.CapabilityMaxFrameSize)
+	assert.Nil(t, err)
+	assert.Equal(t, "DO91", resp.AssignedID)
+	assert.Equal(t, uint32(1<<20), resp.MaxFrameSize)
+	assert.Equal(t, "max-frame-size", resp.Capabilities.String())
+
+	// a frame bigger than the maximum is discarded and the next frame can be read
+	stream := bytes.NewReader(append(protocol.EncodeFrameV2(3, make([]byte, 64)), protocol.EncodeFrameV2(4, []byte{0x0C})...))
+	frame, err := protocol.ReadFrameV2(stream, 32)
+	assert.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+	assert.Equal(t, uint32(3), frame.RequestID)
+	frame, err = protocol.ReadFrameV2(stream, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), frame.RequestID)
+
+	assert.Equal(t, []byte{0x00, 0x00, 0x00, 0x0C, 0x00, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00},
+		protocol.EncodeErrorFrame(protocol.ProtocolVersion2, 3, protocol.ErrorBadRequest))
+}
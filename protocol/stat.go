@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// FileStat is the information of a file sent in the STAT and LIST responses.
+type FileStat struct {
+	Name     string
+	Size     uint64
+	Blocks   uint32
+	Created  time.Time
+	Modified time.Time
+	// Checksum is the hex encoded checksum of the file content, it can be empty for legacy files.
+	Checksum string
+	// Owner is the ID of the client that created the file, it can be empty.
+	Owner string
+	Tags  map[string]string
+}
+
+// ListResult is the payload of a LIST response.
+//
+// NextCursor is empty when there are no more files, otherwise it is sent as the
+// cursor of the next LIST message.
+type ListResult struct {
+	Files      []FileStat
+	NextCursor string
+}
+
+// appendFileStat appends a FileStat with the format:
+// [nameLength(1 byte)][name][size(8 bytes)][blocks(4 bytes)][created(8 bytes)][modified(8 bytes)]
+// [checksumLength(1 byte)][checksum][ownerLength(1 byte)][owner][tagsCount(2 bytes)][tag * tagsCount]
+//
+// The times are sent as nanoseconds since the Unix epoch, 0 is an unknown time.
+// The tags have the format of appendTags.
+func appendFileStat(out []byte, stat FileStat) []byte {
+	out = append(out, byte(len(stat.Name)))
+	out = append(out, stat.Name...)
+	out = binary.BigEndian.AppendUint64(out, stat.Size)
+	out = binary.BigEndian.AppendUint32(out, stat.Blocks)
+	out = binary.BigEndian.AppendUint64(out, unixNano(stat.Created))
+	out = binary.BigEndian.AppendUint64(out, unixNano(stat.Modified))
+	out = append(out, byte(len(stat.Checksum)))
+	out = append(out, stat.Checksum...)
+	out = append(out, byte(len(stat.Owner)))
+	out = append(out, stat.Owner...)
+
+	return appendTags(out, stat.Tags)
+}
+
+// readFileStat reads a FileStat written by appendFileStat and returns the offset after it.
+func readFileStat(raw []byte, offset int) (stat FileStat, next int, err error) {
+	if offset+1 > len(raw) {
+		return FileStat{}, 0, fmt.Errorf("the payload length=%d does not contain the file name", len(raw))
+	}
+	nameLength := int(raw[offset])
+	offset += 1
+	if offset+nameLength+8+4+8+8+1 > len(raw) {
+		return FileStat{}, 0, fmt.Errorf("the payload length=%d does not contain the file information", len(raw))
+	}
+
+	stat = FileStat{Name: string(raw[offset : offset+nameLength])}
+	offset += nameLength
+	stat.Size = binary.BigEndian.Uint64(raw[offset : offset+8])
+	offset += 8
+	stat.Blocks = binary.BigEndian.Uint32(raw[offset : offset+4])
+	offset += 4
+	stat.Created = fromUnixNano(binary.BigEndian.Uint64(raw[offset : offset+8]))
+	offset += 8
+	stat.Modified = fromUnixNano(binary.BigEndian.Uint64(raw[offset : offset+8]))
+	offset += 8
+
+	checksumLength := int(raw[offset])
+	offset += 1
+	if offset+checksumLength > len(raw) {
+		return FileStat{}, 0, fmt.Errorf("the payload length=%d does not contain the checksum", len(raw))
+	}
+	stat.Checksum = string(raw[offset : offset+checksumLength])
+	offset += checksumLength
+
+	if offset+1 > len(raw) {
+		return FileStat{}, 0, fmt.Errorf("the payload length=%d does not contain the owner", len(raw))
+	}
+	ownerLength := int(raw[offset])
+	offset += 1
+	if offset+ownerLength > len(raw) {
+		return FileStat{}, 0, fmt.Errorf("the payload length=%d does not contain the owner", len(raw))
+	}
+	stat.Owner = string(raw[offset : offset+ownerLength])
+	offset += ownerLength
+
+	stat.Tags, offset, err = readTags(raw, offset)
+	if err != nil {
+		return FileStat{}, 0, err
+	}
+	return stat, offset, nil
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(nanos uint64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nanos))
+}
+
+// EncodeStatPayload builds the payload of a STAT response.
+func EncodeStatPayload(stat FileStat) []byte {
+	return appendFileStat(nil, stat)
+}
+
+// DecodeStatPayload reads the payload of a STAT response.
+func DecodeStatPayload(raw []byte) (FileStat, error) {
+	stat, offset, err := readFileStat(raw, 0)
+	if err != nil {
+		return FileStat{}, err
+	}
+	if offset != len(raw) {
+		return FileStat{}, fmt.Errorf("the payload length=%d has unexpected bytes after the file information", len(raw))
+	}
+	return stat, nil
+}
+
+// EncodeListPayload builds the payload of a LIST response with the format:
+// [count(4 bytes)][FileStat * count][cursorLength(1 byte)][cursor]
+func EncodeListPayload(result ListResult) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(result.Files)))
+	for _, stat := range result.Files {
+		out = appendFileStat(out, stat)
+	}
+	out = append(out, byte(len(result.NextCursor)))
+	out = append(out, result.NextCursor...)
+	return out
+}
+
+// DecodeListPayload reads the payload of a LIST response.
+func DecodeListPayload(raw []byte) (ListResult, error) {
+	if len(raw) < 5 {
+		return ListResult{}, fmt.Errorf("list payload too short length=%d", len(raw))
+	}
+
+	count := int(binary.BigEndian.Uint32(raw[0:4]))
+	offset := 4
+	result := ListResult{}
+	for i := 0; i < count; i++ {
+		stat, next, err := readFileStat(raw, offset)
+		if err != nil {
+			return ListResult{}, err
+		}
+		result.Files = append(result.Files, stat)
+		offset = next
+	}
+
+	if offset+1 > len(raw) {
+		return ListResult{}, fmt.Errorf("the payload length=%d does not contain the cursor", len(raw))
+	}
+	cursorLength := int(raw[offset])
+	offset += 1
+	if offset+cursorLength != len(raw) {
+		return ListResult{}, fmt.Errorf("the payload length=%d does not match the cursor length=%d", len(raw), cursorLength)
+	}
+	result.NextCursor = string(raw[offset:])
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// appendTags appends the tags with the format:
+// [tagsCount(2 bytes)][tag * tagsCount]
+//
+// Every tag has the format [keyLength(1 byte)][key][valueLength(2 bytes)][value], sorted by key.
+func appendTags(out []byte, tags map[string]string) []byte {
+	out = binary.BigEndian.AppendUint16(out, uint16(len(tags)))
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		out = append(out, byte(len(key)))
+		out = append(out, key...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(tags[key])))
+		out = append(out, tags[key]...)
+	}
+	return out
+}
+
+// readTags reads the tags written by appendTags and returns the offset after them,
+// the map is nil when there are no tags.
+func readTags(raw []byte, offset int) (map[string]string, int, error) {
+	if offset+2 > len(raw) {
+		return nil, 0, fmt.Errorf("the rawData length=%d does not contain the tags count", len(raw))
+	}
+	count := int(binary.BigEndian.Uint16(raw[offset : offset+2]))
+	offset += 2
+
+	var tags map[string]string
+	for i := 0; i < count; i++ {
+		if offset+1 > len(raw) {
+			return nil, 0, fmt.Errorf("the rawData length=%d does not contain the tag key", len(raw))
+		}
+		keyLength := int(raw[offset])
+		offset += 1
+		if offset+keyLength+2 > len(raw) {
+			return nil, 0, fmt.Errorf("the rawData length=%d does not contain the tag key", len(raw))
+		}
+		key := string(raw[offset : offset+keyLength])
+		offset += keyLength
+
+		valueLength := int(binary.BigEndian.Uint16(raw[offset : offset+2]))
+		offset += 2
+		if offset+valueLength > len(raw) {
+			return nil, 0, fmt.Errorf("the rawData length=%d does not contain the value of the tag=%s", len(raw), key)
+		}
+
+		if tags == nil {
+			tags = make(map[string]string, count)
+		}
+		tags[key] = string(raw[offset : offset+valueLength])
+		offset += valueLength
+	}
+	return tags, offset, nil
+}
+
+// validateTagLengths validates that the tags can be encoded by appendTags.
+func validateTagLengths(tags map[string]string) error {
+	if len(tags) > 0xFFFF {
+		return fmt.Errorf("too many tags=%d", len(tags))
+	}
+	for key, value := range tags {
+		if len(key) > 0xFF || len(value) > 0xFFFF {
+			return fmt.Errorf("the tag=%.32s is too long", key)
+		}
+	}
+	return nil
+}
+
+// EncodeTagsPayload builds the payload of a SET TAGS or GET TAGS response.
+func EncodeTagsPayload(tags map[string]string) []byte {
+	return appendTags(nil, tags)
+}
+
+// DecodeTagsPayload reads the payload of a SET TAGS or GET TAGS response.
+func DecodeTagsPayload(raw []byte) (map[string]string, error) {
+	tags, offset, err := readTags(raw, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset != len(raw) {
+		return nil, fmt.Errorf("the payload length=%d has unexpected bytes after the tags", len(raw))
+	}
+	return tags, nil
+}
@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DefaultChunkSize is the size of the chunks sent by the clients in an upload,
+// the server accepts chunks of any size that fits in a message.
+const DefaultChunkSize = 1 << 20
+
+// EncodeUploadPayload builds the payload of an UPLOAD BEGIN response with the format:
+// [uploadID(8 bytes)]
+func EncodeUploadPayload(uploadID uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uploadID)
+}
+
+// DecodeUploadPayload reads the payload of an UPLOAD BEGIN response.
+func DecodeUploadPayload(raw []byte) (uint64, error) {
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("the upload payload length=%d needs to be 8 bytes", len(raw))
+	}
+	return binary.BigEndian.Uint64(raw), nil
+}
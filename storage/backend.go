@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"time"
+)
+
+// MetadataKey is the reserved key used by the Store to persist the metadata document in a Backend.
+const MetadataKey = "metadata.json"
+
+// ObjectInfo describes an object saved in a Backend.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend defines the operations a storage medium needs to implement to save
+// the blocks and the metadata used by the Store.
+//
+// Implementations must be safe for concurrent use, and must return an error wrapping
+// os.ErrNotExist when the requested key does not exist.
+type Backend interface {
+	// Put saves data under key, replacing any previous value.
+	Put(key string, data []byte) error
+	// Get returns the data saved under key.
+	Get(key string) ([]byte, error)
+	// Delete removes the data saved under key.
+	Delete(key string) error
+	// Stat returns information about the data saved under key.
+	Stat(key string) (ObjectInfo, error)
+	// List returns the keys of all the blocks saved in the backend, the metadata key is not included.
+	List() ([]string, error)
+}
+
+// Journal is implemented by the backends able to persist the metadata changes in an append-only log.
+//
+// The Store appends one record for every change of the metadata and periodically saves a
+// checkpoint of the full metadata under MetadataKey, after the checkpoint the journal is truncated.
+type Journal interface {
+	// AppendJournal adds a record at the end of the journal, the record must be durable when the method returns.
+	AppendJournal(record []byte) error
+	// ReadJournal returns every complete record saved since the last truncate, in order.
+	ReadJournal() ([][]byte, error)
+	// TruncateJournal removes all the records of the journal.
+	TruncateJournal() error
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackends(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		backend Backend
+	}{
+		{
+			name:    "memory backend",
+			backend: NewMemoryBackend(),
+		},
+		{
+			name:    "disk backend",
+			backend: NewDiskBackend(filepath.Join(dir, "blocks"), filepath.Join(dir, "metadata.json")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.backend.Get("block-1.bin")
+			assert.True(t, errors.Is(err, os.ErrNotExist))
+
+			assert.Nil(t, tt.backend.Put("block-1.bin", []byte("hello")))
+			assert.Nil(t, tt.backend.Put("block-2.bin", []byte("world!")))
+			assert.Nil(t, tt.backend.Put(MetadataKey, []byte("{}")))
+
+			data, err := tt.backend.Get("block-1.bin")
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("hello"), data)
+
+			info, err := tt.backend.Stat("block-2.bin")
+			assert.Nil(t, err)
+			assert.Equal(t, int64(6), info.Size)
+
+			keys, err := tt.backend.List()
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"block-1.bin", "block-2.bin"}, keys)
+
+			assert.Nil(t, tt.backend.Delete("block-1.bin"))
+			_, err = tt.backend.Stat("block-1.bin")
+			assert.True(t, errors.Is(err, os.ErrNotExist))
+			assert.True(t, errors.Is(tt.backend.Delete("block-1.bin"), os.ErrNotExist))
+		})
+	}
+}
+
+func TestStoreWithMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	// a file bigger than one block is split in two blocks
+	data := make([]byte, DefaultBlockSize+10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	assert.Nil(t, store.WriteFile("big-file.bin", data))
+	keys, _ := backend.List()
+	assert.Len(t, keys, 2)
+
+	got, err := store.ReadFile("big-file.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = store.DeleteFile("big-file.bin")
+	assert.Nil(t, err)
+	keys, _ = backend.List()
+	assert.Empty(t, keys)
+
+	_, err = store.ReadFile("big-file.bin")
+	assert.NotNil(t, err)
+}
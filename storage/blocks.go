@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// block is a chunk of a file with its content address.
+//
+// content is nil for the blocks of a file that are not modified by an operation.
+type block struct {
+	id       string
+	checksum string
+	content  []byte
+}
+
+// checksum returns the hex encoded SHA-256 of a block content.
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// blockID returns the content address of a block from its checksum.
+func blockID(checksum string) string {
+	return fmt.Sprintf("%s.bin", checksum)
+}
+
+// splitBlocks splits data in chunks of blockSize bytes, the last chunk can be smaller.
+func splitBlocks(data []byte, blockSize int) [][]byte {
+	chunks := make([][]byte, 0, (len(data)+blockSize-1)/blockSize)
+
+	// loop through the data in blockSize chunks
+	for i := 0; i < len(data); i += blockSize {
+		end := i + blockSize
+
+		// this if is to ensure we don't read beyond the data length
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[i:end])
+	}
+	return chunks
+}
+
+// blockIDs returns the ID of every block.
+func blockIDs(blocks []block) []string {
+	ids := make([]string, len(blocks))
+	for i, b := range blocks {
+		ids[i] = b.id
+	}
+	return ids
+}
+
+// isReferenced reports if a block is referenced by any file.
+func (s *Store) isReferenced(id string) bool {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+	return s.meta.Blocks[id].RefCount > 0
+}
+
+// writeBlocks saves every chunk concurrently as a block.
+//
+// The chunks already saved by other files are not written again.
+// If any block fails the blocks written are removed and an error is returned.
+func (s *Store) writeBlocks(chunks [][]byte) ([]block, error) {
+	blocks := make([]block, len(chunks))
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(chunks))
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		// Launch a goroutine to hash and write this block concurrently
+		go func(index int, content []byte) {
+			defer wg.Done()
+			sum := checksum(content)
+			id := blockID(sum)
+			blocks[index] = block{id: id, checksum: sum, content: content}
+
+			if s.isReferenced(id) {
+				slog.Info("Block already saved, skipping write", "blockID", id)
+				return
+			}
+
+			slog.Info("Writing block to backend", "blockID", id)
+			if err := s.backend.Put(id, content); err != nil {
+				slog.Error("Error writing block to backend", "blockID", id, "error", err)
+				errChan <- fmt.Errorf("failed to write block %s: %v", id, err)
+			}
+		}(i, chunk)
+	}
+
+	wg.Wait()
+	close(errChan)
+
+	if err := <-errChan; err != nil {
+		s.removeUnreferencedBlocks(blockIDs(blocks))
+		return nil, err
+	}
+
+	slog.Info("All blocks written to backend")
+	return blocks, nil
+}
+
+// commitBlocks saves in the metadata that filename is made of blocks and has size bytes,
+// the owner and the tags of opts are only saved when the file is created.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) commitBlocks(filename string, blocks []block, size int64, opts WriteOptions) error {
+	if err := s.ensureBlocks(blocks); err != nil {
+		return err
+	}
+
+	ids := make([]string, len(blocks))
+	checksums := make([]string, len(blocks))
+	for i, b := range blocks {
+		ids[i] = b.id
+		checksums[i] = b.checksum
+	}
+
+	return s.commit(journalRecord{
+		Op:        journalOpPut,
+		Filename:  filename,
+		Blocks:    ids,
+		Checksums: checksums,
+		Size:      size,
+		Time:      time.Now(),
+		Owner:     opts.Owner,
+		Tags:      maps.Clone(opts.Tags),
+	})
+}
+
+// ensureBlocks validates that the blocks exist in the backend before they are referenced.
+//
+// A block that was not referenced when it was written could be removed by a concurrent
+// delete before the commit, those blocks are written again.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) ensureBlocks(blocks []block) error {
+	for _, b := range blocks {
+		if s.meta.Blocks[b.id].RefCount > 0 {
+			continue
+		}
+
+		if _, err := s.backend.Stat(b.id); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if b.content == nil {
+			return fmt.Errorf("%w: block=%s", ErrBlockMissing, b.id)
+		}
+
+		slog.Info("Block removed by a concurrent operation, writing it again", "blockID", b.id)
+		if err := s.backend.Put(b.id, b.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnreferencedBlocks removes the blocks that are not referenced by any file.
+//
+// The metadata lock is held while the blocks are removed, so a concurrent write
+// can not reference a block in the middle of its removal.
+func (s *Store) removeUnreferencedBlocks(ids []string) []error {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+	return s.deleteBlocks(ids)
+}
+
+// deleteBlocks removes concurrently the blocks without references and returns the errors that happened,
+// the pinned blocks are kept.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) deleteBlocks(ids []string) []error {
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(ids))
+	seen := make(map[string]bool)
+
+	for _, blockID := range ids {
+		// a file can contain the same block many times
+		if blockID == "" || seen[blockID] || s.meta.Blocks[blockID].RefCount > 0 || s.pinnedBlocks[blockID] > 0 {
+			continue
+		}
+		seen[blockID] = true
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			slog.Info("deleting the block saved with id", "blockID", id)
+			err := s.backend.Delete(id)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Error("An error occurred deleting the block", "blockID", id, "error", err)
+				errChan <- fmt.Errorf("failed to delete block %s: %v", id, err)
+			}
+		}(blockID)
+	}
+
+	wg.Wait()
+	close(errChan)
+
+	// collect errors from channel
+	var deleteErrors []error
+	for err := range errChan {
+		deleteErrors = append(deleteErrors, err)
+	}
+	return deleteErrors
+}
+
+// pinBlocks protects the blocks from being deleted while they are used by an upload or a reader,
+// a block can be pinned many times and it is protected until it is unpinned the same number of times.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) pinBlocks(ids []string) {
+	if s.pinnedBlocks == nil {
+		s.pinnedBlocks = make(map[string]int)
+	}
+	for _, id := range ids {
+		s.pinnedBlocks[id]++
+	}
+}
+
+// unpinBlocks removes the protection added by pinBlocks.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) unpinBlocks(ids []string) {
+	for _, id := range ids {
+		s.pinnedBlocks[id]--
+		if s.pinnedBlocks[id] <= 0 {
+			delete(s.pinnedBlocks, id)
+		}
+	}
+}
+
+// checksums returns the checksum saved in the metadata for every block.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) checksums(ids []string) []string {
+	checksums := make([]string, len(ids))
+	for i, id := range ids {
+		checksums[i] = s.meta.Blocks[id].Checksum
+	}
+	return checksums
+}
+
+// readBlock reads a block from the backend and verifies its content.
+//
+// expected is the checksum saved in the metadata, an empty checksum is not verified.
+func (s *Store) readBlock(id string, expected string) ([]byte, error) {
+	slog.Info("Reading block from backend", "blockID", id)
+	chunk, err := s.backend.Get(id)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Error("Block does not exist in the backend", "blockID", id)
+		return nil, fmt.Errorf("%w: block=%s", ErrBlockMissing, id)
+	}
+	if err != nil {
+		slog.Error("Error reading block from backend", "blockID", id, "error", err)
+		return nil, fmt.Errorf("failed to read block %s: %v", id, err)
+	}
+
+	if expected != "" && checksum(chunk) != expected {
+		slog.Error("Block checksum does not match", "blockID", id, "expected", expected)
+		return nil, fmt.Errorf("%w: block=%s", ErrChecksumMismatch, id)
+	}
+	return chunk, nil
+}
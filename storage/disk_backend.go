@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// journalSuffix is appended to the metadata file path to build the journal file path.
+const journalSuffix = ".wal"
+
+// DiskBackend saves the blocks as files inside a directory and the metadata as a JSON file.
+//
+// The metadata journal is saved next to the metadata file, using the same name with the ".wal" suffix.
+type DiskBackend struct {
+	BlocksDir    string
+	MetadataFile string
+
+	journalMutex sync.Mutex
+}
+
+// NewDiskBackend creates a Backend that uses the local filesystem.
+//
+// blocksDir is the directory where every block is saved as a file, metadataFile is the
+// path of the JSON file with the metadata document.
+func NewDiskBackend(blocksDir, metadataFile string) *DiskBackend {
+	return &DiskBackend{BlocksDir: blocksDir, MetadataFile: metadataFile}
+}
+
+// path resolves the location on disk for a key.
+func (d *DiskBackend) path(key string) (string, error) {
+	if key == MetadataKey {
+		return d.MetadataFile, nil
+	}
+
+	// block keys are plain file names, we never allow to escape the blocks directory
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid block key=%q", key)
+	}
+	return filepath.Join(d.BlocksDir, key), nil
+}
+
+func (d *DiskBackend) journalPath() string {
+	return d.MetadataFile + journalSuffix
+}
+
+// Put saves the data atomically, the data is written in a temporary file that is
+// synced to disk and then renamed, a crash never leaves a partially written key.
+func (d *DiskBackend) Put(key string, data []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// the remove fails after the rename, it only cleans the temporary file on errors
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (d *DiskBackend) Get(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (d *DiskBackend) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (d *DiskBackend) Stat(key string) (ObjectInfo, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *DiskBackend) List() ([]string, error) {
+	entries, err := os.ReadDir(d.BlocksDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// skip the metadata and journal files when they are saved inside the blocks directory
+	metadataPath, _ := filepath.Abs(d.MetadataFile)
+	journalPath, _ := filepath.Abs(d.journalPath())
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// directories and temporary files of an unfinished Put are not blocks
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		entryPath, _ := filepath.Abs(filepath.Join(d.BlocksDir, entry.Name()))
+		if entryPath == metadataPath || entryPath == journalPath {
+			continue
+		}
+		keys = append(keys, entry.Name())
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// AppendJournal writes a record at the end of the journal file and syncs it to disk.
+//
+// Every record is saved as [length(4 bytes)][crc32(4 bytes)][record], the checksum
+// allows to detect a record partially written by a crash.
+func (d *DiskBackend) AppendJournal(record []byte) error {
+	d.journalMutex.Lock()
+	defer d.journalMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(d.journalPath()), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(d.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	frame := make([]byte, 8+len(record))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(record))
+	copy(frame[8:], record)
+
+	if _, err := file.Write(frame); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ReadJournal reads all the complete records of the journal file.
+//
+// A torn or corrupted record at the end of the file is the result of a crash while appending,
+// the record was never acknowledged so it is ignored together with anything after it.
+func (d *DiskBackend) ReadJournal() ([][]byte, error) {
+	d.journalMutex.Lock()
+	defer d.journalMutex.Unlock()
+
+	data, err := os.ReadFile(d.journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	offset := 0
+	for offset < len(data) {
+		if offset+8 > len(data) {
+			slog.Warn("Ignoring a torn record at the end of the journal", "offset", offset)
+			break
+		}
+
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		checksum := binary.BigEndian.Uint32(data[offset+4 : offset+8])
+		if offset+8+length > len(data) {
+			slog.Warn("Ignoring a torn record at the end of the journal", "offset", offset)
+			break
+		}
+
+		record := data[offset+8 : offset+8+length]
+		if crc32.ChecksumIEEE(record) != checksum {
+			slog.Warn("Ignoring a corrupted record in the journal", "offset", offset)
+			break
+		}
+
+		records = append(records, record)
+		offset += 8 + length
+	}
+
+	return records, nil
+}
+
+func (d *DiskBackend) TruncateJournal() error {
+	d.journalMutex.Lock()
+	defer d.journalMutex.Unlock()
+
+	err := os.Truncate(d.journalPath(), 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// syncDir flushes the directory entry changes (like a rename) to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// some platforms do not support syncing a directory, it is not a fatal error
+	if err := f.Sync(); err != nil && err != io.EOF {
+		slog.Debug("Could not sync directory", "dir", dir, "error", err)
+	}
+	return nil
+}
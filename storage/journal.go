@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// CheckpointInterval is the number of journal records after which the Store saves
+// a checkpoint of the full metadata and truncates the journal.
+const CheckpointInterval = 128
+
+const (
+	journalOpPut          = "put"
+	journalOpDelete       = "delete"
+	journalOpVolumeCreate = "volume-create"
+	journalOpVolumeWrite  = "volume-write"
+	journalOpVolumeDelete = "volume-delete"
+	journalOpTags         = "tags"
+)
+
+// journalRecord is one change of the metadata saved in the journal.
+//
+// Records are idempotent, replaying a record that is already part of the checkpoint
+// produces the same metadata.
+type journalRecord struct {
+	Op       string   `json:"op"`
+	Filename string   `json:"file"`
+	Blocks   []string `json:"blocks,omitempty"`
+	// Checksums has the checksum of every block in Blocks, in the same order.
+	Checksums []string `json:"checksums,omitempty"`
+
+	// Size is the size of the file for a put and the size of the volume for a volume-create,
+	// SectorSize is only used by the volume-create.
+	Size       int64 `json:"size,omitempty"`
+	SectorSize int   `json:"sectorSize,omitempty"`
+	// Time is when a put was executed, it is saved as the modification time of the file.
+	Time time.Time `json:"time,omitzero"`
+	// Owner and Tags are saved when a put creates the file, they are ignored when
+	// the put replaces the blocks of an existing file. A tags record has all the tags of the file.
+	Owner string            `json:"owner,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	// Regions has the index of the volume region where every block in Blocks is saved,
+	// an empty block ID in a volume-write deallocates the region.
+	Regions []int64 `json:"regions,omitempty"`
+}
+
+// apply executes the record over the metadata, the reference count of the blocks
+// is updated to keep it equal to the number of references from the files.
+func (doc *metadataDocument) apply(rec journalRecord) error {
+	switch rec.Op {
+	case journalOpPut:
+		record, exists := doc.Files[rec.Filename]
+		doc.unreference(record.Blocks)
+		if !exists {
+			record.Created = rec.Time
+			record.Owner = rec.Owner
+			record.Tags = rec.Tags
+		}
+		record.Blocks = rec.Blocks
+		record.Size = rec.Size
+		record.SizeUnknown = false
+		record.Modified = rec.Time
+		record.Checksum = fileChecksum(rec.Checksums)
+		doc.Files[rec.Filename] = record
+		doc.reference(rec.Blocks, rec.Checksums)
+	case journalOpDelete:
+		doc.unreference(doc.Files[rec.Filename].Blocks)
+		delete(doc.Files, rec.Filename)
+	case journalOpTags:
+		if record, exists := doc.Files[rec.Filename]; exists {
+			record.Tags = rec.Tags
+			doc.Files[rec.Filename] = record
+		}
+	case journalOpVolumeCreate:
+		if _, exists := doc.Volumes[rec.Filename]; !exists {
+			doc.Volumes[rec.Filename] = VolumeRecord{
+				Size:       rec.Size,
+				SectorSize: rec.SectorSize,
+				Blocks:     make(map[int64]string),
+			}
+		}
+	case journalOpVolumeWrite:
+		volume, exists := doc.Volumes[rec.Filename]
+		if !exists {
+			return fmt.Errorf("journal record for unknown volume=%s", rec.Filename)
+		}
+		for i, region := range rec.Regions {
+			if old, ok := volume.Blocks[region]; ok {
+				doc.unreference([]string{old})
+			}
+
+			if rec.Blocks[i] == "" {
+				delete(volume.Blocks, region)
+				continue
+			}
+			volume.Blocks[region] = rec.Blocks[i]
+			doc.reference(rec.Blocks[i:i+1], rec.Checksums[i:i+1])
+		}
+	case journalOpVolumeDelete:
+		if volume, exists := doc.Volumes[rec.Filename]; exists {
+			for _, id := range volume.Blocks {
+				doc.unreference([]string{id})
+			}
+			delete(doc.Volumes, rec.Filename)
+		}
+	default:
+		return fmt.Errorf("unknown journal operation=%s", rec.Op)
+	}
+	return nil
+}
+
+// load reads the metadata from the backend the first time it is needed.
+//
+// The recovery process is:
+//  1. Load the last checkpoint saved under MetadataKey.
+//  2. Replay the journal records saved after the checkpoint.
+//  3. Remove the blocks not referenced by the metadata, they belong to operations that
+//     never reached the journal (writes are rolled back) or whose blocks were not
+//     deleted yet (deletes are completed).
+//  4. Save a new checkpoint and truncate the journal.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) load() error {
+	if s.meta != nil {
+		return nil
+	}
+
+	doc, err := s.loadMetadata()
+	if err != nil {
+		slog.Error("An error occurred when reading the metadata checkpoint", "error", err)
+		return err
+	}
+
+	var records [][]byte
+	if s.journal != nil {
+		records, err = s.journal.ReadJournal()
+		if err != nil {
+			slog.Error("An error occurred when reading the metadata journal", "error", err)
+			return err
+		}
+	}
+
+	slog.Info("Replaying the metadata journal", "records", len(records))
+	for _, raw := range records {
+		var rec journalRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return fmt.Errorf("invalid journal record: %v", err)
+		}
+		if err := doc.apply(rec); err != nil {
+			return err
+		}
+	}
+
+	if err := s.checkBlockSize(doc); err != nil {
+		slog.Error("The metadata can not be used by the store", "error", err)
+		return err
+	}
+
+	s.meta = doc
+	s.removeOrphanBlocks()
+
+	if s.journal != nil {
+		return s.checkpoint()
+	}
+	return nil
+}
+
+// checkBlockSize verifies that the metadata was saved with the block size of the Store.
+//
+// The documents saved before the block size could be configured have no block size, their
+// files and volumes used DefaultBlockSize. An empty document takes the block size of the Store.
+func (s *Store) checkBlockSize(doc *metadataDocument) error {
+	if doc.BlockSize == 0 {
+		doc.BlockSize = s.blockSize
+		if len(doc.Files) > 0 || len(doc.Volumes) > 0 {
+			doc.BlockSize = DefaultBlockSize
+		}
+	}
+	if doc.BlockSize != s.blockSize {
+		return fmt.Errorf("%w: the metadata was saved with blocks of %d bytes and the store uses %d bytes", ErrBlockSizeMismatch, doc.BlockSize, s.blockSize)
+	}
+	return nil
+}
+
+// removeOrphanBlocks deletes every block in the backend that is not referenced by the metadata.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) removeOrphanBlocks() {
+	keys, err := s.backend.List()
+	if err != nil {
+		slog.Error("Could not list the blocks to find orphans", "error", err)
+		return
+	}
+
+	for _, key := range keys {
+		if s.meta.Blocks[key].RefCount > 0 {
+			continue
+		}
+
+		slog.Info("Removing orphan block", "blockID", key)
+		if err := s.backend.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Could not remove orphan block", "blockID", key, "error", err)
+		}
+	}
+}
+
+// commit persists a metadata change and applies it to the in-memory metadata.
+//
+// When the backend supports a journal the record is appended to it, otherwise the
+// full metadata is saved on every change.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) commit(rec journalRecord) error {
+	if s.journal == nil {
+		if err := s.meta.apply(rec); err != nil {
+			return err
+		}
+		return s.checkpoint()
+	}
+
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if err := s.journal.AppendJournal(raw); err != nil {
+		slog.Error("An error occurred appending a record to the journal", "op", rec.Op, "file", rec.Filename, "error", err)
+		return err
+	}
+
+	if err := s.meta.apply(rec); err != nil {
+		return err
+	}
+
+	s.pendingRecords++
+	if s.pendingRecords >= CheckpointInterval {
+		// the change is already durable in the journal, a failed checkpoint is retried later
+		if err := s.checkpoint(); err != nil {
+			slog.Error("An error occurred saving the metadata checkpoint", "error", err)
+		}
+	}
+	return nil
+}
+
+// checkpoint saves the full metadata and truncates the journal.
+//
+// The caller must hold the metadataMutex.
+func (s *Store) checkpoint() error {
+	jsonData, err := json.MarshalIndent(s.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := s.backend.Put(MetadataKey, jsonData); err != nil {
+		return err
+	}
+
+	s.pendingRecords = 0
+	if s.journal != nil {
+		return s.journal.TruncateJournal()
+	}
+	return nil
+}
+
+// Checkpoint saves the full metadata in the backend and truncates the journal.
+func (s *Store) Checkpoint() error {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.checkpoint()
+}
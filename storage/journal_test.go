@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	blocksDir := filepath.Join(dir, "blocks")
+	metadataFile := filepath.Join(dir, "metadata.json")
+
+	store := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	assert.Nil(t, store.WriteFile("first.txt", []byte("first file")))
+	assert.Nil(t, store.WriteFile("second.txt", []byte("second file")))
+	_, err := store.DeleteFile("first.txt")
+	assert.Nil(t, err)
+
+	// the changes live in the journal until the next checkpoint
+	info, err := os.Stat(metadataFile + journalSuffix)
+	assert.Nil(t, err)
+	assert.NotZero(t, info.Size())
+
+	// a new store simulates a restart of the server without a clean shutdown
+	restarted := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	data, err := restarted.ReadFile("second.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("second file"), data)
+
+	_, err = restarted.ReadFile("first.txt")
+	assert.NotNil(t, err)
+
+	// the recovery saves a checkpoint and truncates the journal
+	info, err = os.Stat(metadataFile + journalSuffix)
+	assert.Nil(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestJournalIgnoresTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	backend := NewDiskBackend(filepath.Join(dir, "blocks"), filepath.Join(dir, "metadata.json"))
+
+	store := NewStore(backend)
+	assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+	// simulate a crash in the middle of appending a record
+	file, err := os.OpenFile(backend.journalPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0x00, 0x00, 0x01, 0x00, 0xAA, 0xBB})
+	assert.Nil(t, err)
+	file.Close()
+
+	records, err := backend.ReadJournal()
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	data, err := NewStore(backend).ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+}
+
+func TestRecoveryRemovesOrphanBlocks(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+	assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+	// a block written by an operation that crashed before the journal record was saved
+	assert.Nil(t, backend.Put("orphan.bin", []byte("lost")))
+
+	restarted := NewStore(backend)
+	data, err := restarted.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.NotContains(t, keys, "orphan.bin")
+}
+
+func TestJournalReplayFileRecord(t *testing.T) {
+	dir := t.TempDir()
+	blocksDir := filepath.Join(dir, "blocks")
+	metadataFile := filepath.Join(dir, "metadata.json")
+
+	store := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	tags := map[string]string{"env": "test"}
+	assert.Nil(t, store.WriteFileWith("owned.txt", []byte("Hello World"), WriteOptions{Owner: "DO91", Tags: tags}))
+	// the store keeps its own copy of the tags
+	tags["env"] = "changed"
+
+	_, err := store.UpdateFile("owned.txt", []byte("Hello"))
+	assert.Nil(t, err)
+	before, err := store.Stat("owned.txt")
+	assert.Nil(t, err)
+
+	restarted := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	after, err := restarted.Stat("owned.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "DO91", after.Owner)
+	assert.Equal(t, map[string]string{"env": "test"}, after.Tags)
+	assert.Equal(t, int64(5), after.Size)
+	assert.True(t, before.Created.Equal(after.Created))
+	assert.True(t, before.Modified.Equal(after.Modified))
+	assert.Equal(t, before.Checksum, after.Checksum)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryBackend keeps the blocks and the metadata in memory, the data is lost when the process exits.
+//
+// It is useful for tests and for running the server without a disk.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	journal [][]byte
+}
+
+// NewMemoryBackend creates an empty in-memory Backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]memoryObject)}
+}
+
+func (m *MemoryBackend) Put(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// copy the data, callers are free to reuse their slices
+	m.objects[key] = memoryObject{data: append([]byte{}, data...), modTime: time.Now()}
+	return nil
+}
+
+func (m *MemoryBackend) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("key=%s: %w", key, os.ErrNotExist)
+	}
+	return append([]byte{}, obj.data...), nil
+}
+
+func (m *MemoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[key]; !ok {
+		return fmt.Errorf("key=%s: %w", key, os.ErrNotExist)
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryBackend) Stat(key string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("key=%s: %w", key, os.ErrNotExist)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (m *MemoryBackend) List() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		if key == MetadataKey {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryBackend) AppendJournal(record []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.journal = append(m.journal, append([]byte{}, record...))
+	return nil
+}
+
+func (m *MemoryBackend) ReadJournal() ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	records := make([][]byte, len(m.journal))
+	copy(records, m.journal)
+	return records, nil
+}
+
+func (m *MemoryBackend) TruncateJournal() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.journal = nil
+	return nil
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// metadataVersion is the version of the metadata document saved in the checkpoint.
+//
+// Version 0 is the legacy document, a plain JSON object mapping every filename to its block IDs.
+// Version 1 maps every filename to its block IDs inside the files field.
+// Version 2 saves a FileRecord for every file, the owner and the tags of the files were
+// added later as optional fields of the same version.
+const metadataVersion = 2
+
+// FileRecord keeps the information saved in the metadata for every file.
+type FileRecord struct {
+	// Blocks is the ordered list of block IDs with the content of the file.
+	Blocks   []string  `json:"blocks"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	// Checksum identifies the content of the file, it is the hex encoded SHA-256 of the
+	// checksums of its blocks in order. Files with legacy blocks do not have a checksum.
+	Checksum string `json:"checksum,omitempty"`
+	// Owner is the ID of the client that created the file, it is empty for files
+	// created before the owner was saved or without a client.
+	Owner string `json:"owner,omitempty"`
+	// Tags are the key/value pairs supplied by the users.
+	Tags map[string]string `json:"tags,omitempty"`
+	// SizeUnknown is true when the last block of a migrated file was missing and its size
+	// could not be computed, the file can only be replaced or deleted.
+	SizeUnknown bool `json:"sizeUnknown,omitempty"`
+}
+
+// checkSize returns an error wrapping ErrBlockMissing when the size of the file is not known.
+func (r FileRecord) checkSize(filename string) error {
+	if r.SizeUnknown {
+		return fmt.Errorf("%w: the size of the file=%s is unknown", ErrBlockMissing, filename)
+	}
+	return nil
+}
+
+// Metadata maps a user-facing filename to its FileRecord.
+type Metadata map[string]FileRecord
+
+// fileChecksum returns the checksum of a file made of blocks with the given checksums,
+// it is empty when a block does not have a checksum.
+func fileChecksum(checksums []string) string {
+	hash := sha256.New()
+	for _, c := range checksums {
+		if c == "" {
+			return ""
+		}
+		hash.Write([]byte(c))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// BlockRecord keeps the information saved in the metadata for every block.
+type BlockRecord struct {
+	// RefCount is the number of references to the block from all the files,
+	// a block is removed from the backend when it reaches zero.
+	RefCount int `json:"refCount"`
+	// Checksum is the hex encoded SHA-256 of the block content, it is verified on every read.
+	// Blocks migrated from a legacy metadata file do not have a checksum.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// VolumeRecord keeps the information saved in the metadata for every volume.
+type VolumeRecord struct {
+	Size       int64 `json:"size"`
+	SectorSize int   `json:"sectorSize"`
+	// Blocks maps the index of every block size region of the volume to its block ID,
+	// the regions never written are not in the map and read as zeros.
+	Blocks map[int64]string `json:"blocks"`
+}
+
+// metadataDocument is the content of the metadata checkpoint.
+type metadataDocument struct {
+	Version int `json:"version"`
+	// BlockSize is the size of the blocks of the files and the volume regions, it is 0 in the
+	// documents saved before the block size could be configured, they used DefaultBlockSize
+	BlockSize int                     `json:"blockSize,omitempty"`
+	Files     Metadata                `json:"files"`
+	Blocks    map[string]BlockRecord  `json:"blocks"`
+	Volumes   map[string]VolumeRecord `json:"volumes,omitempty"`
+}
+
+func newMetadataDocument() *metadataDocument {
+	return &metadataDocument{
+		Version: metadataVersion,
+		Files:   make(Metadata),
+		Blocks:  make(map[string]BlockRecord),
+		Volumes: make(map[string]VolumeRecord),
+	}
+}
+
+// reference increases the reference count of every block, checksums is the
+// checksum of every block in the same order, it can be nil for legacy blocks.
+func (doc *metadataDocument) reference(blockIDs []string, checksums []string) {
+	for i, id := range blockIDs {
+		record := doc.Blocks[id]
+		record.RefCount++
+		if record.Checksum == "" && i < len(checksums) {
+			record.Checksum = checksums[i]
+		}
+		doc.Blocks[id] = record
+	}
+}
+
+// unreference decreases the reference count of every block, the blocks without
+// references are removed from the document.
+func (doc *metadataDocument) unreference(blockIDs []string) {
+	for _, id := range blockIDs {
+		record, ok := doc.Blocks[id]
+		if !ok {
+			continue
+		}
+
+		record.RefCount--
+		if record.RefCount <= 0 {
+			delete(doc.Blocks, id)
+			continue
+		}
+		doc.Blocks[id] = record
+	}
+}
+
+// loadMetadata loads the last metadata checkpoint saved in the backend.
+//
+// A checkpoint of an older version is migrated to the current document, the reference
+// count of the blocks of a legacy checkpoint is computed from the files.
+func (s *Store) loadMetadata() (*metadataDocument, error) {
+	jsonData, err := s.backend.Get(MetadataKey)
+	// create metadata file if it doesn't exist
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Metadata file does not exist, creating a new one.")
+		return newMetadataDocument(), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(jsonData, &header); err != nil || header.Version == 0 {
+		slog.Info("Migrating a legacy metadata file")
+		var legacy map[string][]string
+		if err := json.Unmarshal(jsonData, &legacy); err != nil {
+			return nil, err
+		}
+
+		doc := newMetadataDocument()
+		for _, blockIDs := range legacy {
+			doc.reference(blockIDs, nil)
+		}
+		s.migrateFiles(doc, legacy)
+		return doc, nil
+	}
+
+	if header.Version == 1 {
+		slog.Info("Migrating the metadata file to the file records", "version", header.Version)
+		var v1 struct {
+			Files   map[string][]string     `json:"files"`
+			Blocks  map[string]BlockRecord  `json:"blocks"`
+			Volumes map[string]VolumeRecord `json:"volumes"`
+		}
+		if err := json.Unmarshal(jsonData, &v1); err != nil {
+			return nil, err
+		}
+
+		doc := newMetadataDocument()
+		if v1.Blocks != nil {
+			doc.Blocks = v1.Blocks
+		}
+		if v1.Volumes != nil {
+			doc.Volumes = v1.Volumes
+		}
+		s.migrateFiles(doc, v1.Files)
+		return doc, nil
+	}
+
+	doc := &metadataDocument{}
+	if err := json.Unmarshal(jsonData, doc); err != nil {
+		return nil, err
+	}
+	if doc.Files == nil {
+		doc.Files = make(Metadata)
+	}
+	if doc.Blocks == nil {
+		doc.Blocks = make(map[string]BlockRecord)
+	}
+	if doc.Volumes == nil {
+		doc.Volumes = make(map[string]VolumeRecord)
+	}
+	return doc, nil
+}
+
+// migrateFiles creates the FileRecord of files saved only with their block IDs.
+//
+// Every block except the last one has DefaultBlockSize bytes, the legacy metadata was saved
+// before the block size could be configured. The size of the last block and the time the
+// file was saved are taken from the backend. When the last block can not be read the file
+// is migrated with SizeUnknown, the other files are not affected.
+func (s *Store) migrateFiles(doc *metadataDocument, files map[string][]string) {
+	for filename, blockIDs := range files {
+		record := FileRecord{Blocks: blockIDs}
+		if len(blockIDs) > 0 {
+			info, err := s.backend.Stat(blockIDs[len(blockIDs)-1])
+			if err != nil {
+				slog.Error("Could not read the last block of a migrated file, its size is unknown", "file", filename, "error", err)
+				record.SizeUnknown = true
+			} else {
+				record.Size = int64(len(blockIDs)-1)*DefaultBlockSize + info.Size
+				record.Created = info.ModTime
+				record.Modified = info.ModTime
+			}
+		}
+
+		checksums := make([]string, len(blockIDs))
+		for i, id := range blockIDs {
+			checksums[i] = doc.Blocks[id].Checksum
+		}
+		record.Checksum = fileChecksum(checksums)
+		doc.Files[filename] = record
+	}
+}
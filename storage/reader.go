@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// ErrReaderClosed is returned when a FileReader is used after it was closed.
+var ErrReaderClosed = errors.New("file reader already closed")
+
+// FileReader reads the content of a file one block at a time, it keeps in memory at most one block.
+//
+// The reader uses the blocks the file had when it was opened, a concurrent update or delete
+// of the file does not change the content returned. The blocks are protected from deletes
+// until the reader is closed, a FileReader must always be closed.
+//
+// A FileReader is not safe to use from multiple goroutines.
+type FileReader struct {
+	store     *Store
+	filename  string
+	ids       []string
+	checksums []string
+	size      int64
+
+	// next is the index of the next block to read, current has the unread data of the previous block
+	next    int
+	current []byte
+	closed  bool
+}
+
+// Open returns a reader of the content of a file.
+//
+// The first block is read and verified before Open returns, so a missing or corrupted
+// first block is reported by Open. The other blocks are verified when they are read,
+// an error wrapping ErrBlockMissing or ErrChecksumMismatch is returned by Read.
+func (s *Store) Open(filename string) (*FileReader, error) {
+	slog.Info("Opening file", "filename", filename)
+
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
+		return nil, err
+	}
+	record, ok := s.meta.Files[filename]
+	if !ok {
+		s.metadataMutex.Unlock()
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
+	if err := record.checkSize(filename); err != nil {
+		s.metadataMutex.Unlock()
+		return nil, err
+	}
+	s.pinBlocks(record.Blocks)
+	checksums := s.checksums(record.Blocks)
+	s.metadataMutex.Unlock()
+
+	reader := &FileReader{
+		store:     s,
+		filename:  filename,
+		ids:       record.Blocks,
+		checksums: checksums,
+		size:      record.Size,
+	}
+
+	if err := reader.readNextBlock(); err != nil && err != io.EOF {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Size returns the size of the file when it was opened.
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// Read reads the next bytes of the file, the blocks are read from the backend when they are needed.
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+
+	for len(r.current) == 0 {
+		if err := r.readNextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// WriteTo writes the rest of the file to w one block at a time, it is used by io.Copy.
+func (r *FileReader) WriteTo(w io.Writer) (int64, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+
+	var written int64
+	for {
+		if len(r.current) > 0 {
+			n, err := w.Write(r.current)
+			written += int64(n)
+			r.current = r.current[n:]
+			if err != nil {
+				return written, err
+			}
+		}
+
+		if err := r.readNextBlock(); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
+
+// readNextBlock reads and verifies the next block of the file, it returns io.EOF after the last block.
+func (r *FileReader) readNextBlock() error {
+	if r.next >= len(r.ids) {
+		return io.EOF
+	}
+
+	chunk, err := r.store.readBlock(r.ids[r.next], r.checksums[r.next])
+	if err != nil {
+		return fmt.Errorf("the file=%s can not be read: %w", r.filename, err)
+	}
+	r.next++
+	r.current = chunk
+	return nil
+}
+
+// Close releases the blocks of the file, the blocks that were removed from the file
+// while it was read are deleted when they are not used by other files.
+func (r *FileReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.current = nil
+
+	s := r.store
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	s.unpinBlocks(r.ids)
+	if errs := s.deleteBlocks(r.ids); len(errs) > 0 {
+		return fmt.Errorf("errors occurred during block deletion: %v", errs)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+
+	data := make([]byte, 2*DefaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	assert.Nil(t, store.WriteFile("data.bin", data))
+
+	reader, err := store.Open("data.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), reader.Size())
+
+	// a small buffer reads the blocks in many calls
+	head := make([]byte, 1000)
+	_, err = io.ReadFull(reader, head)
+	assert.Nil(t, err)
+	assert.Equal(t, data[:1000], head)
+
+	var rest bytes.Buffer
+	n, err := io.Copy(&rest, reader)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)-1000), n)
+	assert.Equal(t, data[1000:], rest.Bytes())
+
+	assert.Nil(t, reader.Close())
+	_, err = reader.Read(head)
+	assert.ErrorIs(t, err, ErrReaderClosed)
+
+	_, err = store.Open("missing.bin")
+	assert.NotNil(t, err)
+}
+
+func TestOpenKeepsBlocksUntilClose(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	data := make([]byte, 2*DefaultBlockSize)
+	for i := range data {
+		data[i] = byte(i % 13)
+	}
+	assert.Nil(t, store.WriteFile("data.bin", data))
+
+	reader, err := store.Open("data.bin")
+	assert.Nil(t, err)
+
+	// the file is deleted while it is read
+	_, err = store.DeleteFile("data.bin")
+	assert.Nil(t, err)
+
+	read, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	// the blocks are removed when the reader is closed
+	assert.Nil(t, reader.Close())
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestOpenVerifiesBlocks(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	first := bytes.Repeat([]byte{0x01}, DefaultBlockSize)
+	second := []byte("second block")
+	assert.Nil(t, store.WriteFile("data.bin", append(append([]byte{}, first...), second...)))
+
+	// a corrupted first block is reported by Open
+	assert.Nil(t, backend.Put(blockID(checksum(first)), []byte("corrupted")))
+	_, err := store.Open("data.bin")
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// a missing block after the first one is reported by Read
+	assert.Nil(t, backend.Put(blockID(checksum(first)), first))
+	assert.Nil(t, backend.Delete(blockID(checksum(second))))
+	reader, err := store.Open("data.bin")
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, ErrBlockMissing)
+}
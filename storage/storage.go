@@ -2,25 +2,49 @@ package storage
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
-
-	"github.com/google/uuid"
+	"time"
 )
 
 const (
-	// The fixed size for each storage block, is 256 kilobyte.
-	BlockSize = 256000
+	// DefaultBlockSize is the size of the blocks of a Store created by NewStore, is 256 kilobyte.
+	DefaultBlockSize = 256000
+	// MinBlockSize is the smallest block size allowed for a Store.
+	MinBlockSize = 4096
+	// MaxBlockSize is the biggest block size allowed for a Store.
+	MaxBlockSize = 64 << 20
+	// MaxFileSize is the biggest size of a file, WriteAt can not write after it.
+	MaxFileSize = 1 << 40
+	// MaxWriteAtGap is how far after the end of a file WriteAt can start, the gap is filled
+	// with zeros in memory before the blocks are saved.
+	MaxWriteAtGap = 64 << 20
+)
+
+var (
+	// ErrNotFound is returned when a file does not exist in the metadata.
+	ErrNotFound = errors.New("file not found")
+	// ErrBlockMissing is returned when a block referenced by the metadata does not exist in the backend.
+	ErrBlockMissing = errors.New("block missing")
+	// ErrChecksumMismatch is returned when the content of a block does not match the checksum saved in the metadata.
+	ErrChecksumMismatch = errors.New("block checksum mismatch")
+	// ErrOutOfRange is returned when a range starts after the end of the file.
+	ErrOutOfRange = errors.New("range out of file bounds")
+	// ErrBlockSizeMismatch is returned when the metadata was saved by a Store with other block size.
+	ErrBlockSizeMismatch = errors.New("block size mismatch")
 )
 
-// Default locations relative to the repository root. Can be overridden via env.
+// Default locations relative to the working directory. Can be overridden via env.
 var (
-	BlocksDirDefault    = "/Users/pablohernadez/Documents/GitHub/stgblock/blocks"
-	MetadataFileDefault = "/Users/pablohernadez/Documents/GitHub/stgblock/metadata.json"
+	BlocksDirDefault    = filepath.Join("data", "blocks")
+	MetadataFileDefault = filepath.Join("data", "metadata.json")
 )
 
 // resolvePaths determines the directories to use at runtime.
@@ -39,26 +63,161 @@ func resolvePaths() (blocksDir string, metadataFile string) {
 	return
 }
 
-var metadataMutex sync.Mutex
+// Store splits the files into blocks and keeps track of them using the metadata,
+// the blocks and the metadata are persisted in a Backend.
+//
+// Blocks are content addressed, the ID of a block is the SHA-256 of its content, so
+// identical blocks are saved once and shared by all the files that contain them.
+//
+// The metadata is loaded from the backend on the first operation and kept in memory,
+// every change is saved in the backend journal before it is visible to other operations.
+type Store struct {
+	backend       Backend
+	journal       Journal
+	blockSize     int
+	metadataMutex sync.Mutex
+
+	// meta is nil until the metadata is loaded from the backend
+	meta           *metadataDocument
+	pendingRecords int
+
+	// volumeLocks has a *sync.Mutex for every volume, it serializes the writes of a volume
+	volumeLocks sync.Map
+	// fileLocks has a *sync.Mutex for every file written with WriteAt, it serializes the writes of a file
+	fileLocks sync.Map
+	// pinnedBlocks counts the uploads and readers that use every block, see pinBlocks
+	pinnedBlocks map[string]int
+	// openUploads counts the uploads of every owner that are not committed or aborted
+	openUploads map[string]int
+}
+
+// NewStore creates a Store that saves the data in the given backend with blocks of DefaultBlockSize bytes.
+//
+// When the backend implements Journal the metadata changes are saved in the journal,
+// otherwise the full metadata is saved after every change.
+func NewStore(backend Backend) *Store {
+	journal, _ := backend.(Journal)
+	return &Store{backend: backend, journal: journal, blockSize: DefaultBlockSize}
+}
 
-// Metadata maps a user-facing filename to an ordered slice of blocks IDs.
-type Metadata map[string][]string
+// StoreOptions configures a Store created by NewStoreWithOptions.
+type StoreOptions struct {
+	// BlockSize is the size of the blocks, 0 uses DefaultBlockSize. It must be between
+	// MinBlockSize and MaxBlockSize.
+	BlockSize int
+}
 
-// WriteFile splits data into blocks and saved them concurrently.
+// NewStoreWithOptions creates a Store that saves the data in the given backend with the options.
+//
+// The block size is saved in the metadata, a Store can not load the metadata saved with
+// other block size, the operations return an error wrapping ErrBlockSizeMismatch.
+func NewStoreWithOptions(backend Backend, opts StoreOptions) (*Store, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.BlockSize < MinBlockSize || opts.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size=%d must be between %d and %d", opts.BlockSize, MinBlockSize, MaxBlockSize)
+	}
+
+	store := NewStore(backend)
+	store.blockSize = opts.BlockSize
+	return store, nil
+}
+
+// LoadMetadata loads the metadata from the backend, the operations load it when it is first
+// needed. It allows to report a metadata that can not be used when the application starts.
+func (s *Store) LoadMetadata() error {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+	return s.load()
+}
+
+// BlockSize returns the size of the blocks, every block of a file except the last one has BlockSize bytes.
+func (s *Store) BlockSize() int {
+	return s.blockSize
+}
+
+// Backend returns the backend used by the Store.
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+var (
+	defaultStoreMutex sync.Mutex
+	defaultStore      *Store
+)
+
+// Default returns the Store used by the package level functions, unless it was replaced
+// with SetDefault it saves the data on disk in the locations resolved by resolvePaths.
+func Default() *Store {
+	defaultStoreMutex.Lock()
+	defer defaultStoreMutex.Unlock()
+	if defaultStore == nil {
+		blocksDir, metadataFile := resolvePaths()
+		defaultStore = NewStore(NewDiskBackend(blocksDir, metadataFile))
+	}
+	return defaultStore
+}
+
+// SetDefault replaces the Store returned by Default, the tests use it to keep the files
+// in memory instead of the data directory.
+func SetDefault(store *Store) {
+	defaultStoreMutex.Lock()
+	defer defaultStoreMutex.Unlock()
+	defaultStore = store
+}
+
+// WriteFile saves a file using the default Store.
 func WriteFile(filename string, data []byte) error {
+	return Default().WriteFile(filename, data)
+}
+
+// ReadFile reads a file using the default Store.
+func ReadFile(filename string) ([]byte, error) {
+	return Default().ReadFile(filename)
+}
+
+// UpdateFile updates a file using the default Store.
+func UpdateFile(filename string, data []byte) ([]byte, error) {
+	return Default().UpdateFile(filename, data)
+}
+
+// DeleteFile deletes a file using the default Store.
+func DeleteFile(filename string) ([]byte, error) {
+	return Default().DeleteFile(filename)
+}
+
+// WriteOptions are the optional values saved in the metadata when a file is created.
+type WriteOptions struct {
+	// Owner is the ID of the client that creates the file.
+	Owner string
+	Tags  map[string]string
+}
+
+// WriteFile splits data into blocks and saved them concurrently.
+//
+// See WriteFileWith for details.
+func (s *Store) WriteFile(filename string, data []byte) error {
+	return s.WriteFileWith(filename, data, WriteOptions{})
+}
+
+// WriteFileWith splits data into blocks and saved them concurrently, the owner and the
+// tags of opts are saved in the metadata of the file.
+//
+// The blocks are saved before the metadata, if the process crashes before the metadata
+// is saved the blocks are removed on the next start.
+func (s *Store) WriteFileWith(filename string, data []byte, opts WriteOptions) error {
 	slog.Info("Starting file write", "filename", filename)
-	slog.Info("Attempting to write files to disk", "bytes", len(data))
-	blocksDir, _ := resolvePaths()
-	os.MkdirAll(blocksDir, 0755)
+	if err := validateTags(opts.Tags); err != nil {
+		return err
+	}
 
-	var blockIDs []string
-	var wg sync.WaitGroup
+	slog.Info("Attempting to write files to disk", "bytes", len(data))
 
 	// Review if the file was already saved
-	metadataMutex.Lock()
-	meta, err := loadMetadata()
-	if err != nil {
-		metadataMutex.Unlock()
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
 		slog.Error("An error occurred when reading the metadata from disk", "error", err)
 		return err
 	}
@@ -66,77 +225,78 @@ func WriteFile(filename string, data []byte) error {
 	// TODO: add better logic to determine if the file already exists
 	// Maybe a deep comparison of the file content?
 	// For now, we just check if the filename is already in the metadata
-	if _, exists := meta[filename]; exists {
-		metadataMutex.Unlock()
+	if _, exists := s.meta.Files[filename]; exists {
+		s.metadataMutex.Unlock()
 		slog.Info("The file already exists skipping", "file", filename)
 		return nil
 	}
 
-	metadataMutex.Unlock()
+	s.metadataMutex.Unlock()
 
-	// loop through the data in BlockSize chunks
-	for i := 0; i < len(data); i += BlockSize {
-		end := i + BlockSize
+	blocks, err := s.writeBlocks(splitBlocks(data, s.blockSize))
+	if err != nil {
+		return err
+	}
 
-		// this if is to ensure we don't read beyond the data length
-		if end > len(data) {
-			end = len(data)
-		}
-		chunk := data[i:end]
+	// Save the metadata linking the file to its blocks IDs
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
 
-		// Generate an unique ID for each chunk
-		blockID := fmt.Sprintf("%s.bin", uuid.New().String())
-		blockPath := filepath.Join(blocksDir, blockID)
-		blockIDs = append(blockIDs, blockID)
+	// another client saved the same file while the blocks were written
+	if _, exists := s.meta.Files[filename]; exists {
+		slog.Info("The file was saved by another operation, discarding blocks", "file", filename)
+		s.deleteBlocks(blockIDs(blocks))
+		return nil
+	}
 
-		wg.Add(1)
-		// Launch a goroutine to write this block concurrently
-		go func(path string, content []byte) {
-			defer wg.Done()
-			slog.Info("Writing block to disk", "path", path)
-			if err := os.WriteFile(path, content, 0644); err != nil {
-				// in a real system, you should handle this error more robustly
-				slog.Error("Error writing block to disk", "path", path, "error", err)
-			}
-		}(blockPath, chunk)
+	slog.Info("Attempting to update metadata for file", "file", filename)
+	if err := s.commitBlocks(filename, blocks, int64(len(data)), opts); err != nil {
+		s.deleteBlocks(blockIDs(blocks))
+		return err
 	}
 
-	wg.Wait()
-	slog.Info("All blocks written to disk")
-	// Save the metadata linking the file to its blocks IDs
-	return saveMetadata(filename, blockIDs)
+	slog.Info("Updated metadata for file", "file", filename)
+	return nil
 }
 
-func ReadFile(filename string) ([]byte, error) {
+// ReadFile reads all the blocks of a file and returns its content.
+//
+// Every block is verified against the checksum saved in the metadata, an error wrapping
+// ErrBlockMissing or ErrChecksumMismatch is returned instead of incomplete or corrupted data.
+func (s *Store) ReadFile(filename string) ([]byte, error) {
 	slog.Info("Reading file", "filename", filename)
-	_, _ = resolvePaths()
 
 	// 1. load the metadata to find which blocks to read
-	meta, err := loadMetadata()
-	if err != nil {
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
 		return nil, err
 	}
-	blockIDs, ok := meta[filename]
+	record, ok := s.meta.Files[filename]
+	blockIDs := record.Blocks
+	checksums := s.checksums(blockIDs)
+	s.metadataMutex.Unlock()
 	if !ok {
-		return nil, fmt.Errorf("%s file not found in metadata", filename)
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
+	if err := record.checkSize(filename); err != nil {
+		return nil, err
 	}
 
 	// create a slice to hold the data from each block
 	// this is crucial for maintaining the correct order after concurrent reads.
 	fileChunks := make([][]byte, len(blockIDs))
 	var wg sync.WaitGroup
+	errChan := make(chan error, len(blockIDs))
 
 	// 2. read all block files concurrently
 	for i, blockID := range blockIDs {
 		wg.Add(1)
 		go func(index int, id string) {
 			defer wg.Done()
-			blocksDir, _ := resolvePaths()
-			path := filepath.Join(blocksDir, id)
-			slog.Info("Reading block from disk", "path", path)
-			chunk, err := os.ReadFile(path)
+			chunk, err := s.readBlock(id, checksums[index])
 			if err != nil {
-				slog.Error("Error reading block from disk", "path", path, "error", err)
+				errChan <- err
 				return
 			}
 
@@ -145,204 +305,429 @@ func ReadFile(filename string) ([]byte, error) {
 	}
 
 	wg.Wait()
-	slog.Info("All blocks read from disk")
+	close(errChan)
+
+	// 3. never return a file with missing or corrupted blocks
+	if err := <-errChan; err != nil {
+		return nil, fmt.Errorf("the file=%s can not be read: %w", filename, err)
+	}
+	slog.Info("All blocks read from backend")
 
 	// 4. merge all chunks into a single []byte
 	fullFile := bytes.Join(fileChunks, []byte{})
 	return fullFile, nil
 }
 
-func UpdateFile(filename string, data []byte) ([]byte, error) {
-	slog.Info("Updating the chunks for", "file", filename)
-	blocksDir, _ := resolvePaths()
-
-	// load the metadata to know the blocks location
-	metadataMutex.Lock()
-	meta, err := loadMetadata()
-	if err != nil {
-		metadataMutex.Unlock()
-		slog.Error("an error occurred when reading the metadata", "error", err)
-		return nil, fmt.Errorf("an error occurred when reading the metadata error=%v", err)
+// ReadRange reads length bytes of a file starting at offset.
+//
+// Only the blocks that cover the range are read from the backend. When the range ends
+// after the end of the file the data until the end of the file is returned, an offset
+// after the end of the file returns an error wrapping ErrOutOfRange.
+func (s *Store) ReadRange(filename string, offset int64, length int) ([]byte, error) {
+	slog.Info("Reading file range", "filename", filename, "offset", offset, "length", length)
+	if offset < 0 || length < 1 {
+		return nil, fmt.Errorf("%w: offset=%d length=%d", ErrOutOfRange, offset, length)
 	}
 
-	fileIDs, exists := meta[filename]
-	if !exists {
-		metadataMutex.Unlock()
-		slog.Error("the file entry not exists on the metadata", "file", filename)
-		return nil, fmt.Errorf("the file=%s entry not exists on the metadata", filename)
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
+		return nil, err
+	}
+	record, ok := s.meta.Files[filename]
+	blockIDs := record.Blocks
+	checksums := s.checksums(blockIDs)
+	s.metadataMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
+	if err := record.checkSize(filename); err != nil {
+		return nil, err
 	}
 
-	metadataMutex.Unlock()
+	// every block except the last one has exactly blockSize bytes
+	blockSize := int64(s.blockSize)
+	firstBlock := int(offset / blockSize)
+	lastBlock := int((offset + int64(length) - 1) / blockSize)
+	if firstBlock >= len(blockIDs) {
+		return nil, fmt.Errorf("%w: offset=%d", ErrOutOfRange, offset)
+	}
+	if lastBlock >= len(blockIDs) {
+		lastBlock = len(blockIDs) - 1
+	}
 
-	// Remove the file
-	slog.Info("Removing blocks for file", "fileID", filename, "numberChunks", len(fileIDs))
+	chunks := make([][]byte, lastBlock-firstBlock+1)
 	var wg sync.WaitGroup
+	errChan := make(chan error, len(chunks))
 
-	for _, value := range fileIDs {
-		blockPath := filepath.Join(blocksDir, value)
-
+	for i := firstBlock; i <= lastBlock; i++ {
 		wg.Add(1)
-
-		go func(path string) {
+		go func(index int) {
 			defer wg.Done()
-			slog.Info("Removing block on disk", "blockId", blockPath)
-			if err := os.Remove(path); err != nil {
-				slog.Error("Error deleting block on disk", "block", path)
+			chunk, err := s.readBlock(blockIDs[index], checksums[index])
+			if err != nil {
+				errChan <- err
+				return
 			}
-		}(blockPath)
+			chunks[index-firstBlock] = chunk
+		}(i)
 	}
 
 	wg.Wait()
-	slog.Info("all blocks deleted for", "file", filename)
+	close(errChan)
 
-	// Remove block entry in metadata
-	metadataMutex.Lock()
-	delete(meta, filename)
-	err = updateMetadata(meta, filename)
-	if err != nil {
-		metadataMutex.Unlock()
-		slog.Info("The file to delete does not exists on disk or an error happens", "file", filename)
-		return nil, fmt.Errorf("failed to update metadata for file %s: %v", filename, err)
+	if err := <-errChan; err != nil {
+		return nil, fmt.Errorf("the file=%s can not be read: %w", filename, err)
 	}
-	metadataMutex.Unlock()
 
-	// WRITE the file into disk
-	err = WriteFile(filename, data)
+	// cut the bytes before the offset in the first block and after the range in the last block
+	data := bytes.Join(chunks, []byte{})
+	start := int(offset - int64(firstBlock)*blockSize)
+	if start >= len(data) {
+		return nil, fmt.Errorf("%w: offset=%d", ErrOutOfRange, offset)
+	}
 
-	return data, err
+	end := start + length
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end], nil
 }
 
-func saveMetadata(filename string, blockIDs []string) error {
-	slog.Info("Attempting to update metadata for file", "file", filename)
-	metadataMutex.Lock()
-	defer metadataMutex.Unlock()
+// FileInfo describes a file saved in the Store.
+type FileInfo struct {
+	Name     string
+	Size     int64
+	Blocks   int
+	Created  time.Time
+	Modified time.Time
+	Checksum string
+	Owner    string
+	Tags     map[string]string
+}
 
-	// Load existing metadata or create a new one if it doesn't exist
-	meta, err := loadMetadata()
-	if err != nil && !os.IsNotExist(err) {
-		return err
+// fileInfo builds the FileInfo of a file from its record.
+func fileInfo(name string, record FileRecord) FileInfo {
+	return FileInfo{
+		Name:     name,
+		Size:     record.Size,
+		Blocks:   len(record.Blocks),
+		Created:  record.Created,
+		Modified: record.Modified,
+		Checksum: record.Checksum,
+		Owner:    record.Owner,
+		Tags:     maps.Clone(record.Tags),
 	}
+}
 
-	if meta == nil {
-		meta = make(Metadata)
+// Stat returns the information of a file without reading its blocks.
+//
+// It returns an error wrapping ErrBlockMissing when the size of a migrated file is unknown.
+func (s *Store) Stat(filename string) (FileInfo, error) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return FileInfo{}, err
+	}
+	record, ok := s.meta.Files[filename]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
 	}
+	if err := record.checkSize(filename); err != nil {
+		return FileInfo{}, err
+	}
+	return fileInfo(filename, record), nil
+}
 
-	meta[filename] = blockIDs
-	jsonData, err := json.MarshalIndent(meta, "", "  ")
-	if err != nil {
-		return err
+// DefaultListLimit is the number of files returned by List when limit is not positive.
+const DefaultListLimit = 1000
+
+// List returns the files whose name starts with prefix sorted by name.
+//
+// Only the files after cursor are returned, at most limit files. The returned cursor is
+// empty when there are no more files, otherwise it is used in the next call to get the next page.
+func (s *Store) List(prefix string, cursor string, limit int) ([]FileInfo, string, error) {
+	if limit <= 0 || limit > DefaultListLimit {
+		limit = DefaultListLimit
 	}
 
-	slog.Info("Updated metadata for file", "file", filename)
-	_, metadataFile := resolvePaths()
-	return os.WriteFile(metadataFile, jsonData, 0644)
-}
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
 
-// loadMetadata loads the metadata
-func loadMetadata() (Metadata, error) {
-	_, metadataFile := resolvePaths()
-	jsonData, err := os.ReadFile(metadataFile)
-	// create metadata file if it doesn't exist
-	if os.IsNotExist(err) {
-		slog.Info("Metadata file does not exist, creating a new one.")
-		return make(Metadata), nil
+	if err := s.load(); err != nil {
+		return nil, "", err
 	}
 
-	if err != nil {
-		return nil, err
+	var names []string
+	for name := range s.meta.Files {
+		if strings.HasPrefix(name, prefix) && name > cursor {
+			names = append(names, name)
+		}
 	}
+	slices.Sort(names)
 
-	var meta Metadata
-	err = json.Unmarshal(jsonData, &meta)
-	return meta, err
+	next := ""
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+
+	files := make([]FileInfo, len(names))
+	for i, name := range names {
+		files[i] = fileInfo(name, s.meta.Files[name])
+	}
+	return files, next, nil
 }
 
-// DeleteFile deletes a file from the storage system by removing its blocks and updating metadata.
+// UpdateFile replaces the content of an existing file.
 //
-// filename is the name of the file to delete
-func DeleteFile(filename string) ([]byte, error) {
-	slog.Info("starting delete operation for file", "file", filename)
+// The new blocks are saved first, then the metadata is switched to the new blocks
+// and finally the old blocks without references are removed, a crash in any step
+// never loses the file.
+func (s *Store) UpdateFile(filename string, data []byte) ([]byte, error) {
+	slog.Info("Updating the chunks for", "file", filename)
 
-	// Validates if the file exists before delete it
-	_, err := ReadFile(filename)
-	if err != nil {
-		return nil,
-			fmt.Errorf("an error occurred while validating if the file=%s exists on disk before delete it, error=%v", filename, err)
+	// load the metadata to validate the file exists
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
+		slog.Error("an error occurred when reading the metadata", "error", err)
+		return nil, fmt.Errorf("an error occurred when reading the metadata: %w", err)
 	}
 
-	var wg sync.WaitGroup
+	if _, exists := s.meta.Files[filename]; !exists {
+		s.metadataMutex.Unlock()
+		slog.Error("the file entry not exists on the metadata", "file", filename)
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
 
-	// load the metadata to know the block address
-	metadataMutex.Lock()
-	meta, err := loadMetadata()
+	s.metadataMutex.Unlock()
+
+	// WRITE the new blocks
+	blocks, err := s.writeBlocks(splitBlocks(data, s.blockSize))
 	if err != nil {
-		metadataMutex.Unlock()
-		slog.Error("An error occurred when reading the metadata from disk", "error", err)
 		return nil, err
 	}
 
-	blocksAddr, exists := meta[filename]
+	// Switch the file to the new blocks
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	record, exists := s.meta.Files[filename]
+	oldIDs := record.Blocks
 	if !exists {
-		metadataMutex.Unlock()
-		slog.Info("The file to be deleted does not exists on disk", "file", filename)
-		return nil, fmt.Errorf("the file=%s does not exists on disk", filename)
+		s.deleteBlocks(blockIDs(blocks))
+		slog.Error("the file was deleted while it was updated", "file", filename)
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
 	}
 
-	// remove the file from metadata
-	delete(meta, filename)
-	err = updateMetadata(meta, filename)
-	if err != nil {
-		metadataMutex.Unlock()
-		slog.Info("The file to delete does not exists on disk or an error happens", "file", filename)
+	if err := s.commitBlocks(filename, blocks, int64(len(data)), WriteOptions{}); err != nil {
+		s.deleteBlocks(blockIDs(blocks))
 		return nil, fmt.Errorf("failed to update metadata for file %s: %v", filename, err)
 	}
-	metadataMutex.Unlock()
 
-	errChan := make(chan error, len(blocksAddr))
+	// Remove the old blocks, an orphan block is removed on the next start
+	slog.Info("Removing blocks for file", "fileID", filename, "numberChunks", len(oldIDs))
+	if errs := s.deleteBlocks(oldIDs); len(errs) > 0 {
+		slog.Error("Error deleting old blocks on backend", "file", filename, "errors", errs)
+	}
+	slog.Info("all old blocks deleted for", "file", filename)
 
-	blocksDir, _ := resolvePaths()
-	for _, blockID := range blocksAddr {
-		wg.Add(1)
-		blockPath := filepath.Join(blocksDir, blockID)
+	return data, nil
+}
 
-		go func(path string) {
-			defer wg.Done()
-			slog.Info("deleting the block saved in path", "path", path)
-			err := os.Remove(path)
-			if err != nil {
-				slog.Error("An error occurred deleting the file", "file", path, "error", err)
-				errChan <- fmt.Errorf("failed to delete block %s: %v", path, err)
-			}
-		}(blockPath)
+// writeAtRetries is the number of times WriteAt is retried when the file is modified concurrently.
+const writeAtRetries = 3
+
+// WriteAt writes data in an existing file starting at offset.
+//
+// Only the blocks touched by the write are saved again, the partial blocks are read,
+// modified and written as new blocks. The block IDs of the file are swapped in the
+// metadata with a single journal record. Writing after the end of the file extends
+// it, the gap between the old end and offset is filled with zeros. Writes of the same
+// file are serialized, the pipelined writes of a client often touch the same blocks.
+//
+// A write that ends after MaxFileSize or starts more than MaxWriteAtGap bytes after the
+// end of the file returns an error wrapping ErrOutOfRange.
+func (s *Store) WriteAt(filename string, offset int64, data []byte) error {
+	slog.Info("Writing file at offset", "filename", filename, "offset", offset, "bytes", len(data))
+	if offset < 0 || offset > MaxFileSize-int64(len(data)) {
+		return fmt.Errorf("%w: offset=%d", ErrOutOfRange, offset)
+	}
+	if len(data) == 0 {
+		return nil
 	}
 
-	wg.Wait()
-	close(errChan)
+	lock, _ := s.fileLocks.LoadOrStore(filename, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
 
-	// collect errors from channel
-	var deleteErrors []error
-	for err := range errChan {
-		deleteErrors = append(deleteErrors, err)
+	for attempt := 1; ; attempt++ {
+		err := s.writeAt(filename, offset, data)
+		if !errors.Is(err, errConcurrentModification) || attempt == writeAtRetries {
+			return err
+		}
+		slog.Info("The file was modified while it was written, retrying", "file", filename, "attempt", attempt)
 	}
+}
 
-	if len(deleteErrors) > 0 {
-		return nil, fmt.Errorf("errors occurred during block deletion: %v", deleteErrors)
+// errConcurrentModification is returned when the blocks of a file change while an operation is modifying them.
+var errConcurrentModification = errors.New("the file was modified by a concurrent operation")
+
+func (s *Store) writeAt(filename string, offset int64, data []byte) error {
+	s.metadataMutex.Lock()
+	if err := s.load(); err != nil {
+		s.metadataMutex.Unlock()
+		return err
+	}
+	record, ok := s.meta.Files[filename]
+	oldIDs := record.Blocks
+	checksums := s.checksums(oldIDs)
+	s.metadataMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
+	if err := record.checkSize(filename); err != nil {
+		return err
+	}
+	if offset > record.Size+MaxWriteAtGap {
+		return fmt.Errorf("%w: offset=%d is more than %d bytes after the end of the file=%s", ErrOutOfRange, offset, MaxWriteAtGap, filename)
 	}
 
-	slog.Info("All blocks were deleted for file", "file", filename)
-	return nil, nil
-}
+	numBlocks := len(oldIDs)
+	end := offset + int64(len(data))
+	blockSize := int64(s.blockSize)
+	firstBlock := int(offset / blockSize)
+	lastBlock := int((end - 1) / blockSize)
+
+	// when the write starts after the last block, the last block is padded with zeros
+	// and every block in the gap is rewritten too
+	startBlock := firstBlock
+	if numBlocks > 0 && startBlock > numBlocks-1 {
+		startBlock = numBlocks - 1
+	}
+	if numBlocks == 0 {
+		startBlock = 0
+	}
+
+	// read the existing blocks touched by the write
+	existing := make([][]byte, lastBlock-startBlock+1)
+	for i := startBlock; i <= lastBlock && i < numBlocks; i++ {
+		chunk, err := s.readBlock(oldIDs[i], checksums[i])
+		if err != nil {
+			return fmt.Errorf("the file=%s can not be read: %w", filename, err)
+		}
+		existing[i-startBlock] = chunk
+	}
+
+	// every block except the last one has blockSize bytes
+	lastFileBlock := max(numBlocks-1, lastBlock)
+	fileSize := max(record.Size, end)
+
+	// build the new content of every touched block
+	chunks := make([][]byte, len(existing))
+	for i := range chunks {
+		index := startBlock + i
+		blockStart := int64(index) * blockSize
+		blockLength := blockSize
+		if index == lastFileBlock {
+			blockLength = fileSize - blockStart
+		}
 
-func updateMetadata(meta Metadata, elem string) error {
-	slog.Info("attempting to remove one element from metadata", "file", elem)
+		chunk := make([]byte, blockLength)
+		copy(chunk, existing[i])
 
-	_, metadataFile := resolvePaths()
-	jsonData, err := json.MarshalIndent(meta, "", " ")
+		// copy the part of data that overlaps this block
+		from := max(offset, blockStart)
+		to := min(end, blockStart+blockLength)
+		if from < to {
+			copy(chunk[from-blockStart:], data[from-offset:to-offset])
+		}
+		chunks[i] = chunk
+	}
+
+	written, err := s.writeBlocks(chunks)
 	if err != nil {
-		slog.Error("An error occurred while parsing metadata to json for delete operation", "error", err)
 		return err
 	}
 
-	slog.Info("removing element from metadata", "element", elem)
-	return os.WriteFile(metadataFile, jsonData, 0644)
+	// swap the touched blocks in the list of blocks of the file
+	newBlocks := make([]block, 0, max(numBlocks, lastBlock+1))
+	for i := 0; i < startBlock; i++ {
+		newBlocks = append(newBlocks, block{id: oldIDs[i], checksum: checksums[i]})
+	}
+	newBlocks = append(newBlocks, written...)
+	for i := lastBlock + 1; i < numBlocks; i++ {
+		newBlocks = append(newBlocks, block{id: oldIDs[i], checksum: checksums[i]})
+	}
+
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	current, exists := s.meta.Files[filename]
+	if !exists || !slices.Equal(current.Blocks, oldIDs) {
+		s.deleteBlocks(blockIDs(written))
+		if !exists {
+			return fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+		}
+		return errConcurrentModification
+	}
+
+	if err := s.commitBlocks(filename, newBlocks, fileSize, WriteOptions{}); err != nil {
+		s.deleteBlocks(blockIDs(written))
+		return fmt.Errorf("failed to update metadata for file %s: %v", filename, err)
+	}
+
+	// remove the replaced blocks that are not used anymore
+	if lastBlock >= startBlock && startBlock < numBlocks {
+		replaced := oldIDs[startBlock:min(lastBlock+1, numBlocks)]
+		if errs := s.deleteBlocks(replaced); len(errs) > 0 {
+			slog.Error("Error deleting replaced blocks on backend", "file", filename, "errors", errs)
+		}
+	}
+
+	slog.Info("File written at offset", "file", filename, "blocksWritten", len(written))
+	return nil
+}
+
+// DeleteFile deletes a file from the storage system by removing its blocks and updating metadata.
+//
+// Only the blocks that are not referenced by other files are removed from the backend.
+//
+// filename is the name of the file to delete
+func (s *Store) DeleteFile(filename string) ([]byte, error) {
+	slog.Info("starting delete operation for file", "file", filename)
+
+	// load the metadata to know the block address
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		slog.Error("An error occurred when reading the metadata from disk", "error", err)
+		return nil, err
+	}
+
+	// Validates if the file exists before delete it, a file with corrupted blocks can be deleted
+	record, exists := s.meta.Files[filename]
+	blocksAddr := record.Blocks
+	if !exists {
+		slog.Info("The file to be deleted does not exists on disk", "file", filename)
+		return nil,
+			fmt.Errorf("an error occurred while validating if the file exists before delete it: %w: file=%s", ErrNotFound, filename)
+	}
+
+	// remove the file from metadata
+	err := s.commit(journalRecord{Op: journalOpDelete, Filename: filename})
+	if err != nil {
+		slog.Info("The file to delete does not exists on disk or an error happens", "file", filename)
+		return nil, fmt.Errorf("failed to update metadata for file %s: %v", filename, err)
+	}
+
+	if deleteErrors := s.deleteBlocks(blocksAddr); len(deleteErrors) > 0 {
+		return nil, fmt.Errorf("errors occurred during block deletion: %v", deleteErrors)
+	}
+
+	slog.Info("All blocks were deleted for file", "file", filename)
+	return nil, nil
 }
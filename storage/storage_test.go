@@ -2,12 +2,20 @@ package storage
 
 import (
 	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDeleteFile(t *testing.T) {
+	// the package level functions use the default store
+	SetDefault(NewStore(NewMemoryBackend()))
+
 	// Write the file before delete it
 	err := WriteFile("data.txt", []byte{0x65, 0x78, 0x61, 0x6D, 0x70, 0x6C, 0x65, 0x20, 0x72, 0x65, 0x70, 0x6F, 0x72, 0x74})
 	if err != nil {
@@ -50,6 +58,8 @@ func TestDeleteFile(t *testing.T) {
 }
 
 func TestUpdateFile(t *testing.T) {
+	SetDefault(NewStore(NewMemoryBackend()))
+
 	// =========================================================
 	// Write the file before deleting it
 	err := WriteFile("data.txt", []byte{0x65, 0x78, 0x61, 0x6D, 0x70, 0x6C, 0x65, 0x20, 0x72, 0x65, 0x70, 0x6F, 0x72, 0x74})
@@ -70,3 +80,461 @@ func TestUpdateFile(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []byte{0x65, 0x78, 0x61, 0x6D, 0x70, 0x6C, 0x65, 0x20, 0x72, 0x65, 0x70, 0x6F, 0x72, 0x74, 0x76, 0x32}, updatedData)
 }
+
+func TestDeduplicatedBlocks(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	// two blocks with the same content and one different block
+	block := make([]byte, DefaultBlockSize)
+	for i := range block {
+		block[i] = byte(i % 7)
+	}
+	first := append(append([]byte{}, block...), block...)
+	second := append(append([]byte{}, block...), []byte("different tail")...)
+
+	assert.Nil(t, store.WriteFile("first.bin", first))
+	assert.Nil(t, store.WriteFile("second.bin", second))
+
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, 3, store.meta.Blocks[blockID(checksum(block))].RefCount)
+
+	// the shared block is kept while other file references it
+	_, err = store.DeleteFile("first.bin")
+	assert.Nil(t, err)
+
+	data, err := store.ReadFile("second.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, second, data)
+	assert.Equal(t, 1, store.meta.Blocks[blockID(checksum(block))].RefCount)
+
+	_, err = store.DeleteFile("second.bin")
+	assert.Nil(t, err)
+
+	keys, err = backend.List()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestLoadLegacyMetadata(t *testing.T) {
+	backend := NewMemoryBackend()
+	assert.Nil(t, backend.Put("19260c6a-531e-40b8-abcb-b50c2ddb5e7f.bin", []byte("Hello World")))
+	assert.Nil(t, backend.Put(MetadataKey, []byte(`{"data.txt": ["19260c6a-531e-40b8-abcb-b50c2ddb5e7f.bin"]}`)))
+
+	store := NewStore(backend)
+	data, err := store.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+	assert.Equal(t, 1, store.meta.Blocks["19260c6a-531e-40b8-abcb-b50c2ddb5e7f.bin"].RefCount)
+
+	// the size of a migrated file is computed from its blocks
+	info, err := store.Stat("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.Equal(t, 1, info.Blocks)
+	assert.False(t, info.Modified.IsZero())
+	assert.Empty(t, info.Checksum)
+}
+
+func TestLoadLegacyMetadataMissingBlock(t *testing.T) {
+	backend := NewMemoryBackend()
+	assert.Nil(t, backend.Put("19260c6a-531e-40b8-abcb-b50c2ddb5e7f.bin", []byte("Hello World")))
+	assert.Nil(t, backend.Put(MetadataKey, []byte(`{
+		"data.txt": ["19260c6a-531e-40b8-abcb-b50c2ddb5e7f.bin"],
+		"lost.txt": ["7d0f3a52-8c5e-4b9e-9a3c-6f1e2b4d8a10.bin"]
+	}`)))
+
+	// a file with a missing last block does not stop the other files from loading
+	store := NewStore(backend)
+	assert.Nil(t, store.LoadMetadata())
+	data, err := store.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+
+	// the size of the file is unknown, it is reported as corrupted instead of a wrong size
+	_, err = store.Stat("lost.txt")
+	assert.ErrorIs(t, err, ErrBlockMissing)
+	_, err = store.ReadFile("lost.txt")
+	assert.ErrorIs(t, err, ErrBlockMissing)
+	_, err = store.Open("lost.txt")
+	assert.ErrorIs(t, err, ErrBlockMissing)
+	_, err = store.ReadRange("lost.txt", 0, 1)
+	assert.ErrorIs(t, err, ErrBlockMissing)
+	assert.ErrorIs(t, store.WriteAt("lost.txt", 0, []byte("data")), ErrBlockMissing)
+
+	// replacing the content of the file repairs it
+	_, err = store.UpdateFile("lost.txt", []byte("Hello"))
+	assert.Nil(t, err)
+	info, err := store.Stat("lost.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size)
+}
+
+func TestLoadVersion1Metadata(t *testing.T) {
+	content := []byte("Hello World")
+	id := blockID(checksum(content))
+
+	backend := NewMemoryBackend()
+	assert.Nil(t, backend.Put(id, content))
+	assert.Nil(t, backend.Put(MetadataKey, []byte(`{
+		"version": 1,
+		"files": {"data.txt": ["`+id+`"]},
+		"blocks": {"`+id+`": {"refCount": 1, "checksum": "`+checksum(content)+`"}}
+	}`)))
+
+	store := NewStore(backend)
+	info, err := store.Stat("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.Equal(t, fileChecksum([]string{checksum(content)}), info.Checksum)
+
+	data, err := store.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestStatAndList(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	for _, name := range []string{"logs/b.txt", "logs/a.txt", "data.txt", "logs/c.txt"} {
+		assert.Nil(t, store.WriteFile(name, []byte(name)))
+	}
+
+	info, err := store.Stat("logs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), info.Size)
+	assert.Equal(t, 1, info.Blocks)
+	assert.Equal(t, info.Created, info.Modified)
+
+	// an update keeps the creation time and changes the checksum
+	_, err = store.UpdateFile("logs/a.txt", []byte("new content"))
+	assert.Nil(t, err)
+	updated, err := store.Stat("logs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, info.Created, updated.Created)
+	assert.Equal(t, int64(11), updated.Size)
+	assert.NotEqual(t, info.Checksum, updated.Checksum)
+
+	_, err = store.Stat("missing.txt")
+	assert.NotNil(t, err)
+
+	files, next, err := store.List("logs/", "", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "logs/b.txt", next)
+	assert.Equal(t, []string{"logs/a.txt", "logs/b.txt"}, []string{files[0].Name, files[1].Name})
+
+	files, next, err = store.List("logs/", next, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, next)
+	assert.Len(t, files, 1)
+	assert.Equal(t, "logs/c.txt", files[0].Name)
+}
+
+func TestReadFileVerifiesBlocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(backend Backend, id string)
+		wantErr error
+	}{
+		{
+			name: "error when the block content changed",
+			corrupt: func(backend Backend, id string) {
+				backend.Put(id, []byte("Hello Wxrld"))
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "error when the block does not exist",
+			corrupt: func(backend Backend, id string) {
+				backend.Delete(id)
+			},
+			wantErr: ErrBlockMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			store := NewStore(backend)
+			assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+			tt.corrupt(backend, blockID(checksum([]byte("Hello World"))))
+
+			data, err := store.ReadFile("data.txt")
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Nil(t, data)
+
+			// a corrupted file can still be deleted
+			_, err = store.DeleteFile("data.txt")
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	data := make([]byte, 3*DefaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	assert.Nil(t, store.WriteFile("big-file.bin", data))
+
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int
+		want    []byte
+		wantErr error
+	}{
+		{
+			name:   "range inside one block",
+			offset: 10,
+			length: 20,
+			want:   data[10:30],
+		},
+		{
+			name:   "range across blocks",
+			offset: DefaultBlockSize - 5,
+			length: DefaultBlockSize + 10,
+			want:   data[DefaultBlockSize-5 : 2*DefaultBlockSize+5],
+		},
+		{
+			name:   "range after the end of the file is truncated",
+			offset: 3*DefaultBlockSize + 90,
+			length: 50,
+			want:   data[3*DefaultBlockSize+90:],
+		},
+		{
+			name:    "error when offset is after the end of the file",
+			offset:  3*DefaultBlockSize + 100,
+			length:  1,
+			wantErr: ErrOutOfRange,
+		},
+		{
+			name:    "error when offset is after the last block",
+			offset:  10 * DefaultBlockSize,
+			length:  1,
+			wantErr: ErrOutOfRange,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.ReadRange("big-file.bin", tt.offset, tt.length)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	original := make([]byte, 2*DefaultBlockSize+100)
+	for i := range original {
+		original[i] = byte(i % 241)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		data   []byte
+		// changedBlocks is the index of the blocks that must have a new ID
+		changedBlocks []int
+	}{
+		{
+			name:          "write inside one block",
+			offset:        DefaultBlockSize + 10,
+			data:          []byte("patched"),
+			changedBlocks: []int{1},
+		},
+		{
+			name:          "write across two blocks",
+			offset:        DefaultBlockSize - 3,
+			data:          []byte("patched"),
+			changedBlocks: []int{0, 1},
+		},
+		{
+			name:          "write extends the last block",
+			offset:        2*DefaultBlockSize + 95,
+			data:          []byte("patched"),
+			changedBlocks: []int{2},
+		},
+		{
+			name:          "write after the end fills the gap with zeros",
+			offset:        4*DefaultBlockSize + 5,
+			data:          []byte("patched"),
+			changedBlocks: []int{2, 3, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore(NewMemoryBackend())
+			assert.Nil(t, store.WriteFile("big-file.bin", original))
+			before := append([]string{}, store.meta.Files["big-file.bin"].Blocks...)
+
+			assert.Nil(t, store.WriteAt("big-file.bin", tt.offset, tt.data))
+
+			// build the expected content
+			end := int(tt.offset) + len(tt.data)
+			want := make([]byte, max(len(original), end))
+			copy(want, original)
+			copy(want[tt.offset:], tt.data)
+
+			got, err := store.ReadFile("big-file.bin")
+			assert.Nil(t, err)
+			assert.Equal(t, want, got)
+
+			after := store.meta.Files["big-file.bin"].Blocks
+			for i := range before {
+				if slices.Contains(tt.changedBlocks, i) {
+					assert.NotEqual(t, before[i], after[i], "block %d must be rewritten", i)
+				} else {
+					assert.Equal(t, before[i], after[i], "block %d must not be rewritten", i)
+				}
+			}
+		})
+	}
+}
+
+// slowBackend delays the writes of blocks, the concurrent operations overlap.
+type slowBackend struct {
+	*MemoryBackend
+}
+
+func (b slowBackend) Put(key string, data []byte) error {
+	time.Sleep(time.Millisecond)
+	return b.MemoryBackend.Put(key, data)
+}
+
+func TestWriteAtConcurrent(t *testing.T) {
+	store := NewStore(slowBackend{NewMemoryBackend()})
+	assert.Nil(t, store.WriteFile("shared.bin", make([]byte, 64)))
+
+	// the writes touch the same block, none of them fails with a concurrent modification
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, store.WriteAt("shared.bin", int64(i), []byte{byte(i + 1)}))
+		}()
+	}
+	wg.Wait()
+
+	got, err := store.ReadFile("shared.bin")
+	assert.Nil(t, err)
+	for i, b := range got {
+		assert.Equal(t, byte(i+1), b)
+	}
+}
+
+func TestWriteAtFileNotFound(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	err := store.WriteAt("missing.bin", 0, []byte("data"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileNotFound(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+
+	_, err := store.ReadFile("missing.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.ReadRange("missing.bin", 0, 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Stat("missing.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Open("missing.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Tags("missing.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.DeleteFile("missing.bin")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestWriteAtOutOfRange(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{name: "negative offset", offset: -1},
+		{name: "offset overflows the end", offset: math.MaxInt64 - 2},
+		{name: "end after the max file size", offset: MaxFileSize - 5},
+		{name: "gap bigger than the limit", offset: 11 + MaxWriteAtGap + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.WriteAt("data.txt", tt.offset, []byte("0123456789"))
+			assert.ErrorIs(t, err, ErrOutOfRange)
+		})
+	}
+
+	data, err := store.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+}
+
+func TestSetTags(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	assert.Nil(t, store.WriteFileWith("data.txt", []byte("Hello World"), WriteOptions{Tags: map[string]string{"team": "ingest"}}))
+	before, err := store.Stat("data.txt")
+	assert.Nil(t, err)
+
+	tags, err := store.SetTags("data.txt", map[string]string{"retention": "30d", "team": ""})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"retention": "30d"}, tags)
+
+	// the tags are changed without rewriting the blocks
+	after, err := store.Stat("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, before.Checksum, after.Checksum)
+	assert.Equal(t, before.Modified, after.Modified)
+	assert.Equal(t, map[string]string{"retention": "30d"}, after.Tags)
+
+	_, err = store.SetTags("data.txt", map[string]string{"": "value"})
+	assert.ErrorIs(t, err, ErrInvalidTags)
+	_, err = store.SetTags("data.txt", map[string]string{"key": strings.Repeat("v", MaxTagValueLength+1)})
+	assert.ErrorIs(t, err, ErrInvalidTags)
+	assert.ErrorIs(t, store.WriteFileWith("other.txt", []byte("data"), WriteOptions{Tags: map[string]string{"": "x"}}), ErrInvalidTags)
+
+	_, err = store.SetTags("missing.txt", map[string]string{"team": "ingest"})
+	assert.NotNil(t, err)
+}
+
+func TestStoreBlockSize(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewStoreWithOptions(backend, StoreOptions{BlockSize: MinBlockSize})
+	assert.Nil(t, err)
+	assert.Equal(t, MinBlockSize, store.BlockSize())
+
+	data := make([]byte, 3*MinBlockSize+10)
+	for i := range data {
+		data[i] = byte(i % 199)
+	}
+	assert.Nil(t, store.WriteFile("small-blocks.bin", data))
+	info, err := store.Stat("small-blocks.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, info.Blocks)
+
+	read, err := store.ReadRange("small-blocks.bin", MinBlockSize-5, MinBlockSize+10)
+	assert.Nil(t, err)
+	assert.Equal(t, data[MinBlockSize-5:2*MinBlockSize+5], read)
+
+	// a store with other block size can not use the metadata
+	other := NewStore(backend)
+	_, err = other.ReadFile("small-blocks.bin")
+	assert.ErrorIs(t, err, ErrBlockSizeMismatch)
+
+	_, err = NewStoreWithOptions(backend, StoreOptions{BlockSize: MinBlockSize - 1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+)
+
+const (
+	// MaxTags is the maximum number of tags of a file.
+	MaxTags = 64
+	// MaxTagKeyLength is the maximum length in bytes of a tag key.
+	MaxTagKeyLength = 128
+	// MaxTagValueLength is the maximum length in bytes of a tag value.
+	MaxTagValueLength = 1024
+)
+
+// ErrInvalidTags is returned when the tags of a file exceed the limits.
+var ErrInvalidTags = errors.New("invalid tags")
+
+// validateTags validates the tags saved for a file.
+func validateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%w: a file can have at most %d tags", ErrInvalidTags, MaxTags)
+	}
+	for key, value := range tags {
+		if key == "" || len(key) > MaxTagKeyLength {
+			return fmt.Errorf("%w: the key=%.32q must have between 1 and %d bytes", ErrInvalidTags, key, MaxTagKeyLength)
+		}
+		if len(value) > MaxTagValueLength {
+			return fmt.Errorf("%w: the value of the key=%s can have at most %d bytes", ErrInvalidTags, key, MaxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// Tags returns the tags of a file.
+func (s *Store) Tags(filename string) (map[string]string, error) {
+	info, err := s.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return info.Tags, nil
+}
+
+// SetTags adds tags to a file without rewriting its blocks and returns all the tags of the file.
+//
+// A tag with an empty value removes the key from the tags of the file.
+func (s *Store) SetTags(filename string, tags map[string]string) (map[string]string, error) {
+	slog.Info("Setting file tags", "file", filename, "tags", len(tags))
+
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	record, ok := s.meta.Files[filename]
+	if !ok {
+		return nil, fmt.Errorf("%w: file=%s", ErrNotFound, filename)
+	}
+
+	merged := maps.Clone(record.Tags)
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	for key, value := range tags {
+		if value == "" {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = value
+	}
+	if err := validateTags(merged); err != nil {
+		return nil, err
+	}
+
+	// the record has all the tags of the file, replaying it twice gives the same tags
+	if err := s.commit(journalRecord{Op: journalOpTags, Filename: filename, Tags: merged}); err != nil {
+		return nil, fmt.Errorf("failed to update metadata for file %s: %v", filename, err)
+	}
+	return maps.Clone(merged), nil
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+)
+
+// MaxUploadsPerOwner is the number of uploads that an owner can keep open at the same time.
+const MaxUploadsPerOwner = 16
+
+var (
+	// ErrFileExists is returned when an upload is created or committed for a file that already exists.
+	ErrFileExists = errors.New("file already exists")
+	// ErrUploadClosed is returned when an upload is used after it was committed or aborted.
+	ErrUploadClosed = errors.New("upload already closed")
+	// ErrTooManyUploads is returned when an upload is created and the owner already has MaxUploadsPerOwner open.
+	ErrTooManyUploads = errors.New("too many open uploads")
+)
+
+// Upload writes a file that is received in chunks, it keeps in memory at most one block.
+// The block buffer is allocated when the first chunk is written.
+//
+// Every time the received data fills a block the block is saved in the backend, the file
+// is added to the metadata only when the upload is committed. The blocks of an upload are
+// protected from the deletes of other files until the upload is committed or aborted, if
+// the process crashes before the commit they are removed on the next start.
+//
+// The methods of an Upload are safe to call from multiple goroutines.
+type Upload struct {
+	store    *Store
+	filename string
+	opts     WriteOptions
+
+	mu     sync.Mutex
+	buffer []byte
+	blocks []block
+	size   int64
+	closed bool
+}
+
+// CreateUpload starts the upload of a new file, the owner and the tags of opts are saved
+// in the metadata of the file when the upload is committed.
+//
+// It returns an error wrapping ErrFileExists when the file is already saved, and an error
+// wrapping ErrTooManyUploads when the owner has MaxUploadsPerOwner uploads that are not
+// committed or aborted.
+func (s *Store) CreateUpload(filename string, opts WriteOptions) (*Upload, error) {
+	slog.Info("Starting file upload", "file", filename)
+	if err := validateTags(opts.Tags); err != nil {
+		return nil, err
+	}
+
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		slog.Error("An error occurred when reading the metadata from disk", "error", err)
+		return nil, err
+	}
+	if _, exists := s.meta.Files[filename]; exists {
+		return nil, fmt.Errorf("%w: file=%s", ErrFileExists, filename)
+	}
+	if s.openUploads[opts.Owner] >= MaxUploadsPerOwner {
+		return nil, fmt.Errorf("%w: owner=%s", ErrTooManyUploads, opts.Owner)
+	}
+	if s.openUploads == nil {
+		s.openUploads = make(map[string]int)
+	}
+	s.openUploads[opts.Owner]++
+
+	opts.Tags = maps.Clone(opts.Tags)
+	return &Upload{store: s, filename: filename, opts: opts}, nil
+}
+
+// Filename returns the name of the file saved by the upload.
+func (u *Upload) Filename() string {
+	return u.filename
+}
+
+// Owner returns the ID of the client that created the upload.
+func (u *Upload) Owner() string {
+	return u.opts.Owner
+}
+
+// Size returns the number of bytes received by the upload.
+func (u *Upload) Size() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.size
+}
+
+// Write appends p to the file, every full block is saved in the backend before Write returns.
+func (u *Upload) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return 0, ErrUploadClosed
+	}
+	// the buffer is allocated with the first chunk, an upload without data does not use memory
+	if u.buffer == nil && len(p) > 0 {
+		u.buffer = make([]byte, 0, u.store.blockSize)
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(u.store.blockSize-len(u.buffer), len(p)-written)
+		u.buffer = append(u.buffer, p[written:written+n]...)
+		written += n
+		u.size += int64(n)
+
+		if len(u.buffer) == u.store.blockSize {
+			if err := u.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush saves the buffered data as a block.
+//
+// The block is protected before it is written, a concurrent delete of a file with the same
+// content can not remove it between the write and the commit.
+//
+// The caller must hold the upload mutex.
+func (u *Upload) flush() error {
+	s := u.store
+	sum := checksum(u.buffer)
+	id := blockID(sum)
+
+	s.metadataMutex.Lock()
+	s.pinBlocks([]string{id})
+	referenced := s.meta.Blocks[id].RefCount > 0
+	s.metadataMutex.Unlock()
+
+	if referenced {
+		slog.Info("Block already saved, skipping write", "blockID", id)
+	} else {
+		slog.Info("Writing upload block to backend", "file", u.filename, "blockID", id)
+		if err := s.backend.Put(id, u.buffer); err != nil {
+			slog.Error("Error writing block to backend", "blockID", id, "error", err)
+			s.metadataMutex.Lock()
+			s.unpinBlocks([]string{id})
+			s.deleteBlocks([]string{id})
+			s.metadataMutex.Unlock()
+			return fmt.Errorf("failed to write block %s: %v", id, err)
+		}
+	}
+
+	u.blocks = append(u.blocks, block{id: id, checksum: sum})
+	u.buffer = u.buffer[:0]
+	return nil
+}
+
+// Commit saves the remaining data and adds the file to the metadata, the file is visible
+// to the other operations after Commit returns.
+//
+// It returns an error wrapping ErrFileExists when another operation saved the file while
+// it was uploaded, the blocks of the upload are removed in that case.
+func (u *Upload) Commit() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return ErrUploadClosed
+	}
+	u.close()
+
+	// the last block can be smaller, an empty file has no blocks
+	if len(u.buffer) > 0 {
+		if err := u.flush(); err != nil {
+			u.discard()
+			return err
+		}
+	}
+
+	s := u.store
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	ids := blockIDs(u.blocks)
+	s.unpinBlocks(ids)
+
+	if _, exists := s.meta.Files[u.filename]; exists {
+		slog.Info("The file was saved by another operation, discarding the upload", "file", u.filename)
+		s.deleteBlocks(ids)
+		return fmt.Errorf("%w: file=%s", ErrFileExists, u.filename)
+	}
+
+	if err := s.commitBlocks(u.filename, u.blocks, u.size, u.opts); err != nil {
+		s.deleteBlocks(ids)
+		return err
+	}
+
+	slog.Info("Upload committed", "file", u.filename, "bytes", u.size, "blocks", len(u.blocks))
+	return nil
+}
+
+// Abort discards the upload and removes the blocks that are not used by other files.
+//
+// Aborting an upload that is already closed does nothing.
+func (u *Upload) Abort() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil
+	}
+	u.close()
+
+	slog.Info("Aborting file upload", "file", u.filename, "bytes", u.size)
+	if errs := u.discard(); len(errs) > 0 {
+		return fmt.Errorf("errors occurred during block deletion: %v", errs)
+	}
+	return nil
+}
+
+// close marks the upload as closed and releases its place in the open uploads of the owner.
+//
+// The caller must hold the upload mutex.
+func (u *Upload) close() {
+	u.closed = true
+
+	s := u.store
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+	s.openUploads[u.opts.Owner]--
+	if s.openUploads[u.opts.Owner] == 0 {
+		delete(s.openUploads, u.opts.Owner)
+	}
+}
+
+// discard removes the blocks saved by the upload.
+//
+// The caller must hold the upload mutex.
+func (u *Upload) discard() []error {
+	s := u.store
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	ids := blockIDs(u.blocks)
+	s.unpinBlocks(ids)
+	u.blocks = nil
+	u.buffer = nil
+	return s.deleteBlocks(ids)
+}
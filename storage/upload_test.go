@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadCommit(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	data := make([]byte, 2*DefaultBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	upload, err := store.CreateUpload("upload.bin", WriteOptions{Owner: "client-01", Tags: map[string]string{"team": "ingest"}})
+	assert.Nil(t, err)
+
+	// the chunks do not need to be aligned with the blocks
+	for offset := 0; offset < len(data); offset += 70000 {
+		end := min(offset+70000, len(data))
+		n, err := upload.Write(data[offset:end])
+		assert.Nil(t, err)
+		assert.Equal(t, end-offset, n)
+	}
+	assert.Equal(t, int64(len(data)), upload.Size())
+
+	// the full blocks are saved while the data arrives, the file is not visible yet
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	_, err = store.Stat("upload.bin")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, upload.Commit())
+	assert.ErrorIs(t, upload.Commit(), ErrUploadClosed)
+	_, err = upload.Write([]byte("more"))
+	assert.ErrorIs(t, err, ErrUploadClosed)
+
+	read, err := store.ReadFile("upload.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	info, err := store.Stat("upload.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, 3, info.Blocks)
+	assert.Equal(t, "client-01", info.Owner)
+	assert.Equal(t, map[string]string{"team": "ingest"}, info.Tags)
+
+	// a file written in one message has the same checksum
+	assert.Nil(t, store.WriteFile("write.bin", data))
+	written, err := store.Stat("write.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, written.Checksum, info.Checksum)
+
+	_, err = store.CreateUpload("upload.bin", WriteOptions{})
+	assert.ErrorIs(t, err, ErrFileExists)
+}
+
+func TestUploadEmptyFile(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+
+	upload, err := store.CreateUpload("empty.txt", WriteOptions{})
+	assert.Nil(t, err)
+	// the block buffer is allocated only when data is written
+	assert.Nil(t, upload.buffer)
+	assert.Nil(t, upload.Commit())
+
+	info, err := store.Stat("empty.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size)
+	assert.Equal(t, 0, info.Blocks)
+}
+
+func TestUploadAbort(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	block := make([]byte, DefaultBlockSize)
+	for i := range block {
+		block[i] = byte(i % 13)
+	}
+	assert.Nil(t, store.WriteFile("shared.bin", block))
+
+	upload, err := store.CreateUpload("upload.bin", WriteOptions{})
+	assert.Nil(t, err)
+	_, err = upload.Write(block)
+	assert.Nil(t, err)
+	_, err = upload.Write([]byte("different tail that fills the second block"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, upload.Abort())
+	assert.Nil(t, upload.Abort())
+	assert.ErrorIs(t, upload.Commit(), ErrUploadClosed)
+
+	// the shared block is kept and the file is never visible
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{blockID(checksum(block))}, keys)
+	_, err = store.Stat("upload.bin")
+	assert.NotNil(t, err)
+}
+
+func TestUploadBlocksSurviveDeletes(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	block := make([]byte, DefaultBlockSize)
+	for i := range block {
+		block[i] = byte(i % 17)
+	}
+	assert.Nil(t, store.WriteFile("shared.bin", block))
+
+	upload, err := store.CreateUpload("upload.bin", WriteOptions{})
+	assert.Nil(t, err)
+	_, err = upload.Write(block)
+	assert.Nil(t, err)
+
+	// the only file that references the block is removed before the commit
+	_, err = store.DeleteFile("shared.bin")
+	assert.Nil(t, err)
+
+	assert.Nil(t, upload.Commit())
+	data, err := store.ReadFile("upload.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, block, data)
+}
+
+func TestUploadCommitFileExists(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	upload, err := store.CreateUpload("data.txt", WriteOptions{})
+	assert.Nil(t, err)
+	_, err = upload.Write([]byte("uploaded content"))
+	assert.Nil(t, err)
+
+	// another operation saves the file while it is uploaded
+	assert.Nil(t, store.WriteFile("data.txt", []byte("Hello World")))
+
+	assert.ErrorIs(t, upload.Commit(), ErrFileExists)
+	data, err := store.ReadFile("data.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Hello World"), data)
+
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+}
+
+func TestUploadLimitPerOwner(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+
+	uploads := make([]*Upload, MaxUploadsPerOwner)
+	for i := range uploads {
+		var err error
+		uploads[i], err = store.CreateUpload(fmt.Sprintf("file-%d.txt", i), WriteOptions{Owner: "client-01"})
+		assert.Nil(t, err)
+	}
+	_, err := store.CreateUpload("other.txt", WriteOptions{Owner: "client-01"})
+	assert.ErrorIs(t, err, ErrTooManyUploads)
+
+	// the limit is counted for every owner
+	_, err = store.CreateUpload("other.txt", WriteOptions{Owner: "client-02"})
+	assert.Nil(t, err)
+
+	// a committed or aborted upload releases its place, closing it again does not
+	assert.Nil(t, uploads[0].Commit())
+	assert.Nil(t, uploads[1].Abort())
+	assert.Nil(t, uploads[1].Abort())
+	for _, name := range []string{"other-1.txt", "other-2.txt"} {
+		_, err = store.CreateUpload(name, WriteOptions{Owner: "client-01"})
+		assert.Nil(t, err)
+	}
+	_, err = store.CreateUpload("other-3.txt", WriteOptions{Owner: "client-01"})
+	assert.ErrorIs(t, err, ErrTooManyUploads)
+}
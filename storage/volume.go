@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+)
+
+const (
+	// MinSectorSize is the smallest sector size allowed for a volume.
+	MinSectorSize = 512
+	// MaxSectorSize is the biggest sector size allowed for a volume.
+	MaxSectorSize = 65536
+	// MaxVolumeReadLength is the biggest read of a volume in bytes, the data is returned in memory.
+	MaxVolumeReadLength = 64 << 20
+)
+
+var (
+	// ErrVolumeNotFound is returned when the volume does not exist in the metadata.
+	ErrVolumeNotFound = errors.New("volume not found")
+	// ErrVolumeExists is returned when a volume is created with the name of an existing volume.
+	ErrVolumeExists = errors.New("volume already exists")
+	// ErrInvalidVolume is returned when a volume is created with an invalid size or sector size.
+	ErrInvalidVolume = errors.New("invalid volume")
+)
+
+// VolumeInfo describes a volume saved in the Store.
+type VolumeInfo struct {
+	Name       string
+	Size       int64
+	SectorSize int
+	// AllocatedBlocks is the number of regions of the volume that were written.
+	AllocatedBlocks int
+}
+
+// Sectors returns the number of sectors of the volume.
+func (v VolumeInfo) Sectors() uint64 {
+	return uint64(v.Size / int64(v.SectorSize))
+}
+
+// CreateVolume creates a thin provisioned volume of size bytes addressed by sectors of sectorSize bytes.
+//
+// The volume does not use space in the backend until it is written, the sector size must be a
+// power of two between MinSectorSize and MaxSectorSize, and size must be a multiple of the sector size.
+func (s *Store) CreateVolume(name string, size int64, sectorSize int) error {
+	slog.Info("Creating volume", "volume", name, "size", size, "sectorSize", sectorSize)
+	if sectorSize < MinSectorSize || sectorSize > MaxSectorSize || sectorSize&(sectorSize-1) != 0 {
+		return fmt.Errorf("%w: sector size=%d must be a power of two between %d and %d", ErrInvalidVolume, sectorSize, MinSectorSize, MaxSectorSize)
+	}
+	if size < 1 || size%int64(sectorSize) != 0 {
+		return fmt.Errorf("%w: size=%d must be a positive multiple of the sector size=%d", ErrInvalidVolume, size, sectorSize)
+	}
+
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, exists := s.meta.Volumes[name]; exists {
+		return fmt.Errorf("%w: volume=%s", ErrVolumeExists, name)
+	}
+
+	return s.commit(journalRecord{Op: journalOpVolumeCreate, Filename: name, Size: size, SectorSize: sectorSize})
+}
+
+// Volume returns the information of a volume.
+func (s *Store) Volume(name string) (VolumeInfo, error) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return VolumeInfo{}, err
+	}
+	volume, exists := s.meta.Volumes[name]
+	if !exists {
+		return VolumeInfo{}, fmt.Errorf("%w: volume=%s", ErrVolumeNotFound, name)
+	}
+
+	return VolumeInfo{
+		Name:            name,
+		Size:            volume.Size,
+		SectorSize:      volume.SectorSize,
+		AllocatedBlocks: len(volume.Blocks),
+	}, nil
+}
+
+// Volumes returns the information of all the volumes sorted by name.
+func (s *Store) Volumes() ([]VolumeInfo, error) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	volumes := make([]VolumeInfo, 0, len(s.meta.Volumes))
+	for _, name := range slices.Sorted(maps.Keys(s.meta.Volumes)) {
+		volume := s.meta.Volumes[name]
+		volumes = append(volumes, VolumeInfo{
+			Name:            name,
+			Size:            volume.Size,
+			SectorSize:      volume.SectorSize,
+			AllocatedBlocks: len(volume.Blocks),
+		})
+	}
+	return volumes, nil
+}
+
+// DeleteVolume deletes a volume and the blocks that are not referenced by other files or volumes.
+func (s *Store) DeleteVolume(name string) error {
+	slog.Info("Deleting volume", "volume", name)
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	volume, exists := s.meta.Volumes[name]
+	if !exists {
+		return fmt.Errorf("%w: volume=%s", ErrVolumeNotFound, name)
+	}
+
+	if err := s.commit(journalRecord{Op: journalOpVolumeDelete, Filename: name}); err != nil {
+		return fmt.Errorf("failed to update metadata for volume %s: %v", name, err)
+	}
+
+	if errs := s.deleteBlocks(slices.Collect(maps.Values(volume.Blocks))); len(errs) > 0 {
+		return fmt.Errorf("errors occurred during block deletion: %v", errs)
+	}
+	return nil
+}
+
+// volumeRange validates that count sectors starting at lba are inside the volume
+// and returns the range in bytes.
+func volumeRange(volume VolumeRecord, lba uint64, count uint64) (int64, int64, error) {
+	sectors := uint64(volume.Size / int64(volume.SectorSize))
+	if count == 0 || lba >= sectors || count > sectors-lba {
+		return 0, 0, fmt.Errorf("%w: lba=%d sectors=%d volume sectors=%d", ErrOutOfRange, lba, count, sectors)
+	}
+
+	offset := int64(lba) * int64(volume.SectorSize)
+	return offset, int64(count) * int64(volume.SectorSize), nil
+}
+
+// volumeRegions validates the range of a volume operation and returns the volume, the range
+// in bytes and the blocks of the allocated regions touched by the range.
+//
+// The range is count sectors for a read, or the sectors in dataLength bytes for a write.
+func (s *Store) volumeRegions(name string, lba uint64, count uint64, dataLength int) (VolumeRecord, int64, int64, map[int64]block, error) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	if err := s.load(); err != nil {
+		return VolumeRecord{}, 0, 0, nil, err
+	}
+	volume, exists := s.meta.Volumes[name]
+	if !exists {
+		return VolumeRecord{}, 0, 0, nil, fmt.Errorf("%w: volume=%s", ErrVolumeNotFound, name)
+	}
+
+	if dataLength > 0 {
+		if dataLength%volume.SectorSize != 0 {
+			return VolumeRecord{}, 0, 0, nil, fmt.Errorf("%w: data length=%d is not a multiple of the sector size=%d", ErrOutOfRange, dataLength, volume.SectorSize)
+		}
+		count = uint64(dataLength / volume.SectorSize)
+	}
+
+	offset, length, err := volumeRange(volume, lba, count)
+	if err != nil {
+		return VolumeRecord{}, 0, 0, nil, err
+	}
+	if dataLength == 0 && length > MaxVolumeReadLength {
+		return VolumeRecord{}, 0, 0, nil, fmt.Errorf("%w: read length=%d is bigger than the maximum=%d", ErrOutOfRange, length, MaxVolumeReadLength)
+	}
+
+	regions := make(map[int64]block)
+	blockSize := int64(s.blockSize)
+	for index := offset / blockSize; index*blockSize < offset+length; index++ {
+		if id, allocated := volume.Blocks[index]; allocated {
+			regions[index] = block{id: id, checksum: s.meta.Blocks[id].Checksum}
+		}
+	}
+	return volume, offset, length, regions, nil
+}
+
+// regionLength returns the number of bytes of the region at index, only the last region can be smaller than blockSize.
+func regionLength(volume VolumeRecord, index int64, blockSize int64) int64 {
+	return min(blockSize, volume.Size-index*blockSize)
+}
+
+// ReadVolume reads count sectors of a volume starting at the logical block address lba.
+//
+// The regions of the volume never written are returned as zeros. A read bigger than
+// MaxVolumeReadLength returns an error wrapping ErrOutOfRange.
+func (s *Store) ReadVolume(name string, lba uint64, count uint32) ([]byte, error) {
+	slog.Info("Reading volume", "volume", name, "lba", lba, "sectors", count)
+
+	_, offset, length, regions, err := s.volumeRegions(name, lba, uint64(count), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	end := offset + length
+	blockSize := int64(s.blockSize)
+	for index := offset / blockSize; index*blockSize < end; index++ {
+		region, allocated := regions[index]
+		if !allocated {
+			// thin provisioned region, data already has zeros
+			continue
+		}
+
+		chunk, err := s.readBlock(region.id, region.checksum)
+		if err != nil {
+			return nil, fmt.Errorf("the volume=%s can not be read: %w", name, err)
+		}
+
+		regionStart := index * blockSize
+		from := max(offset, regionStart)
+		to := min(end, regionStart+int64(len(chunk)))
+		if from < to {
+			copy(data[from-offset:], chunk[from-regionStart:to-regionStart])
+		}
+	}
+
+	return data, nil
+}
+
+// WriteVolume writes data in a volume starting at the logical block address lba,
+// the length of data must be a multiple of the sector size.
+//
+// Only the regions touched by the write are saved again, a region that only contains
+// zeros after the write is deallocated. Writes of the same volume are serialized, a block
+// device receives many small writes in the same region from different connections.
+func (s *Store) WriteVolume(name string, lba uint64, data []byte) error {
+	slog.Info("Writing volume", "volume", name, "lba", lba, "bytes", len(data))
+
+	lock, _ := s.volumeLocks.LoadOrStore(name, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	for attempt := 1; ; attempt++ {
+		err := s.writeVolume(name, lba, data)
+		if !errors.Is(err, errConcurrentModification) || attempt == writeAtRetries {
+			return err
+		}
+		slog.Info("The volume was modified while it was written, retrying", "volume", name, "attempt", attempt)
+	}
+}
+
+func (s *Store) writeVolume(name string, lba uint64, data []byte) error {
+	volume, offset, length, regions, err := s.volumeRegions(name, lba, 0, len(data))
+	if err != nil {
+		return err
+	}
+
+	// build the new content of every region touched by the write
+	end := offset + length
+	var indexes []int64
+	var chunks [][]byte
+	blockSize := int64(s.blockSize)
+	for index := offset / blockSize; index*blockSize < end; index++ {
+		regionStart := index * blockSize
+		chunk := make([]byte, regionLength(volume, index, blockSize))
+
+		// a partial write of an allocated region needs the current content
+		from := max(offset, regionStart)
+		to := min(end, regionStart+int64(len(chunk)))
+		if region, allocated := regions[index]; allocated && (from > regionStart || to < regionStart+int64(len(chunk))) {
+			current, err := s.readBlock(region.id, region.checksum)
+			if err != nil {
+				return fmt.Errorf("the volume=%s can not be read: %w", name, err)
+			}
+			copy(chunk, current)
+		}
+
+		copy(chunk[from-regionStart:], data[from-offset:to-offset])
+		indexes = append(indexes, index)
+		chunks = append(chunks, chunk)
+	}
+
+	// the regions with only zeros are deallocated instead of written
+	var toWrite [][]byte
+	for _, chunk := range chunks {
+		if !isZero(chunk) {
+			toWrite = append(toWrite, chunk)
+		}
+	}
+
+	written, err := s.writeBlocks(toWrite)
+	if err != nil {
+		return err
+	}
+
+	rec := journalRecord{Op: journalOpVolumeWrite, Filename: name}
+	newBlocks := make([]block, 0, len(written))
+	next := 0
+	for i, chunk := range chunks {
+		rec.Regions = append(rec.Regions, indexes[i])
+		if isZero(chunk) {
+			rec.Blocks = append(rec.Blocks, "")
+			rec.Checksums = append(rec.Checksums, "")
+			continue
+		}
+
+		rec.Blocks = append(rec.Blocks, written[next].id)
+		rec.Checksums = append(rec.Checksums, written[next].checksum)
+		newBlocks = append(newBlocks, written[next])
+		next++
+	}
+
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+
+	current, exists := s.meta.Volumes[name]
+	if !exists {
+		s.deleteBlocks(blockIDs(written))
+		return fmt.Errorf("%w: volume=%s", ErrVolumeNotFound, name)
+	}
+
+	// another write changed the regions touched by this write
+	var replaced []string
+	for _, index := range indexes {
+		if current.Blocks[index] != regions[index].id {
+			s.deleteBlocks(blockIDs(written))
+			return errConcurrentModification
+		}
+		if region, allocated := regions[index]; allocated {
+			replaced = append(replaced, region.id)
+		}
+	}
+
+	if err := s.ensureBlocks(newBlocks); err != nil {
+		s.deleteBlocks(blockIDs(written))
+		return err
+	}
+	if err := s.commit(rec); err != nil {
+		s.deleteBlocks(blockIDs(written))
+		return fmt.Errorf("failed to update metadata for volume %s: %v", name, err)
+	}
+
+	if errs := s.deleteBlocks(replaced); len(errs) > 0 {
+		slog.Error("Error deleting replaced blocks on backend", "volume", name, "errors", errs)
+	}
+	return nil
+}
+
+// isZero reports if all the bytes of data are zero.
+func isZero(data []byte) bool {
+	for len(data) > 0 {
+		n := min(len(data), len(zeroBlock))
+		if !bytes.Equal(data[:n], zeroBlock[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+var zeroBlock = make([]byte, 4096)
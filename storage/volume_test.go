@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeThinProvisioning(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+
+	assert.Nil(t, store.CreateVolume("disk.img", 4*DefaultBlockSize, 512))
+
+	// a new volume reads as zeros and does not use space in the backend
+	data, err := store.ReadVolume("disk.img", 0, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 8*512), data)
+
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	info, err := store.Volume("disk.img")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4*DefaultBlockSize/512), info.Sectors())
+	assert.Zero(t, info.AllocatedBlocks)
+}
+
+func TestWriteVolume(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+	assert.Nil(t, store.CreateVolume("disk.img", 4*DefaultBlockSize, 512))
+
+	sector := bytes.Repeat([]byte{0xAB}, 512)
+	// lba 499 is the last sector of the first region, the write crosses into the second region
+	lba := uint64(DefaultBlockSize/512 - 1)
+	assert.Nil(t, store.WriteVolume("disk.img", lba, append(sector, sector...)))
+
+	data, err := store.ReadVolume("disk.img", lba-1, 4)
+	assert.Nil(t, err)
+	expected := append(make([]byte, 512), sector...)
+	expected = append(expected, sector...)
+	expected = append(expected, make([]byte, 512)...)
+	assert.Equal(t, expected, data)
+
+	info, err := store.Volume("disk.img")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, info.AllocatedBlocks)
+
+	// writing zeros over the data deallocates the regions
+	assert.Nil(t, store.WriteVolume("disk.img", lba, make([]byte, 1024)))
+	info, err = store.Volume("disk.img")
+	assert.Nil(t, err)
+	assert.Zero(t, info.AllocatedBlocks)
+}
+
+func TestVolumeErrors(t *testing.T) {
+	store := NewStore(NewMemoryBackend())
+
+	assert.ErrorIs(t, store.CreateVolume("disk.img", 4096, 1000), ErrInvalidVolume)
+	assert.ErrorIs(t, store.CreateVolume("disk.img", 1000, 512), ErrInvalidVolume)
+	assert.Nil(t, store.CreateVolume("disk.img", 4096, 512))
+	assert.ErrorIs(t, store.CreateVolume("disk.img", 4096, 512), ErrVolumeExists)
+
+	_, err := store.ReadVolume("missing.img", 0, 1)
+	assert.ErrorIs(t, err, ErrVolumeNotFound)
+	_, err = store.ReadVolume("disk.img", 7, 2)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+	assert.ErrorIs(t, store.WriteVolume("disk.img", 0, make([]byte, 100)), ErrOutOfRange)
+	assert.ErrorIs(t, store.WriteVolume("disk.img", 8, make([]byte, 512)), ErrOutOfRange)
+
+	// a thin volume can be bigger than the memory, the reads are limited
+	assert.Nil(t, store.CreateVolume("thin.img", 1<<40, MaxSectorSize))
+	_, err = store.ReadVolume("thin.img", 0, MaxVolumeReadLength/MaxSectorSize)
+	assert.Nil(t, err)
+	_, err = store.ReadVolume("thin.img", 0, math.MaxUint32)
+	assert.ErrorIs(t, err, ErrOutOfRange)
+}
+
+func TestDeleteVolume(t *testing.T) {
+	backend := NewMemoryBackend()
+	store := NewStore(backend)
+	assert.Nil(t, store.CreateVolume("disk.img", 4096, 512))
+	assert.Nil(t, store.WriteVolume("disk.img", 0, bytes.Repeat([]byte{0x01}, 512)))
+
+	assert.Nil(t, store.DeleteVolume("disk.img"))
+	assert.ErrorIs(t, store.DeleteVolume("disk.img"), ErrVolumeNotFound)
+
+	keys, err := backend.List()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestVolumeJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	blocksDir := filepath.Join(dir, "blocks")
+	metadataFile := filepath.Join(dir, "metadata.json")
+
+	store := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	assert.Nil(t, store.CreateVolume("disk.img", 8192, 4096))
+	assert.Nil(t, store.WriteVolume("disk.img", 1, bytes.Repeat([]byte{0x7F}, 4096)))
+
+	restarted := NewStore(NewDiskBackend(blocksDir, metadataFile))
+	data, err := restarted.ReadVolume("disk.img", 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, append(make([]byte, 4096), bytes.Repeat([]byte{0x7F}, 4096)...), data)
+}